@@ -369,6 +369,34 @@ func main() {
 	fmt.Fprintf(b, "PITSpeakerDummy = %d\n", C.KVM_PIT_SPEAKER_DUMMY)
 	fmt.Fprint(b, ")\n\n")
 
+	// ioeventfd flags
+
+	fmt.Fprintln(b, "const (")
+	fmt.Fprintf(b, "IOEventFDFlagDatamatch = %d\n", C.KVM_IOEVENTFD_FLAG_DATAMATCH)
+	fmt.Fprintf(b, "IOEventFDFlagPIO = %d\n", C.KVM_IOEVENTFD_FLAG_PIO)
+	fmt.Fprintf(b, "IOEventFDFlagDeassign = %d\n", C.KVM_IOEVENTFD_FLAG_DEASSIGN)
+	fmt.Fprint(b, ")\n\n")
+
+	// binary stats descriptor flags
+
+	fmt.Fprintln(b, "const (")
+	fmt.Fprintf(b, "StatsTypeMask = %#x\n", C.KVM_STATS_TYPE_MASK)
+	fmt.Fprintf(b, "StatsTypeCumulative = %#x\n", C.KVM_STATS_TYPE_CUMULATIVE)
+	fmt.Fprintf(b, "StatsTypeInstant = %#x\n", C.KVM_STATS_TYPE_INSTANT)
+	fmt.Fprintf(b, "StatsTypePeak = %#x\n", C.KVM_STATS_TYPE_PEAK)
+	fmt.Fprintf(b, "StatsTypeLinearHist = %#x\n", C.KVM_STATS_TYPE_LINEAR_HIST)
+	fmt.Fprintf(b, "StatsTypeLogHist = %#x\n", C.KVM_STATS_TYPE_LOG_HIST)
+	fmt.Fprintf(b, "StatsUnitMask = %#x\n", C.KVM_STATS_UNIT_MASK)
+	fmt.Fprintf(b, "StatsUnitNone = %#x\n", C.KVM_STATS_UNIT_NONE)
+	fmt.Fprintf(b, "StatsUnitBytes = %#x\n", C.KVM_STATS_UNIT_BYTES)
+	fmt.Fprintf(b, "StatsUnitSeconds = %#x\n", C.KVM_STATS_UNIT_SECONDS)
+	fmt.Fprintf(b, "StatsUnitCycles = %#x\n", C.KVM_STATS_UNIT_CYCLES)
+	fmt.Fprintf(b, "StatsUnitBoolean = %#x\n", C.KVM_STATS_UNIT_BOOLEAN)
+	fmt.Fprintf(b, "StatsBaseMask = %#x\n", C.KVM_STATS_BASE_MASK)
+	fmt.Fprintf(b, "StatsBasePow10 = %#x\n", C.KVM_STATS_BASE_POW10)
+	fmt.Fprintf(b, "StatsBasePow2 = %#x\n", C.KVM_STATS_BASE_POW2)
+	fmt.Fprint(b, ")\n\n")
+
 	// ioctls
 
 	fmt.Fprintln(b, "const (")
@@ -398,6 +426,8 @@ func main() {
 	fmt.Fprintf(b, "kGetSupportedCPUID = %#x\n", C.KVM_GET_SUPPORTED_CPUID)
 	fmt.Fprintf(b, "kSetCPUID2 = %#x\n", C.KVM_SET_CPUID2)
 	fmt.Fprintf(b, "kIRQFD = %#x\n", C.KVM_IRQFD)
+	fmt.Fprintf(b, "kGetStatsFD = %#x\n", C.KVM_GET_STATS_FD)
+	fmt.Fprintf(b, "kIOEventFD = %#x\n", C.KVM_IOEVENTFD)
 	fmt.Fprint(b, ")\n\n")
 
 	// misc constants
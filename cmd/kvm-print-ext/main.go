@@ -1,14 +1,34 @@
-// kvm-print-ext prints information about the KVM API and extensions.
+// kvm-print-ext prints information about the KVM API and extensions. If the -pid flag
+// is set, it prints the binary stats of a VM running in the given process instead. The
+// process must hold open binary stats fds, like the ones opened by vmm.New.
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/c35s/hype/kvm"
+	"golang.org/x/sys/unix"
 )
 
 func main() {
+	pid := flag.Int("pid", 0, "print the KVM stats of a running VM owned by this process")
+
+	flag.Parse()
+
+	if *pid != 0 {
+		if err := printStats(*pid); err != nil {
+			fmt.Fprintf(os.Stderr, "kvm-print-ext: %v\n", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	sys, err := os.Open("/dev/kvm")
 	if err != nil {
 		panic(err)
@@ -33,3 +53,77 @@ func main() {
 		fmt.Printf("%v: %v\n", c, v)
 	}
 }
+
+// printStats finds the binary stats fds owned by pid, copies them into this process
+// with pidfd_getfd, and prints their contents. KVM refuses VM and VCPU ioctls from
+// other processes, so the stats fds must already be open. The caller must be allowed
+// to ptrace pid.
+func printStats(pid int) error {
+	links, err := filepath.Glob(fmt.Sprintf("/proc/%d/fd/*", pid))
+	if err != nil {
+		return err
+	}
+
+	// anon inode name:target fd
+	targets := make(map[string]int)
+	for _, l := range links {
+		name, err := os.Readlink(l)
+		if err != nil {
+			continue
+		}
+
+		name, ok := strings.CutPrefix(name, "anon_inode:")
+		if !ok || !(name == "kvm-vm-stats" || strings.HasPrefix(name, "kvm-vcpu-stats:")) {
+			continue
+		}
+
+		var fd int
+		if _, err := fmt.Sscanf(filepath.Base(l), "%d", &fd); err == nil {
+			targets[name] = fd
+		}
+	}
+
+	if len(targets) == 0 {
+		return fmt.Errorf("process %d has no KVM stats fds", pid)
+	}
+
+	pfd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return fmt.Errorf("pidfd_open: %w", err)
+	}
+
+	defer unix.Close(pfd)
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		fd, err := unix.PidfdGetfd(pfd, targets[name], 0)
+		if err != nil {
+			return fmt.Errorf("pidfd_getfd %s: %w", name, err)
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		stats, err := kvm.ReadStats(f)
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		fmt.Printf("\n# %s\n", name)
+		for _, s := range stats {
+			if s.IsHistogram() || len(s.Value) != 1 {
+				fmt.Printf("%s: %v\n", s.Name, s.Value)
+				continue
+			}
+
+			fmt.Printf("%s: %d\n", s.Name, s.Value[0])
+		}
+	}
+
+	return nil
+}
@@ -11,3 +11,5 @@ require (
 	golang.org/x/sys v0.16.0
 	golang.org/x/term v0.16.0
 )
+
+require golang.org/x/crypto v0.18.0
@@ -55,6 +55,16 @@ type IRQFDConfig struct {
 	_          [16]uint8
 }
 
+// IOEventFDConfig has the same layout as struct kvm_ioeventfd.
+type IOEventFDConfig struct {
+	Datamatch uint64
+	Addr      uint64
+	Len       uint32
+	Fd        int32
+	Flags     uint32
+	_         [36]uint8
+}
+
 // StableAPIVersion is the expected return value of GetAPIVersion.
 const StableAPIVersion = 12
 
@@ -170,3 +180,32 @@ func IRQFD(vm *VM, cfg *IRQFDConfig) error {
 
 	return nil
 }
+
+// IOEventFD "attaches or detaches an ioeventfd to a legal pio/mmio address within the
+// guest. A guest write in the registered address will signal the provided event
+// instead of triggering an exit." If IOEventFDConfig.Flags includes
+// IOEventFDFlagDatamatch, "the event will only be signaled if the written value to the
+// registered address is equal to" IOEventFDConfig.Datamatch. The ioeventfd is removed
+// using the IOEventFDFlagDeassign flag with the same config. This ioctl is available if
+// CheckExtension(CapIOEventFD) returns 1.
+func IOEventFD(vm *VM, cfg *IOEventFDConfig) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, vm.Fd(), kIOEventFD, uintptr(unsafe.Pointer(cfg)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// GetStatsFD "returns a file descriptor that can be used to read VM or vCPU
+// statistics data in binary format." The given file should be a VM or VCPU. Use
+// ReadStats to parse the data. This ioctl is available if
+// CheckExtension(CapBinaryStatsFD) returns 1.
+func GetStatsFD(f interface{ Fd() uintptr }) (*os.File, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), kGetStatsFD, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	return os.NewFile(fd, "stats"), nil
+}
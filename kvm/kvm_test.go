@@ -360,6 +360,206 @@ func TestCreateIRQChip(t *testing.T) {
 	}
 }
 
+func TestIOEventFD(t *testing.T) {
+	sys, err := os.Open("/dev/kvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sys.Close()
+
+	ext, err := kvm.CheckExtension(sys, kvm.CapIOEventFD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ext != 1 {
+		t.Skipf("%v is %d", kvm.CapIOEventFD, ext)
+	}
+
+	vm, err := kvm.CreateVM(sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer vm.Close()
+
+	mem, err := unix.Mmap(-1, 0x0, 0x1000,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NORESERVE)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unix.Munmap(mem)
+
+	region := &kvm.UserspaceMemoryRegion{
+		GuestPhysAddr: 0x0,
+		MemorySize:    uint64(len(mem)),
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	}
+
+	if err := kvm.SetUserMemoryRegion(vm, region); err != nil {
+		t.Fatal(err)
+	}
+
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unix.Close(efd)
+
+	// 0x1000 is just past the end of memory, so writes to it are mmio
+	cfg := kvm.IOEventFDConfig{
+		Addr:      0x1000,
+		Len:       2,
+		Datamatch: 0xc35,
+		Fd:        int32(efd),
+		Flags:     kvm.IOEventFDFlagDatamatch,
+	}
+
+	if err := kvm.IOEventFD(vm, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	vcpu, err := kvm.CreateVCPU(vm, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer vcpu.Close()
+
+	mmapSz, err := kvm.GetVCPUMmapSize(sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawState, err := unix.Mmap(int(vcpu.Fd()), 0, mmapSz,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unix.Munmap(rawState)
+
+	state := (*kvm.VCPUState)(unsafe.Pointer(&rawState[0]))
+
+	var sregs kvm.Sregs
+	if err := kvm.GetSregs(vcpu, &sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	sregs.CS.Base = 0
+	sregs.CS.Selector = 0
+
+	if err := kvm.SetSregs(vcpu, &sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	var regs kvm.Regs
+	if err := kvm.GetRegs(vcpu, &regs); err != nil {
+		t.Fatal(err)
+	}
+
+	regs.RIP = 0
+
+	if err := kvm.SetRegs(vcpu, &regs); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(mem, []byte{
+		0xb8, 0x35, 0x0c, // mov ax, 0xc35
+		0xa3, 0x00, 0x10, // mov [0x1000], ax
+		0xf4, // hlt
+	})
+
+	if err := kvm.Run(vcpu); err != nil {
+		t.Fatal(err)
+	}
+
+	if state.ExitReason != kvm.ExitHLT {
+		t.Fatalf("%v != %v", state.ExitReason, kvm.ExitHLT)
+	}
+
+	buf := make([]byte, 8)
+	if _, err := unix.Read(efd, buf); err != nil {
+		t.Fatalf("eventfd not signaled: %v", err)
+	}
+
+	cfg.Flags |= kvm.IOEventFDFlagDeassign
+	if err := kvm.IOEventFD(vm, &cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	sys, err := os.Open("/dev/kvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sys.Close()
+
+	ext, err := kvm.CheckExtension(sys, kvm.CapBinaryStatsFD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ext != 1 {
+		t.Skipf("%v is %d", kvm.CapBinaryStatsFD, ext)
+	}
+
+	vm, err := kvm.CreateVM(sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer vm.Close()
+
+	vcpu, err := kvm.CreateVCPU(vm, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer vcpu.Close()
+
+	files := map[string]interface{ Fd() uintptr }{
+		"vm":   vm,
+		"vcpu": vcpu,
+	}
+
+	for name, f := range files {
+		sf, err := kvm.GetStatsFD(f)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		defer sf.Close()
+
+		stats, err := kvm.ReadStats(sf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if len(stats) == 0 {
+			t.Fatalf("%s: no stats", name)
+		}
+
+		for _, s := range stats {
+			if s.Name == "" {
+				t.Errorf("%s: unnamed stat: %+v", name, s)
+			}
+
+			if len(s.Value) != int(s.Size) {
+				t.Errorf("%s: %s: len(value) %d != size %d", name, s.Name, len(s.Value), s.Size)
+			}
+		}
+	}
+}
+
 func TestDeviceClosed(t *testing.T) {
 	devFn := map[string]func(*os.File) error{
 		"GetAPIVersion":   func(sys *os.File) error { _, err := kvm.GetAPIVersion(sys); return err },
@@ -405,6 +605,8 @@ func TestVMClosed(t *testing.T) {
 		"CheckExtension":      func(vm *kvm.VM) error { _, err := kvm.CheckExtension(vm, 0); return err },
 		"CreateVCPU":          func(vm *kvm.VM) error { _, err := kvm.CreateVCPU(vm, 0); return err },
 		"SetUserMemoryRegion": func(vm *kvm.VM) error { return kvm.SetUserMemoryRegion(vm, nil) },
+		"IOEventFD":           func(vm *kvm.VM) error { return kvm.IOEventFD(vm, nil) },
+		"GetStatsFD":          func(vm *kvm.VM) error { _, err := kvm.GetStatsFD(vm); return err },
 	}
 
 	for name, fn := range vmFn {
@@ -439,7 +641,8 @@ func TestVCPUClosed(t *testing.T) {
 	}
 
 	vcpuFn := map[string]func(vcpu *kvm.VCPU) error{
-		"Run": kvm.Run,
+		"Run":        kvm.Run,
+		"GetStatsFD": func(vcpu *kvm.VCPU) error { _, err := kvm.GetStatsFD(vcpu); return err },
 	}
 
 	for name, fn := range vcpuFn {
@@ -1031,6 +1031,30 @@ const (
 	PITSpeakerDummy = 1
 )
 
+const (
+	IOEventFDFlagDatamatch = 1
+	IOEventFDFlagPIO       = 2
+	IOEventFDFlagDeassign  = 4
+)
+
+const (
+	StatsTypeMask       = 0xf
+	StatsTypeCumulative = 0x0
+	StatsTypeInstant    = 0x1
+	StatsTypePeak       = 0x2
+	StatsTypeLinearHist = 0x3
+	StatsTypeLogHist    = 0x4
+	StatsUnitMask       = 0xf0
+	StatsUnitNone       = 0x0
+	StatsUnitBytes      = 0x10
+	StatsUnitSeconds    = 0x20
+	StatsUnitCycles     = 0x30
+	StatsUnitBoolean    = 0x40
+	StatsBaseMask       = 0xf00
+	StatsBasePow10      = 0x0
+	StatsBasePow2       = 0x100
+)
+
 const (
 	kGetAPIVersion          = 0xae00
 	kCreateVM               = 0xae01
@@ -1058,6 +1082,8 @@ const (
 	kGetSupportedCPUID      = 0xc008ae05
 	kSetCPUID2              = 0x4008ae90
 	kIRQFD                  = 0x4020ae76
+	kGetStatsFD             = 0xaece
+	kIOEventFD              = 0x4040ae79
 )
 
 const (
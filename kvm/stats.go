@@ -0,0 +1,126 @@
+//go:build linux
+
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StatsHeader has the same layout as the C struct kvm_stats_header. It is at the
+// beginning of the data read from a binary stats file descriptor.
+type StatsHeader struct {
+	Flags      uint32
+	NameSize   uint32
+	NumDesc    uint32
+	IDOffset   uint32
+	DescOffset uint32
+	DataOffset uint32
+}
+
+// StatsDesc describes a statistic. It has the same fields as the C struct
+// kvm_stats_desc, but the name is converted from a fixed-size byte array to a string.
+type StatsDesc struct {
+	Flags      uint32
+	Exponent   int16
+	Size       uint16
+	Offset     uint32
+	BucketSize uint32
+	Name       string
+}
+
+// Stat is a statistic and its value. Most statistics have exactly one value. Each
+// value of a histogram statistic is one of its buckets.
+type Stat struct {
+	StatsDesc
+	Value []uint64
+}
+
+// statsDescHeader is the fixed-size part of the C struct kvm_stats_desc.
+type statsDescHeader struct {
+	Flags      uint32
+	Exponent   int16
+	Size       uint16
+	Offset     uint32
+	BucketSize uint32
+}
+
+// ReadStats reads the binary statistics from r, which is normally a file returned by
+// GetStatsFD. The data is generated when it is read, so each call returns the current
+// values.
+func ReadStats(r io.ReaderAt) ([]Stat, error) {
+	var hdr StatsHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, 24), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("read stats header: %w", err)
+	}
+
+	// sanity limits: real headers have a name size of 48 and hundreds of descriptors
+	if hdr.NameSize == 0 || hdr.NameSize > 1<<12 || hdr.NumDesc > 1<<16 {
+		return nil, errors.New("malformed stats header")
+	}
+
+	var (
+		descSz = 16 + int64(hdr.NameSize)
+		descs  = make([]byte, descSz*int64(hdr.NumDesc))
+	)
+
+	if _, err := r.ReadAt(descs, int64(hdr.DescOffset)); err != nil {
+		return nil, fmt.Errorf("read stats descriptors: %w", err)
+	}
+
+	stats := make([]Stat, hdr.NumDesc)
+	for i := range stats {
+		raw := descs[int64(i)*descSz : int64(i+1)*descSz]
+
+		var dh statsDescHeader
+		if err := binary.Read(bytes.NewReader(raw[:16]), binary.LittleEndian, &dh); err != nil {
+			return nil, err
+		}
+
+		name, _, _ := bytes.Cut(raw[16:], []byte{0})
+
+		stats[i].StatsDesc = StatsDesc{
+			Flags:      dh.Flags,
+			Exponent:   dh.Exponent,
+			Size:       dh.Size,
+			Offset:     dh.Offset,
+			BucketSize: dh.BucketSize,
+			Name:       string(name),
+		}
+
+		data := make([]byte, 8*int(dh.Size))
+		if _, err := r.ReadAt(data, int64(hdr.DataOffset)+int64(dh.Offset)); err != nil {
+			return nil, fmt.Errorf("read stat %s: %w", name, err)
+		}
+
+		stats[i].Value = make([]uint64, dh.Size)
+		for j := range stats[i].Value {
+			stats[i].Value[j] = binary.LittleEndian.Uint64(data[8*j:])
+		}
+	}
+
+	return stats, nil
+}
+
+// Type returns the statistic's type, like StatsTypeCumulative.
+func (d StatsDesc) Type() uint32 {
+	return d.Flags & StatsTypeMask
+}
+
+// Unit returns the statistic's unit, like StatsUnitBytes.
+func (d StatsDesc) Unit() uint32 {
+	return d.Flags & StatsUnitMask
+}
+
+// Base returns the base of the statistic's exponent, like StatsBasePow10.
+func (d StatsDesc) Base() uint32 {
+	return d.Flags & StatsBaseMask
+}
+
+// IsHistogram returns true if the statistic is a linear or logarithmic histogram.
+func (d StatsDesc) IsHistogram() bool {
+	return d.Type() == StatsTypeLinearHist || d.Type() == StatsTypeLogHist
+}
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/c35s/hype/os/linux"
 	"github.com/c35s/hype/virtio"
+	"github.com/c35s/hype/virtio/nbd"
 	"github.com/c35s/hype/vmm"
 	"golang.org/x/sys/unix"
 	"golang.org/x/term"
@@ -27,11 +29,13 @@ func main() {
 		kernelPath = flag.String("kernel", "bzImage", "load bzImage from file or URL")
 		initrdPath = flag.String("initrd", "", "load initial ramdisk from file or URL")
 		cmdline    = flag.String("cmdline", "console=hvc0 reboot=t", "set the kernel command line")
+		metrics    = flag.String("metrics", "", "serve block device metrics for Prometheus at http://`addr`/metrics")
 
 		blkdev flagStrings
 	)
 
-	flag.Var(&blkdev, "block", "add a block device (multiple OK)")
+	flag.Var(&blkdev, "block", "add a block device backed by a file `path`, uring:///path[?direct], an http(s) or nbd URL, or mem:size; "+
+		"append :ro for read-only or :overlay for an in-memory write overlay (multiple OK)")
 
 	flag.Parse()
 
@@ -54,34 +58,70 @@ func main() {
 		ll.Initrd = initrd
 	}
 
+	console := &virtio.ConsoleDevice{
+		In:  os.Stdin,
+		Out: os.Stdout,
+	}
+
+	// the console follows the size of the terminal
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		sizeC := make(chan virtio.ConsoleSize)
+		console.Resize = sizeC
+
+		winchC := make(chan os.Signal, 1)
+		signal.Notify(winchC, unix.SIGWINCH)
+
+		go func() {
+			for {
+				if w, h, err := term.GetSize(fd); err == nil {
+					sizeC <- virtio.ConsoleSize{Cols: uint16(w), Rows: uint16(h)}
+				}
+
+				<-winchC
+			}
+		}()
+	}
+
 	cfg := vmm.Config{
 		MemSize: *memSize << 20,
 
 		Devices: []virtio.DeviceConfig{
-			&virtio.ConsoleDevice{
-				In:  os.Stdin,
-				Out: os.Stdout,
-			},
+			console,
 		},
 
 		Loader: ll,
 	}
 
-	// block devices
-	for _, s := range blkdev {
-		s, ro := strings.CutSuffix(s, ":ro")
+	// block devices; SIGHUP tells file-backed devices to re-read their sizes
+	var (
+		resizeCs []chan struct{}
+		closers  []io.Closer // closed after the VM
+	)
+
+	// metrics label block devices with the indexes of their -block flags
+	blkNames := make(map[int]string)
+
+	for n, s := range blkdev {
+		// an overlay keeps the guest's writes in memory, leaving the storage
+		// unchanged, so the storage under it is opened read-only
+		s, ro, overlay := cutBlockSuffixes(s)
+		baseRO := ro || overlay
+
 		u, err := url.Parse(s)
 		if err != nil {
 			panic(err)
 		}
 
-		var stg virtio.BlockStorage
+		var (
+			stg     virtio.BlockStorage
+			resizeC chan struct{}
+		)
 
 		switch u.Scheme {
 		case "file", "":
 			var flg int
 
-			if !ro {
+			if !baseRO {
 				flg = os.O_RDWR
 			}
 
@@ -90,16 +130,72 @@ func main() {
 				panic(err)
 			}
 
+			// qcow2 images have a fixed virtual size, so they can't be resized
+			if virtio.IsQCOW2(f) {
+				f.Close()
+				if stg, err = virtio.OpenQCOW2(u.Path, baseRO); err != nil {
+					panic(err)
+				}
+
+				break
+			}
+
 			stg = &virtio.FileStorage{
 				File: f,
 			}
 
+			resizeC = make(chan struct{}, 1)
+			resizeCs = append(resizeCs, resizeC)
+
+		case "uring":
+			flg := os.O_RDONLY
+
+			if !baseRO {
+				flg = os.O_RDWR
+			}
+
+			if u.Query().Has("direct") {
+				flg |= unix.O_DIRECT
+			}
+
+			f, err := os.OpenFile(u.Path, flg, 0)
+			if err != nil {
+				fatalf("hype: -block %s: %v", s, err)
+			}
+
+			if stg, err = virtio.NewUringStorage(f, 128); err != nil {
+				fatalf("hype: -block %s: %v", s, err)
+			}
+
+			// the storage doesn't close its file
+			closers = append(closers, f)
+
+			resizeC = make(chan struct{}, 1)
+			resizeCs = append(resizeCs, resizeC)
+
 		case "http", "https":
-			ro = true
+			baseRO = true
 			stg = &virtio.HTTPStorage{
-				URL: u.String(),
+				URL:       u.String(),
+				Readahead: 4,
+			}
+
+		case "nbd", "nbd+unix":
+			network, addr := "tcp", u.Host
+			if u.Scheme == "nbd+unix" {
+				network, addr = "unix", u.Query().Get("socket")
+			} else if u.Port() == "" {
+				addr = net.JoinHostPort(u.Hostname(), "10809")
+			}
+
+			c, err := nbd.Dial(network, addr, strings.TrimPrefix(u.Path, "/"))
+			if err != nil {
+				panic(err)
 			}
 
+			baseRO = baseRO || c.ReadOnly()
+			stg = c
+
 		case "mem":
 			sz, err := strconv.ParseInt(u.Opaque, 10, 64)
 			if err != nil {
@@ -114,17 +210,58 @@ func main() {
 			panic("unsupported block storage scheme: " + u.Scheme)
 		}
 
+		if overlay {
+			// the device closes the overlay, but not the storage under it
+			if c, ok := stg.(io.Closer); ok {
+				closers = append(closers, c)
+			}
+
+			if stg, err = virtio.NewOverlayStorage(stg, virtio.OverlayConfig{}); err != nil {
+				panic(err)
+			}
+		}
+
+		blkNames[len(cfg.Devices)] = strconv.Itoa(n)
 		cfg.Devices = append(cfg.Devices, &virtio.BlockDevice{
-			ReadOnly: ro,
-			Storage:  stg,
+			ReadOnly:     blockReadOnly(ro, overlay, baseRO),
+			Storage:      stg,
+			Resize:       resizeC,
+			CloseStorage: true,
 		})
 	}
 
+	if len(resizeCs) > 0 {
+		hupC := make(chan os.Signal, 1)
+		signal.Notify(hupC, unix.SIGHUP)
+
+		go func() {
+			for range hupC {
+				for _, c := range resizeCs {
+					select {
+					case c <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
 	m, err := vmm.New(cfg)
 	if err != nil {
 		panic(err)
 	}
 
+	if *metrics != "" {
+		l, err := net.Listen("tcp", *metrics)
+		if err != nil {
+			panic(err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler(m, blkNames))
+		go http.Serve(l, mux)
+	}
+
 	if term.IsTerminal(int(os.Stdin.Fd())) {
 		old, err := term.MakeRaw(int(os.Stdin.Fd()))
 		if err != nil {
@@ -137,13 +274,56 @@ func main() {
 	ctx, _ := signal.NotifyContext(context.Background(), unix.SIGINT, unix.SIGTERM)
 	err = m.Run(ctx)
 
-	if errors.Is(err, context.Canceled) {
-		return
+	if err != nil && !errors.Is(err, context.Canceled) {
+		panic(err)
 	}
 
-	if err != nil {
+	// closing the VM closes its block devices and their storage
+	if err := m.Close(); err != nil {
 		panic(err)
 	}
+
+	// in reverse, so storage is closed before the files under it
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// cutBlockSuffixes cuts the :ro and :overlay suffixes, in any order, from a
+// -block flag.
+func cutBlockSuffixes(s string) (path string, ro, overlay bool) {
+	for {
+		switch {
+		case strings.HasSuffix(s, ":ro"):
+			s, ro = strings.TrimSuffix(s, ":ro"), true
+
+		case strings.HasSuffix(s, ":overlay"):
+			s, overlay = strings.TrimSuffix(s, ":overlay"), true
+
+		default:
+			return s, ro, overlay
+		}
+	}
+}
+
+// blockReadOnly reports whether a block device is read-only, given the :ro and
+// :overlay suffixes of its -block flag and whether its storage is read-only.
+// The guest can write to an overlay over read-only storage unless the flag
+// has an explicit :ro.
+func blockReadOnly(ro, overlay, baseRO bool) bool {
+	if overlay {
+		return ro
+	}
+
+	return ro || baseRO
+}
+
+// fatalf reports an error setting up the VM and exits.
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
 }
 
 // readURL reads body from a file path or URL.
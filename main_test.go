@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestCutBlockSuffixes(t *testing.T) {
+	tests := []struct {
+		flag        string
+		path        string
+		ro, overlay bool
+	}{
+		{"disk.raw", "disk.raw", false, false},
+		{"disk.raw:ro", "disk.raw", true, false},
+		{"disk.raw:overlay", "disk.raw", false, true},
+		{"disk.raw:ro:overlay", "disk.raw", true, true},
+		{"disk.raw:overlay:ro", "disk.raw", true, true},
+		{"nbd://host/export:ro", "nbd://host/export", true, false},
+	}
+
+	for _, tt := range tests {
+		path, ro, overlay := cutBlockSuffixes(tt.flag)
+		if path != tt.path || ro != tt.ro || overlay != tt.overlay {
+			t.Errorf("%s: got %q, %v, %v", tt.flag, path, ro, overlay)
+		}
+	}
+}
+
+func TestBlockReadOnly(t *testing.T) {
+	tests := []struct {
+		flag   string
+		baseRO bool // the storage is read-only, like http storage
+		want   bool
+	}{
+		{"disk.raw", false, false},
+		{"disk.raw:ro", false, true},
+		{"disk.raw", true, true},
+		{"disk.raw:overlay", true, false},
+		{"disk.raw:ro:overlay", true, true},
+		{"disk.raw:overlay:ro", true, true},
+	}
+
+	for _, tt := range tests {
+		_, ro, overlay := cutBlockSuffixes(tt.flag)
+		if got := blockReadOnly(ro, overlay, tt.baseRO); got != tt.want {
+			t.Errorf("%s (storage read-only %v): got %v", tt.flag, tt.baseRO, got)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/c35s/hype/virtio"
+	"github.com/c35s/hype/vmm"
+)
+
+// metricsHandler serves the VM's block device statistics in the Prometheus
+// text format. names maps each block device's index in the VM config to the
+// value of its device label.
+func metricsHandler(m *vmm.VM, names map[int]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := m.BlockStats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("content-type", "text/plain; version=0.0.4")
+
+		// the status is sent, so the scraper just sees a truncated response
+		if err := writeBlockMetrics(w, stats, names); err != nil {
+			slog.Warn("metrics", "err", err)
+		}
+	})
+}
+
+// writeBlockMetrics writes stats in the Prometheus text format.
+func writeBlockMetrics(w io.Writer, stats map[int]virtio.BlockStats, names map[int]string) error {
+	bw := bufio.NewWriter(w)
+
+	idx := make([]int, 0, len(stats))
+	for i := range stats {
+		idx = append(idx, i)
+	}
+
+	slices.Sort(idx)
+
+	type op struct {
+		name string
+		get  func(virtio.BlockStats) virtio.BlockOpStats
+	}
+
+	ops := []op{
+		{"read", func(s virtio.BlockStats) virtio.BlockOpStats { return s.Read }},
+		{"write", func(s virtio.BlockStats) virtio.BlockOpStats { return s.Write }},
+		{"flush", func(s virtio.BlockStats) virtio.BlockOpStats { return s.Flush }},
+		{"discard", func(s virtio.BlockStats) virtio.BlockOpStats { return s.Discard }},
+		{"write_zeroes", func(s virtio.BlockStats) virtio.BlockOpStats { return s.WriteZeroes }},
+	}
+
+	counter := func(name, help string, get func(virtio.BlockOpStats) uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, i := range idx {
+			for _, o := range ops {
+				fmt.Fprintf(bw, "%s{device=%q,op=%q} %d\n", name, names[i], o.name, get(o.get(stats[i])))
+			}
+		}
+	}
+
+	counter("hype_block_requests_total", "Completed block requests.", func(s virtio.BlockOpStats) uint64 { return s.Ops })
+	counter("hype_block_bytes_total", "Bytes read or written by block requests.", func(s virtio.BlockOpStats) uint64 { return s.Bytes })
+	counter("hype_block_errors_total", "Failed block requests.", func(s virtio.BlockOpStats) uint64 { return s.Errors })
+
+	fmt.Fprintf(bw, "# HELP hype_block_in_flight Block requests being executed.\n# TYPE hype_block_in_flight gauge\n")
+	for _, i := range idx {
+		fmt.Fprintf(bw, "hype_block_in_flight{device=%q} %d\n", names[i], stats[i].InFlight)
+	}
+
+	const lat = "hype_block_latency_seconds"
+	fmt.Fprintf(bw, "# HELP %s Block request latency.\n# TYPE %s histogram\n", lat, lat)
+	for _, i := range idx {
+		for _, o := range ops {
+			h := o.get(stats[i]).Latency
+			labels := fmt.Sprintf("device=%q,op=%q", names[i], o.name)
+
+			// prometheus buckets are cumulative
+			var n uint64
+			for b, c := range h.Counts {
+				n += c
+
+				le := "+Inf"
+				if b < len(h.Bounds) {
+					le = strconv.FormatFloat(h.Bounds[b].Seconds(), 'g', -1, 64)
+				}
+
+				fmt.Fprintf(bw, "%s_bucket{%s,le=%q} %d\n", lat, labels, le, n)
+			}
+
+			fmt.Fprintf(bw, "%s_sum{%s} %g\n", lat, labels, h.Sum.Seconds())
+			fmt.Fprintf(bw, "%s_count{%s} %d\n", lat, labels, n)
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c35s/hype/virtio"
+)
+
+func TestWriteBlockMetrics(t *testing.T) {
+	read := virtio.BlockOpStats{
+		Ops:   3,
+		Bytes: 12288,
+		Latency: virtio.LatencyHistogram{
+			Bounds: []time.Duration{time.Millisecond, 10 * time.Millisecond},
+			Counts: []uint64{1, 2, 0},
+			Sum:    15 * time.Millisecond,
+		},
+	}
+
+	stats := map[int]virtio.BlockStats{
+		3: {Read: read, InFlight: 2},
+		1: {Write: virtio.BlockOpStats{Ops: 1, Errors: 1}},
+	}
+
+	var b strings.Builder
+	if err := writeBlockMetrics(&b, stats, map[int]string{1: "0", 3: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE hype_block_requests_total counter",
+		`hype_block_requests_total{device="1",op="read"} 3`,
+		`hype_block_bytes_total{device="1",op="read"} 12288`,
+		`hype_block_errors_total{device="0",op="write"} 1`,
+		"# TYPE hype_block_in_flight gauge",
+		`hype_block_in_flight{device="1"} 2`,
+		"# TYPE hype_block_latency_seconds histogram",
+		`hype_block_latency_seconds_bucket{device="1",op="read",le="0.001"} 1`,
+		`hype_block_latency_seconds_bucket{device="1",op="read",le="0.01"} 3`,
+		`hype_block_latency_seconds_bucket{device="1",op="read",le="+Inf"} 3`,
+		`hype_block_latency_seconds_sum{device="1",op="read"} 0.015`,
+		`hype_block_latency_seconds_count{device="1",op="read"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+
+	// devices are sorted by index
+	if strings.Index(out, `{device="0"`) > strings.Index(out, `{device="1"`) {
+		t.Error("devices are out of order")
+	}
+
+	if err := writeBlockMetrics(errWriter{}, stats, nil); err == nil {
+		t.Error("no error from a failed write")
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
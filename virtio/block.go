@@ -3,15 +3,18 @@ package virtio
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net/http"
+	"math/bits"
 	"os"
-	"strconv"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/c35s/hype/virtio/virtq"
+	"golang.org/x/sys/unix"
 )
 
 // BlockDevice configures a virtio block device.
@@ -23,10 +26,36 @@ type BlockDevice struct {
 	// Storage is the backing storage for the device. Storage may also
 	// implement the io.WriterAt interface to enable writes.
 	Storage BlockStorage
+
+	// NumQueues is the number of request queues. The guest may use one queue per
+	// CPU to submit requests in parallel. If it's zero, the device has one queue.
+	NumQueues int
+
+	// Serial is the device's serial number, reported to the guest by the get ID
+	// command. It is at most 20 bytes long. If it's empty, the command fails.
+	Serial string
+
+	// Resize, if set, signals that the storage size changed. After each receive,
+	// the device sends a config change notification, and the guest reads the new
+	// capacity. Closing the channel stops the device from watching it.
+	Resize <-chan struct{}
+
+	// RateLimiter, if set, limits the device's request and data rates. Each
+	// queue waits for the limiter before it takes a request. Change the limit
+	// to throttle the device while it's running.
+	RateLimiter *RateLimiter
+
+	// CloseStorage causes the device to close Storage when it's closed, after
+	// its last request completes, if Storage implements io.Closer. Closing an
+	// OverlayStorage commits or discards its overlay.
+	CloseStorage bool
 }
 
 // BlockStorage is the basic interface to a block device's backing storage. It is
 // read-only: To enable writes, storage types should also implement io.WriterAt.
+// Writable storage may implement Syncer, Discarder, and ZeroWriter to support
+// the corresponding block commands, and ReadOnlyReporter if it isn't always
+// writable.
 type BlockStorage interface {
 	io.ReaderAt
 
@@ -34,6 +63,87 @@ type BlockStorage interface {
 	Size() (int64, error)
 }
 
+// Syncer is implemented by block storage that caches writes. If the storage
+// implements it, the device supports the flush command.
+type Syncer interface {
+
+	// Sync commits all completed writes to durable storage.
+	Sync() error
+}
+
+// Discarder is implemented by block storage that can deallocate ranges. If the
+// storage implements it, the device supports the discard command.
+type Discarder interface {
+
+	// Discard deallocates n bytes at off. The contents of the range are
+	// undefined until they are written again.
+	Discard(off, n int64) error
+}
+
+// ReadOnlyReporter is implemented by block storage that implements io.WriterAt
+// but may not be writable, like storage opened read-only. If ReadOnly returns
+// true, the device is read-only.
+type ReadOnlyReporter interface {
+	ReadOnly() bool
+}
+
+// TopologyReporter is implemented by block storage with a logical block size
+// other than 512 bytes, or with preferred I/O sizes. The device reports the
+// storage's topology to the guest.
+type TopologyReporter interface {
+	Topology() BlockTopology
+}
+
+// BlockTopology describes the block sizes and I/O alignment of block storage.
+// All sizes are in bytes.
+type BlockTopology struct {
+
+	// LogicalBlockSize is the smallest addressable unit. It must be a power of 2
+	// of at least 512. If it's zero, 512 is used.
+	LogicalBlockSize uint32
+
+	// PhysicalBlockSize is the smallest unit written without a read-modify-write
+	// cycle. It must be a power of 2 multiple of the logical block size. If it's
+	// zero, the logical block size is used.
+	PhysicalBlockSize uint32
+
+	// AlignmentOffset is the offset of the first logical block aligned to a
+	// physical block, in logical blocks.
+	AlignmentOffset uint8
+
+	// MinIOSize and OptIOSize are the suggested minimum and optimal I/O sizes.
+	// They must be multiples of the logical block size.
+	MinIOSize uint32
+	OptIOSize uint32
+}
+
+// AsyncStorage is implemented by block storage that executes reads, writes, and
+// flushes asynchronously. If the storage implements it, the device submits those
+// requests without waiting for them to complete. Other requests still run
+// synchronously, and the device offers flushes only if the storage also
+// implements Syncer.
+type AsyncStorage interface {
+
+	// ReadAsync reads into bufs from off. It calls done with the number of bytes
+	// read, which is less than the length of bufs only if err is not nil.
+	ReadAsync(bufs [][]byte, off int64, done func(n int, err error))
+
+	// WriteAsync writes bufs at off. It calls done with the number of bytes
+	// written, which is less than the length of bufs only if err is not nil.
+	WriteAsync(bufs [][]byte, off int64, done func(n int, err error))
+
+	// SyncAsync commits all completed writes to durable storage, then calls done.
+	SyncAsync(done func(err error))
+}
+
+// ZeroWriter is implemented by block storage that can zero ranges efficiently.
+// If the storage implements it, the device supports the write zeroes command.
+type ZeroWriter interface {
+
+	// WriteZeroesAt zeroes n bytes at off.
+	WriteZeroesAt(off, n int64) error
+}
+
 // MemStorage is read-write block storage backed by a byte slice.
 type MemStorage struct {
 	Bytes []byte
@@ -44,21 +154,21 @@ type FileStorage struct {
 	File *os.File
 }
 
-// HTTP storage is read-only block storage backed by an HTTP URL.
-// The server must support HEAD requests and GET requests with a Range header.
-type HTTPStorage struct {
-	URL string
-
-	// Client is the HTTP client to use for requests.
-	// If nil, http.DefaultClient is used.
-	Client *http.Client
-}
-
 type blockHandler struct {
-	cfg BlockDevice
-	r   io.ReaderAt
-	w   io.WriterAt
-	wg  sync.WaitGroup
+	cfg   BlockDevice
+	topo  *BlockTopology
+	r     io.ReaderAt
+	w     io.WriterAt
+	s     Syncer
+	a     AsyncStorage
+	d     Discarder
+	z     ZeroWriter
+	wg    sync.WaitGroup
+	doneC chan struct{}
+	stats blkStats
+
+	mu            sync.Mutex
+	configChanged func()
 }
 
 // blkConfig has the same fields as struct virtio_blk_config.
@@ -165,43 +275,162 @@ const (
 	blkSUnsupp = 2
 )
 
+// discard and write zeroes limits
+
+const (
+	blkMaxDiscardSectors = 1 << 22 // 2 GiB per segment
+	blkMaxDiscardSeg     = 256
+	blkDiscardAlignment  = 8 // 4 KiB
+	blkMaxZeroesSectors  = 1 << 22
+	blkMaxZeroesSeg      = 256
+)
+
+// other limits
+
+const (
+	blkIDBytes = 20      // length of the get ID response
+	blkSizeMax = 1 << 20 // max size of a data segment
+	blkSegMax  = 126     // max data segments per request
+
+	blkMaxQueues  = 16 // the mmio bus supports 16 queues per device
+	blkQueueDepth = 64 // max requests in flight per queue
+)
+
+// discard and write zeroes flags
+
+const (
+	blkDWZFUnmap = 1 << 0 // the device may deallocate zeroed sectors
+)
+
 func (cfg BlockDevice) NewHandler() (DeviceHandler, error) {
-	h := &blockHandler{cfg: cfg, r: cfg.Storage}
+	if cfg.NumQueues < 0 || cfg.NumQueues > blkMaxQueues {
+		return nil, fmt.Errorf("block device queue count %d is not in [0, %d]", cfg.NumQueues, blkMaxQueues)
+	}
+
+	if len(cfg.Serial) > blkIDBytes {
+		return nil, fmt.Errorf("block device serial %q is longer than %d bytes", cfg.Serial, blkIDBytes)
+	}
+
+	h := &blockHandler{
+		cfg:   cfg,
+		r:     cfg.Storage,
+		doneC: make(chan struct{}),
+	}
+
+	if tr, ok := cfg.Storage.(TopologyReporter); ok {
+		topo, err := checkTopology(tr.Topology())
+		if err != nil {
+			return nil, err
+		}
+
+		h.topo = &topo
+	}
+
+	ro := cfg.ReadOnly
+	if rr, ok := cfg.Storage.(ReadOnlyReporter); ok && rr.ReadOnly() {
+		ro = true
+	}
 
-	if !cfg.ReadOnly {
+	if !ro {
 		h.w, _ = cfg.Storage.(io.WriterAt)
 	}
 
+	h.a, _ = cfg.Storage.(AsyncStorage)
+
+	if h.w != nil {
+		h.s, _ = cfg.Storage.(Syncer)
+		h.d, _ = cfg.Storage.(Discarder)
+		h.z, _ = cfg.Storage.(ZeroWriter)
+	}
+
+	if cfg.Resize != nil {
+		h.wg.Add(1)
+		go h.watchResize()
+	}
+
 	return h, nil
 }
 
+// watchResize sends a config change notification for each resize signal
+// received after the device is ready. It returns when the handler is closed.
+func (h *blockHandler) watchResize() {
+	defer h.wg.Done()
+	for {
+		select {
+		case _, ok := <-h.cfg.Resize:
+			if !ok {
+				return
+			}
+
+			h.mu.Lock()
+			notify := h.configChanged
+			h.mu.Unlock()
+
+			if notify != nil {
+				notify()
+			}
+
+		case <-h.doneC:
+			return
+		}
+	}
+}
+
 func (h *blockHandler) GetType() DeviceID {
 	return BlockDeviceID
 }
 
 func (h *blockHandler) GetFeatures() (features uint64) {
+	features = blkFSizeMax | blkFSegMac
+
+	if h.numQueues() > 1 {
+		features |= blkFMQ
+	}
+
+	if h.topo != nil {
+		features |= blkFBlkSize | blkFTopology
+	}
+
 	if h.w == nil {
-		return blkFRO
+		return features | blkFRO
+	}
+
+	if h.s != nil {
+		features |= blkFFlush
+	}
+
+	if h.d != nil {
+		features |= blkFDiscard
+	}
+
+	if h.z != nil {
+		features |= blkFWriteZeroes
 	}
 
 	return
 }
 
-func (h *blockHandler) Ready(negotiatedFeatures uint64) error {
+func (h *blockHandler) Ready(negotiatedFeatures uint64, configChanged func()) error {
 	if h.w == nil && negotiatedFeatures&blkFRO == 0 {
-		panic("block device is read-only")
+		return errors.New("block device is read-only, but the driver didn't accept the read-only feature")
 	}
 
+	h.mu.Lock()
+	h.configChanged = configChanged
+	h.mu.Unlock()
+
 	return nil
 }
 
-func (h *blockHandler) QueueReady(num int, q *virtq.Queue, notify <-chan struct{}) error {
-	if num == 0 {
+func (h *blockHandler) QueueReady(num int, q virtq.Queue, notify <-chan struct{}) error {
+	if num < h.numQueues() {
+		sem := make(chan struct{}, blkQueueDepth)
+
 		h.wg.Add(1)
 		go func() {
 			defer h.wg.Done()
 			for range notify {
-				if err := h.handle(q); err != nil {
+				if err := h.handle(q, sem); err != nil {
 					slog.Error("block handler", "error", err)
 				}
 			}
@@ -211,7 +440,12 @@ func (h *blockHandler) QueueReady(num int, q *virtq.Queue, notify <-chan struct{
 	return nil
 }
 
-func (h *blockHandler) handle(q *virtq.Queue) error {
+// handle executes the available requests in q, each on its own goroutine. The
+// capacity of sem limits the number of requests in flight.
+func (h *blockHandler) handle(q virtq.Queue, sem chan struct{}) error {
+	q.DisableNotify()
+	defer q.EnableNotify()
+
 	for {
 		c, err := q.Next()
 		if err != nil {
@@ -219,88 +453,465 @@ func (h *blockHandler) handle(q *virtq.Queue) error {
 		}
 
 		if c == nil {
+			if !q.EnableNotify() {
+				return nil
+			}
+
+			q.DisableNotify()
+			continue
+		}
+
+		// the handler is closing if the wait is canceled
+		if rl := h.cfg.RateLimiter; rl != nil && !rl.Wait(chainDataLen(c), h.doneC) {
 			return nil
 		}
 
-		if len(c.Desc) != 3 {
-			panic("invalid descriptor chain length")
+		sem <- struct{}{}
+		h.wg.Add(1)
+		h.stats.inFlight.Add(1)
+		start := time.Now()
+
+		done := func() {
+			<-sem
+			h.wg.Done()
+		}
+
+		if h.a != nil {
+			h.handleChainAsync(c, start, done)
+			continue
 		}
 
-		hd := c.Desc[0]
-		dd := c.Desc[1]
-		sd := c.Desc[2]
+		go func() {
+			defer done()
 
-		if !hd.IsRO() {
-			panic("descriptor 0 (hdr) is not read-only")
+			if err := h.handleChain(c, start); err != nil {
+				slog.Error("block handler", "error", err)
+			}
+		}()
+	}
+}
+
+// chainDataLen returns the size of the data in the request in c, which is
+// the length of its buffers without the header and the status byte.
+func chainDataLen(c *virtq.Chain) int64 {
+	var n int64
+	for _, d := range c.Desc {
+		n += int64(d.Len)
+	}
+
+	return max(n-16-1, 0)
+}
+
+// blkRequest is a block request parsed from a descriptor chain.
+type blkRequest struct {
+	optype uint32
+	sector uint64
+	out    [][]byte // device-readable data after the header
+	in     [][]byte // device-writable data before the status byte
+	status []byte   // the last device-writable byte
+}
+
+// handleChain executes the request in c, which was taken from its queue at
+// start, and releases it. Malformed requests fail with an I/O error if they have
+// a status byte, and are released unchanged if not.
+func (h *blockHandler) handleChain(c *virtq.Chain, start time.Time) error {
+	req, err := parseBlkRequest(c)
+	if err != nil {
+		h.stats.inFlight.Add(-1)
+		return failChain(c, req, err)
+	}
+
+	status, n, err := h.execute(req)
+	h.record(req, start, status, err)
+	return completeChain(c, req, status, n, err)
+}
+
+// handleChainAsync submits the read, write, or flush request in c to the async
+// storage, and executes other requests on a new goroutine. It calls done after c
+// is released.
+func (h *blockHandler) handleChainAsync(c *virtq.Chain, start time.Time, done func()) {
+	complete := func(req *blkRequest, status byte, n int, err error) {
+		defer done()
+
+		h.record(req, start, status, err)
+
+		if err := completeChain(c, req, status, n, err); err != nil {
+			slog.Error("block handler", "error", err)
 		}
+	}
+
+	req, err := parseBlkRequest(c)
+	if err != nil {
+		defer done()
 
-		if !sd.IsWO() {
-			panic("descriptor 2 (status) is not write-only")
+		h.stats.inFlight.Add(-1)
+		if err := failChain(c, req, err); err != nil {
+			slog.Error("block handler", "error", err)
 		}
 
-		hdr, err := c.Buf(0)
-		if err != nil {
-			return err
+		return
+	}
+
+	switch {
+	case req.optype == blkTIn:
+		off, ok := h.checkRange(req.sector, sgLen(req.in))
+		if !ok {
+			complete(req, blkSIOErr, 0, nil)
+			return
 		}
 
-		if len(hdr) != 16 {
-			panic("invalid hdr buffer length")
+		h.a.ReadAsync(req.in, off, func(n int, err error) {
+			complete(req, blkSOK, n, err)
+		})
+
+	case req.optype == blkTOut && h.w != nil:
+		off, ok := h.checkRange(req.sector, sgLen(req.out))
+		if !ok {
+			complete(req, blkSIOErr, 0, nil)
+			return
 		}
 
-		data, err := c.Buf(1)
-		if err != nil {
-			return err
+		h.a.WriteAsync(req.out, off, func(n int, err error) {
+			complete(req, blkSOK, 0, err)
+		})
+
+	case req.optype == blkTFlush && h.s != nil:
+		h.a.SyncAsync(func(err error) {
+			complete(req, blkSOK, 0, err)
+		})
+
+	default:
+		go func() {
+			status, n, err := h.execute(req)
+			complete(req, status, n, err)
+		}()
+	}
+}
+
+// record counts req, which was taken from its queue at start and completed
+// with status and err, in the handler's statistics. It's called before the
+// request is released, so the driver never sees a used request in flight.
+func (h *blockHandler) record(req *blkRequest, start time.Time, status byte, err error) {
+	h.stats.inFlight.Add(-1)
+
+	s := h.stats.op(req.optype)
+	if s == nil {
+		return
+	}
+
+	failed := status != blkSOK || err != nil
+
+	var n int
+	if !failed && req.optype == blkTIn {
+		n = sgLen(req.in)
+	} else if !failed && req.optype == blkTOut {
+		n = sgLen(req.out)
+	}
+
+	s.record(start, n, failed)
+}
+
+// failChain releases the malformed request in c. If the request has a status
+// byte, failChain sets it to blkSIOErr.
+func failChain(c *virtq.Chain, req *blkRequest, err error) error {
+	slog.Error("block request", "err", err)
+
+	if req == nil {
+		return c.Release(0)
+	}
+
+	req.status[0] = blkSIOErr
+	return c.Release(1)
+}
+
+// completeChain sets the status of req, which wrote n bytes, and releases c.
+func completeChain(c *virtq.Chain, req *blkRequest, status byte, n int, err error) error {
+	if err != nil {
+		status = blkSIOErr
+		slog.Error("block io error", "err", err)
+	}
+
+	req.status[0] = status
+
+	// the device writes n data bytes and the status byte
+	return c.Release(n + 1)
+}
+
+// execute executes req, returning its status and the number of bytes written to
+// its device-writable buffers, not counting the status byte.
+func (h *blockHandler) execute(req *blkRequest) (status byte, n int, err error) {
+	switch req.optype {
+	case blkTIn:
+		off, ok := h.checkRange(req.sector, sgLen(req.in))
+		if !ok {
+			return blkSIOErr, 0, nil
 		}
 
-		status, err := c.Buf(2)
-		if err != nil {
-			return err
+		n, err = sgReadAt(h.r, req.in, off)
+		return blkSOK, n, err
+
+	case blkTOut:
+		if h.w == nil {
+			return blkSUnsupp, 0, nil
 		}
 
-		if len(status) != 1 {
-			panic("invalid status buffer length")
+		off, ok := h.checkRange(req.sector, sgLen(req.out))
+		if !ok {
+			return blkSIOErr, 0, nil
 		}
 
-		var (
-			optype = binary.LittleEndian.Uint32(hdr)
-			offsec = binary.LittleEndian.Uint32(hdr[8:])
-		)
+		_, err = sgWriteAt(h.w, req.out, off)
+		return blkSOK, 0, err
 
-		var n int
-		switch optype {
-		case blkTIn:
-			if !dd.IsWO() {
-				panic("descriptor 1 (data) is not write-only")
-			}
+	case blkTGetID:
+		if h.cfg.Serial == "" {
+			return blkSUnsupp, 0, nil
+		}
 
-			n, err = h.cfg.Storage.ReadAt(data, int64(offsec)*512)
+		// shorter IDs are padded with zeroes
+		id := make([]byte, blkIDBytes)
+		copy(id, h.cfg.Serial)
+		return blkSOK, sgCopy(req.in, id), nil
 
-		case blkTOut:
-			if h.w == nil {
-				status[0] = blkSUnsupp
-				break
-			}
+	case blkTFlush:
+		if h.s == nil {
+			return blkSUnsupp, 0, nil
+		}
 
-			if !dd.IsRO() {
-				panic("descriptor 1 (data) is not read-only")
-			}
+		return blkSOK, 0, h.s.Sync()
+
+	case blkTDiscard, blkTWriteZeroes:
+		if (req.optype == blkTDiscard && h.d == nil) || (req.optype == blkTWriteZeroes && h.z == nil) {
+			return blkSUnsupp, 0, nil
+		}
+
+		// segments are small, so copy them together
+		if sgLen(req.out) > 16*max(blkMaxDiscardSeg, blkMaxZeroesSeg) {
+			return blkSIOErr, 0, nil
+		}
 
-			n, err = h.w.WriteAt(data, int64(offsec)*512)
+		status, err = h.discardOrZero(req.optype, bytes.Join(req.out, nil))
+		return status, 0, err
+
+	default:
+		return blkSUnsupp, 0, nil
+	}
+}
+
+// checkRange returns the byte offset of sector, and true if a transfer of n
+// bytes at that offset is a whole number of sectors within the storage.
+func (h *blockHandler) checkRange(sector uint64, n int) (int64, bool) {
+	if n%512 != 0 {
+		return 0, false
+	}
+
+	sz, err := h.cfg.Storage.Size()
+	if err != nil {
+		slog.Error("block storage size", "err", err)
+		return 0, false
+	}
+
+	capacity := uint64(sz / 512)
+	if sector > capacity || uint64(n/512) > capacity-sector {
+		return 0, false
+	}
+
+	return int64(sector * 512), true
+}
+
+// parseBlkRequest parses the request in c. Its device-readable buffers hold the
+// 16-byte header followed by any data, and its device-writable buffers hold any
+// data followed by the status byte. The header and data may be split among any
+// number of descriptors. If the request is malformed but has a status byte,
+// parseBlkRequest returns the partial request along with an error.
+func parseBlkRequest(c *virtq.Chain) (*blkRequest, error) {
+	var (
+		ro, wo [][]byte
+		bufErr error
+	)
+
+	for i, d := range c.Desc {
+		buf, err := c.Buf(i)
+		if err != nil && bufErr == nil {
+			bufErr = err
+		}
+
+		switch {
+		case d.IsWO():
+			wo = append(wo, buf)
+
+		case len(wo) > 0 && bufErr == nil:
+			bufErr = errors.New("device-readable descriptor follows a device-writable descriptor")
 
 		default:
-			status[0] = blkSUnsupp
+			ro = append(ro, buf)
+		}
+	}
+
+	// the status byte is the last byte of the last non-empty writable buffer
+	for len(wo) > 0 && len(wo[len(wo)-1]) == 0 {
+		wo = wo[:len(wo)-1]
+	}
+
+	if len(wo) == 0 {
+		return nil, errors.New("request has no status byte")
+	}
+
+	last := wo[len(wo)-1]
+	req := &blkRequest{
+		status: last[len(last)-1:],
+		in:     wo[:len(wo)-1],
+	}
+
+	if len(last) > 1 {
+		req.in = append(req.in[:len(req.in):len(req.in)], last[:len(last)-1])
+	}
+
+	if bufErr != nil {
+		return req, bufErr
+	}
+
+	hdr := make([]byte, 16)
+	if sgCopy([][]byte{hdr}, ro...) != len(hdr) {
+		return req, errors.New("request header is too short")
+	}
+
+	req.optype = binary.LittleEndian.Uint32(hdr)
+	req.sector = binary.LittleEndian.Uint64(hdr[8:])
+	req.out = sgSkip(ro, len(hdr))
+
+	return req, nil
+}
+
+// sgLen returns the total length of bufs.
+func sgLen(bufs [][]byte) (n int) {
+	for _, b := range bufs {
+		n += len(b)
+	}
+
+	return
+}
+
+// sgSkip returns bufs without its first n bytes.
+func sgSkip(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+
+	if len(bufs) == 0 {
+		return nil
+	}
+
+	return append([][]byte{bufs[0][n:]}, bufs[1:]...)
+}
+
+// sgCopy copies from the src buffers to the dst buffers, returning the number of
+// bytes copied.
+func sgCopy(dst [][]byte, src ...[]byte) (n int) {
+	dst, src = slices.Clone(dst), slices.Clone(src)
+
+	for len(dst) > 0 && len(src) > 0 {
+		k := copy(dst[0], src[0])
+		n += k
+
+		if dst[0] = dst[0][k:]; len(dst[0]) == 0 {
+			dst = dst[1:]
 		}
 
+		if src[0] = src[0][k:]; len(src[0]) == 0 {
+			src = src[1:]
+		}
+	}
+
+	return
+}
+
+// sgReadAt reads into bufs from r at off.
+func sgReadAt(r io.ReaderAt, bufs [][]byte, off int64) (n int, err error) {
+	for _, b := range bufs {
+		k, err := r.ReadAt(b, off)
+		n += k
+		off += int64(k)
+
+		if err != nil && !(err == io.EOF && k == len(b)) {
+			return n, err
+		}
+	}
+
+	return
+}
+
+// sgWriteAt writes bufs to w at off.
+func sgWriteAt(w io.WriterAt, bufs [][]byte, off int64) (n int, err error) {
+	for _, b := range bufs {
+		k, err := w.WriteAt(b, off)
+		n += k
+		off += int64(k)
+
 		if err != nil {
-			status[0] = blkSIOErr
-			slog.Error("block io error", "err", err)
+			return n, err
 		}
+	}
 
-		// FIX: +1 for the status byte?
-		if err := c.Release(n); err != nil {
-			return err
+	return
+}
+
+// discardOrZero executes the discard or write zeroes segments in data. It returns
+// blkSUnsupp for flags the command doesn't support, and blkSIOErr for malformed or
+// out-of-range segments. The flags of every segment are checked before any
+// segment is executed.
+func (h *blockHandler) discardOrZero(optype uint32, data []byte) (byte, error) {
+	maxSeg, maxSectors := blkMaxDiscardSeg, uint32(blkMaxDiscardSectors)
+	if optype == blkTWriteZeroes {
+		maxSeg, maxSectors = blkMaxZeroesSeg, blkMaxZeroesSectors
+	}
+
+	if len(data) == 0 || len(data)%16 != 0 || len(data)/16 > maxSeg {
+		return blkSIOErr, nil
+	}
+
+	sz, err := h.cfg.Storage.Size()
+	if err != nil {
+		return blkSIOErr, err
+	}
+
+	for seg := data; len(seg) > 0; seg = seg[16:] {
+		var (
+			sector = binary.LittleEndian.Uint64(seg)
+			num    = binary.LittleEndian.Uint32(seg[8:])
+			flags  = binary.LittleEndian.Uint32(seg[12:])
+		)
+
+		// "the device MUST set the status byte to VIRTIO_BLK_S_UNSUPP for discard
+		// commands if the unmap flag is set or if any unknown flag is set"
+		if (optype == blkTDiscard && flags != 0) || flags&^blkDWZFUnmap != 0 {
+			return blkSUnsupp, nil
+		}
+
+		if num > maxSectors || sector > uint64(sz/512) || uint64(num) > uint64(sz/512)-sector {
+			return blkSIOErr, nil
 		}
 	}
+
+	for seg := data; len(seg) > 0; seg = seg[16:] {
+		var (
+			off = int64(binary.LittleEndian.Uint64(seg)) * 512
+			n   = int64(binary.LittleEndian.Uint32(seg[8:])) * 512
+		)
+
+		if optype == blkTDiscard {
+			err = h.d.Discard(off, n)
+		} else {
+			err = h.z.WriteZeroesAt(off, n)
+		}
+
+		if err != nil {
+			return blkSIOErr, err
+		}
+	}
+
+	return blkSOK, nil
 }
 
 func (h *blockHandler) ReadConfig(p []byte, off int) error {
@@ -314,14 +925,23 @@ func (h *blockHandler) ReadConfig(p []byte, off int) error {
 		return err
 	}
 
-	raw := buf.Bytes()
-	copy(p, raw[off:])
+	if raw := buf.Bytes(); off < len(raw) {
+		copy(p, raw[off:])
+	}
 
 	return nil
 }
 
 func (h *blockHandler) Close() error {
+	close(h.doneC)
 	h.wg.Wait()
+
+	if c, ok := h.cfg.Storage.(io.Closer); ok && h.cfg.CloseStorage {
+		if err := c.Close(); err != nil {
+			return fmt.Errorf("close block storage: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -331,17 +951,66 @@ func (h *blockHandler) getBlkConfig() (*blkConfig, error) {
 		return nil, err
 	}
 
-	if sz%512 != 0 {
-		panic("sz % 512 != 0")
+	// a partial last sector is unusable: storage may be resized to any size
+	cfg := blkConfig{
+		Capacity:  uint64(sz / 512),
+		SizeMax:   blkSizeMax,
+		SegMax:    blkSegMax,
+		NumQueues: uint16(h.numQueues()),
 	}
 
-	cfg := blkConfig{
-		Capacity: uint64(sz / 512),
+	if t := h.topo; t != nil {
+		cfg.BlkSize = t.LogicalBlockSize
+		cfg.Topology.PhysicalBlockExp = uint8(bits.TrailingZeros32(t.PhysicalBlockSize / t.LogicalBlockSize))
+		cfg.Topology.AlignmentOffset = t.AlignmentOffset
+		cfg.Topology.MinIOSize = uint16(t.MinIOSize / t.LogicalBlockSize)
+		cfg.Topology.OptIOSize = t.OptIOSize / t.LogicalBlockSize
+	}
+
+	if h.d != nil {
+		cfg.MaxDiscardSectors = blkMaxDiscardSectors
+		cfg.MaxDiscardSeg = blkMaxDiscardSeg
+		cfg.DiscardSectorAlignment = blkDiscardAlignment
+	}
+
+	if h.z != nil {
+		cfg.MaxWriteZeroesSectors = blkMaxZeroesSectors
+		cfg.MaxWriteZeroesSeg = blkMaxZeroesSeg
 	}
 
 	return &cfg, nil
 }
 
+func (h *blockHandler) numQueues() int {
+	return max(h.cfg.NumQueues, 1)
+}
+
+// checkTopology fills in the defaults of t and validates it.
+func checkTopology(t BlockTopology) (BlockTopology, error) {
+	if t.LogicalBlockSize == 0 {
+		t.LogicalBlockSize = 512
+	}
+
+	if t.PhysicalBlockSize == 0 {
+		t.PhysicalBlockSize = t.LogicalBlockSize
+	}
+
+	lbs, pbs := t.LogicalBlockSize, t.PhysicalBlockSize
+
+	switch {
+	case lbs < 512 || lbs&(lbs-1) != 0:
+		return t, fmt.Errorf("block logical block size %d is not a power of 2 >= 512", lbs)
+
+	case pbs < lbs || pbs&(pbs-1) != 0:
+		return t, fmt.Errorf("block physical block size %d is not a power of 2 multiple of %d", pbs, lbs)
+
+	case t.MinIOSize%lbs != 0 || t.MinIOSize/lbs > 0xffff || t.OptIOSize%lbs != 0:
+		return t, fmt.Errorf("block I/O sizes %d and %d are not valid multiples of %d", t.MinIOSize, t.OptIOSize, lbs)
+	}
+
+	return t, nil
+}
+
 // ReadAt copies from the backing slice at off into p.
 func (ms *MemStorage) ReadAt(p []byte, off int64) (n int, err error) {
 	return copy(p, ms.Bytes[off:]), nil
@@ -357,6 +1026,18 @@ func (ms *MemStorage) WriteAt(p []byte, off int64) (n int, err error) {
 	return copy(ms.Bytes[off:], p), nil
 }
 
+// Discard zeroes n bytes of the backing slice at off.
+func (ms *MemStorage) Discard(off, n int64) error {
+	clear(ms.Bytes[off : off+n])
+	return nil
+}
+
+// WriteZeroesAt zeroes n bytes of the backing slice at off.
+func (ms *MemStorage) WriteZeroesAt(off, n int64) error {
+	clear(ms.Bytes[off : off+n])
+	return nil
+}
+
 // ReadAt reads from the backing file.
 func (fs *FileStorage) ReadAt(p []byte, off int64) (n int, err error) {
 	return fs.File.ReadAt(p, off)
@@ -377,54 +1058,34 @@ func (fs *FileStorage) WriteAt(p []byte, off int64) (n int, err error) {
 	return fs.File.WriteAt(p, off)
 }
 
-// ReadAt gets the backing URL with a Range header generated from off and len(p).
-func (hs *HTTPStorage) ReadAt(p []byte, off int64) (n int, err error) {
-	req, err := http.NewRequest(http.MethodGet, hs.URL, nil)
-	if err != nil {
-		return 0, err
-	}
-
-	req.Header.Set("range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
-
-	res, err := hs.getClient().Do(req)
-	if err != nil {
-		return
-	}
-
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusPartialContent {
-		return 0, fmt.Errorf("block device http request failed: GET %s: status %d != %d",
-			hs.URL, res.StatusCode, http.StatusPartialContent)
-	}
-
-	n, err = res.Body.Read(p)
-	if err == io.EOF && n == len(p) {
-		err = nil
-	}
-
-	return
+// Sync commits the backing file's contents to durable storage.
+func (fs *FileStorage) Sync() error {
+	return fs.File.Sync()
 }
 
-// Size sends a HEAD request to the backing URL and parses the Content-Length response header.
-func (hs *HTTPStorage) Size() (int64, error) {
-	res, err := hs.getClient().Head(hs.URL)
-	if err != nil {
-		return 0, err
-	}
+// Discard punches a hole in the backing file, deallocating n bytes at off.
+func (fs *FileStorage) Discard(off, n int64) error {
+	return unix.Fallocate(int(fs.File.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+}
 
-	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotModified {
-		return 0, fmt.Errorf("block device http request failed: HEAD %s: status %d", hs.URL, res.StatusCode)
+// WriteZeroesAt zeroes n bytes of the backing file at off. If the file system
+// doesn't support zeroing ranges, WriteZeroesAt writes zeroes instead.
+func (fs *FileStorage) WriteZeroesAt(off, n int64) error {
+	err := unix.Fallocate(int(fs.File.Fd()), unix.FALLOC_FL_ZERO_RANGE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+	if err != unix.EOPNOTSUPP {
+		return err
 	}
 
-	cl := res.Header.Get("content-length")
-	return strconv.ParseInt(cl, 10, 64)
-}
+	zero := make([]byte, min(n, 1<<20))
+	for n > 0 {
+		k, err := fs.File.WriteAt(zero[:min(n, int64(len(zero)))], off)
+		if err != nil {
+			return err
+		}
 
-func (hs *HTTPStorage) getClient() *http.Client {
-	if hs.Client != nil {
-		return hs.Client
+		off += int64(k)
+		n -= int64(k)
 	}
 
-	return http.DefaultClient
+	return nil
 }
@@ -0,0 +1,477 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/c35s/hype/virtio"
+	"github.com/c35s/hype/virtio/virtq"
+)
+
+// blkTest drives a block device handler through a split virtqueue.
+type blkTest struct {
+	t     *testing.T
+	h     virtio.DeviceHandler
+	mem   []byte
+	desc  []virtq.SplitDesc
+	drvA  []byte
+	devA  []byte
+	kickC chan struct{}
+	usedC chan struct{}
+}
+
+// guest memory layout
+const (
+	blkTestHdr    = 0x1000
+	blkTestStatus = 0x1100
+	blkTestData   = 0x2000
+)
+
+// newBlkTest creates a handler for dev with the given negotiated features and
+// makes queue 0 ready.
+func newBlkTest(t *testing.T, dev virtio.BlockDevice, features uint64) *blkTest {
+	t.Helper()
+
+	h, err := dev.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { h.Close() })
+
+	if err := h.Ready(features, func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	return (&blkTest{t: t, h: h}).queue(0)
+}
+
+// queue makes queue qn ready and returns a blkTest that drives it.
+func (bt *blkTest) queue(qn int) *blkTest {
+	bt.t.Helper()
+
+	qt := &blkTest{
+		t:     bt.t,
+		h:     bt.h,
+		mem:   make([]byte, 1<<20),
+		desc:  make([]virtq.SplitDesc, 8),
+		drvA:  make([]byte, virtq.SplitDriverAreaSize(8)),
+		devA:  make([]byte, virtq.SplitDeviceAreaSize(8)),
+		kickC: make(chan struct{}, 1),
+		usedC: make(chan struct{}, 8),
+	}
+
+	// runs before the handler is closed
+	bt.t.Cleanup(func() { close(qt.kickC) })
+
+	q, err := virtq.NewSplit(qt.desc, qt.drvA, qt.devA, virtq.Config{
+		MemAt: func(addr uint64, size int) ([]byte, error) {
+			return qt.mem[addr : addr+uint64(size)], nil
+		},
+
+		Notify: func() error {
+			qt.usedC <- struct{}{}
+			return nil
+		},
+	})
+
+	if err != nil {
+		bt.t.Fatal(err)
+	}
+
+	if err := bt.h.QueueReady(qn, q, qt.kickC); err != nil {
+		bt.t.Fatal(err)
+	}
+
+	return qt
+}
+
+// push makes a request available at desc[head:head+3] without waiting for it.
+// The request's header, data, and status are at off bytes past the usual
+// addresses. If data is not nil, it is copied to guest memory.
+func (bt *blkTest) push(head uint16, off uint64, optype uint32, sector uint64, data []byte, write bool) {
+	binary.LittleEndian.PutUint32(bt.mem[blkTestHdr+off:], optype)
+	binary.LittleEndian.PutUint64(bt.mem[blkTestHdr+off+8:], sector)
+	bt.mem[blkTestStatus+off] = 0xff
+
+	chain := []virtq.SplitDesc{{Addr: blkTestHdr + off, Len: 16}}
+	if data != nil {
+		copy(bt.mem[blkTestData+off:], data)
+
+		var flags uint16
+		if write {
+			flags = virtq.DescFWrite
+		}
+
+		chain = append(chain, virtq.SplitDesc{Addr: blkTestData + off, Len: uint32(len(data)), Flags: flags})
+	}
+
+	chain = append(chain, virtq.SplitDesc{Addr: blkTestStatus + off, Len: 1, Flags: virtq.DescFWrite})
+
+	bt.pushChain(head, chain...)
+}
+
+// pushChain links chain into desc[head:] and makes it available.
+func (bt *blkTest) pushChain(head uint16, chain ...virtq.SplitDesc) {
+	for i := range chain {
+		if i < len(chain)-1 {
+			chain[i].Flags |= virtq.DescFNext
+			chain[i].Next = head + uint16(i+1)
+		}
+
+		bt.desc[int(head)+i] = chain[i]
+	}
+
+	idx := binary.LittleEndian.Uint16(bt.drvA[2:])
+	binary.LittleEndian.PutUint16(bt.drvA[4+2*(idx%8):], head)
+
+	// the device polls the ring, so the new idx is published atomically
+	// after the chain is written, like a driver's memory barrier
+	flags := binary.LittleEndian.Uint16(bt.drvA)
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&bt.drvA[0])), uint32(flags)|uint32(idx+1)<<16)
+
+	select {
+	case bt.kickC <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for the device to use a request.
+func (bt *blkTest) wait() {
+	bt.t.Helper()
+
+	select {
+	case <-bt.usedC:
+	case <-time.After(5 * time.Second):
+		bt.t.Fatal("request timed out")
+	}
+}
+
+// do submits a request and waits for the device to use it, returning the
+// status. If data is not nil, it is copied to guest memory before the request,
+// and from guest memory after the request.
+func (bt *blkTest) do(optype uint32, sector uint64, data []byte, write bool) byte {
+	bt.t.Helper()
+
+	bt.push(0, 0, optype, sector, data, write)
+	bt.wait()
+
+	copy(data, bt.mem[blkTestData:])
+	return bt.mem[blkTestStatus]
+}
+
+func TestBlockResize(t *testing.T) {
+	var (
+		ms      = &virtio.MemStorage{Bytes: make([]byte, 4096)}
+		resizeC = make(chan struct{})
+		changeC = make(chan struct{}, 1)
+	)
+
+	h, err := virtio.BlockDevice{Storage: ms, Resize: resizeC}.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer h.Close()
+
+	if err := h.Ready(0, func() { changeC <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	ms.Bytes = make([]byte, 8192)
+	resizeC <- struct{}{}
+
+	select {
+	case <-changeC:
+	case <-time.After(time.Second):
+		t.Fatal("no config change after resize")
+	}
+
+	p := make([]byte, 8)
+	if err := h.ReadConfig(p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := binary.LittleEndian.Uint64(p); c != 16 {
+		t.Errorf("capacity %d != 16", c)
+	}
+}
+
+func TestBlockFlushDiscardWriteZeroes(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if _, err := f.Write(bytes.Repeat([]byte{0xaa}, 1<<16)); err != nil {
+		t.Fatal(err)
+	}
+
+	storages := map[string]virtio.BlockStorage{
+		"file": &virtio.FileStorage{File: f},
+		"mem":  &virtio.MemStorage{Bytes: bytes.Repeat([]byte{0xaa}, 1<<16)},
+	}
+
+	for name, stg := range storages {
+		t.Run(name, func(t *testing.T) {
+			h, err := virtio.BlockDevice{Storage: stg}.NewHandler()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			features := h.GetFeatures()
+			h.Close()
+
+			const (
+				fFlush       = 1 << 8
+				fDiscard     = 1 << 12
+				fWriteZeroes = 1 << 13
+			)
+
+			if features&(fDiscard|fWriteZeroes) != fDiscard|fWriteZeroes {
+				t.Fatalf("features %#x missing discard or write zeroes", features)
+			}
+
+			_, syncer := stg.(virtio.Syncer)
+			if syncer != (features&fFlush != 0) {
+				t.Errorf("flush feature %v != Syncer %v", features&fFlush != 0, syncer)
+			}
+
+			bt := newBlkTest(t, virtio.BlockDevice{Storage: stg}, features)
+
+			if syncer {
+				if s := bt.do(4, 0, nil, false); s != 0 {
+					t.Errorf("flush status %d", s)
+				}
+			}
+
+			// sectors 8-15 discarded, 16-23 zeroed with unmap, 24-31 zeroed
+			seg := func(sector uint64, num, flags uint32) []byte {
+				b := binary.LittleEndian.AppendUint64(nil, sector)
+				b = binary.LittleEndian.AppendUint32(b, num)
+				return binary.LittleEndian.AppendUint32(b, flags)
+			}
+
+			if s := bt.do(11, 0, seg(8, 8, 0), false); s != 0 {
+				t.Errorf("discard status %d", s)
+			}
+
+			if s := bt.do(13, 0, append(seg(16, 8, 1), seg(24, 8, 0)...), false); s != 0 {
+				t.Errorf("write zeroes status %d", s)
+			}
+
+			data := make([]byte, 32*512)
+			if s := bt.do(0, 0, data, true); s != 0 {
+				t.Fatalf("read status %d", s)
+			}
+
+			if !bytes.Equal(data[:8*512], bytes.Repeat([]byte{0xaa}, 8*512)) {
+				t.Error("sectors 0-7 changed")
+			}
+
+			if !bytes.Equal(data[16*512:], make([]byte, 16*512)) {
+				t.Error("sectors 16-31 aren't zero")
+			}
+
+			if s := bt.do(11, 0, seg(8, 8, 1), false); s != 2 {
+				t.Errorf("discard with unmap: status %d != unsupported", s)
+			}
+
+			if s := bt.do(13, 0, seg(127, 2, 0), false); s != 1 {
+				t.Errorf("out of range write zeroes: status %d != ioerr", s)
+			}
+		})
+	}
+}
+
+// topoStorage is memory storage with a 4K-native topology.
+type topoStorage struct {
+	virtio.MemStorage
+}
+
+func (ts *topoStorage) Topology() virtio.BlockTopology {
+	return virtio.BlockTopology{
+		LogicalBlockSize:  4096,
+		PhysicalBlockSize: 16384,
+		OptIOSize:         1 << 20,
+	}
+}
+
+func TestBlockGetIDAndTopology(t *testing.T) {
+	stg := &topoStorage{virtio.MemStorage{Bytes: make([]byte, 1<<16)}}
+	dev := virtio.BlockDevice{Storage: stg, Serial: "hype-disk-0"}
+
+	bt := newBlkTest(t, dev, 0)
+
+	id := make([]byte, 20)
+	if s := bt.do(8, 0, id, true); s != 0 {
+		t.Fatalf("get id status %d", s)
+	}
+
+	if want := append([]byte("hype-disk-0"), make([]byte, 9)...); !bytes.Equal(id, want) {
+		t.Errorf("id %q != %q", id, want)
+	}
+
+	cfg := make([]byte, 32)
+	if err := bt.h.ReadConfig(cfg, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		blkSize = binary.LittleEndian.Uint32(cfg[20:])
+		physExp = cfg[24]
+		optIO   = binary.LittleEndian.Uint32(cfg[28:])
+	)
+
+	if blkSize != 4096 || physExp != 2 || optIO != 256 {
+		t.Errorf("blk_size=%d physical_block_exp=%d opt_io_size=%d", blkSize, physExp, optIO)
+	}
+
+	if _, err := (virtio.BlockDevice{Storage: stg, Serial: "0123456789abcdefghijk"}).NewHandler(); err == nil {
+		t.Error("no error for a 21-byte serial")
+	}
+
+	bt = newBlkTest(t, virtio.BlockDevice{Storage: &stg.MemStorage}, 0)
+	if s := bt.do(8, 0, id, true); s != 2 {
+		t.Errorf("get id without a serial: status %d != unsupported", s)
+	}
+}
+
+// barrierStorage is memory storage whose reads wait until n reads are in flight.
+type barrierStorage struct {
+	virtio.MemStorage
+	wg *sync.WaitGroup
+}
+
+func (bs *barrierStorage) ReadAt(p []byte, off int64) (int, error) {
+	bs.wg.Done()
+	bs.wg.Wait()
+	return bs.MemStorage.ReadAt(p, off)
+}
+
+func TestBlockMultiQueue(t *testing.T) {
+	const fMQ = 1 << 11
+
+	wg := new(sync.WaitGroup)
+	stg := &barrierStorage{virtio.MemStorage{Bytes: make([]byte, 1<<16)}, wg}
+	dev := virtio.BlockDevice{Storage: stg, NumQueues: 4}
+
+	bt := newBlkTest(t, dev, fMQ)
+
+	if f := bt.h.GetFeatures(); f&fMQ == 0 {
+		t.Errorf("features %#x missing multiqueue", f)
+	}
+
+	cfg := make([]byte, 36)
+	if err := bt.h.ReadConfig(cfg, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := binary.LittleEndian.Uint16(cfg[34:]); n != 4 {
+		t.Errorf("num_queues %d != 4", n)
+	}
+
+	// two reads in flight on queue 0, and one on queue 3
+	q3 := bt.queue(3)
+	wg.Add(3)
+
+	bt.push(0, 0, 0, 0, make([]byte, 512), true)
+	bt.push(3, 0x200, 0, 1, make([]byte, 512), true)
+	q3.push(0, 0, 0, 2, make([]byte, 512), true)
+
+	bt.wait()
+	bt.wait()
+	q3.wait()
+
+	if _, err := (virtio.BlockDevice{Storage: stg, NumQueues: 17}).NewHandler(); err == nil {
+		t.Error("no error for 17 queues")
+	}
+}
+
+func TestBlockScatterGather(t *testing.T) {
+	var (
+		ms = &virtio.MemStorage{Bytes: make([]byte, 1<<16)}
+		bt = newBlkTest(t, virtio.BlockDevice{Storage: ms}, 0)
+		le = binary.LittleEndian
+	)
+
+	for i := range ms.Bytes {
+		ms.Bytes[i] = byte(i / 512)
+	}
+
+	// header split in two, 3 data segments, status sharing the last segment
+	le.PutUint32(bt.mem[0x1000:], 0)
+	le.PutUint64(bt.mem[0x1010:], 3)
+	bt.pushChain(0,
+		virtq.SplitDesc{Addr: 0x1000, Len: 8},
+		virtq.SplitDesc{Addr: 0x1010, Len: 8},
+		virtq.SplitDesc{Addr: 0x2000, Len: 512, Flags: virtq.DescFWrite},
+		virtq.SplitDesc{Addr: 0x3000, Len: 1024, Flags: virtq.DescFWrite},
+		virtq.SplitDesc{Addr: 0x4000, Len: 513, Flags: virtq.DescFWrite},
+	)
+
+	bt.wait()
+
+	if s := bt.mem[0x4200]; s != 0 {
+		t.Fatalf("read status %d", s)
+	}
+
+	for i, want := range map[uint64]byte{0x2000: 3, 0x3000: 4, 0x3200: 5, 0x4000: 6} {
+		if got := bt.mem[i+511]; got != want {
+			t.Errorf("mem[%#x] sector %d != %d", i, got, want)
+		}
+	}
+
+	// the used length includes the status byte
+	if n := le.Uint32(bt.devA[8:]); n != 2049 {
+		t.Errorf("used len %d != 2049", n)
+	}
+
+	// write from 2 segments at a 64-bit sector beyond the storage
+	le.PutUint32(bt.mem[0x1000:], 1)
+	le.PutUint64(bt.mem[0x1008:], 1<<40)
+	bt.mem[0x5000] = 0xff
+	bt.pushChain(0,
+		virtq.SplitDesc{Addr: 0x1000, Len: 16},
+		virtq.SplitDesc{Addr: 0x2000, Len: 512},
+		virtq.SplitDesc{Addr: 0x3000, Len: 512},
+		virtq.SplitDesc{Addr: 0x5000, Len: 1, Flags: virtq.DescFWrite},
+	)
+
+	bt.wait()
+
+	if s := bt.mem[0x5000]; s != 1 {
+		t.Errorf("out of range write: status %d != ioerr", s)
+	}
+
+	// short header
+	bt.mem[0x5000] = 0xff
+	bt.pushChain(0,
+		virtq.SplitDesc{Addr: 0x1000, Len: 15},
+		virtq.SplitDesc{Addr: 0x5000, Len: 1, Flags: virtq.DescFWrite},
+	)
+
+	bt.wait()
+
+	if s := bt.mem[0x5000]; s != 1 {
+		t.Errorf("short header: status %d != ioerr", s)
+	}
+
+	// no status byte: the chain is released without a status
+	bt.pushChain(0, virtq.SplitDesc{Addr: 0x1000, Len: 16})
+	bt.wait()
+
+	// still working
+	if s := bt.do(0, 0, make([]byte, 512), true); s != 0 {
+		t.Errorf("read after malformed requests: status %d", s)
+	}
+}
@@ -0,0 +1,150 @@
+package virtio
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// BlockStats are a block device's I/O statistics since it was created.
+type BlockStats struct {
+	Read        BlockOpStats
+	Write       BlockOpStats
+	Flush       BlockOpStats
+	Discard     BlockOpStats
+	WriteZeroes BlockOpStats
+
+	// InFlight is the number of requests taken from the device's queues
+	// that haven't completed.
+	InFlight int64
+}
+
+// BlockOpStats count the completed requests of one type.
+type BlockOpStats struct {
+	Ops    uint64
+	Bytes  uint64 // data read or written; zero for other requests
+	Errors uint64 // requests that failed or weren't supported
+
+	// Latency is the time from taking a request from its queue to completing it.
+	Latency LatencyHistogram
+}
+
+// LatencyHistogram is a histogram of request latencies. Counts[i] is the number
+// of requests that took at most Bounds[i] and longer than Bounds[i-1]. The last
+// count is the number of requests that took longer than every bound.
+type LatencyHistogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Sum    time.Duration
+}
+
+// BlockStatsReporter is implemented by device handlers that keep block I/O
+// statistics.
+type BlockStatsReporter interface {
+	BlockStats() BlockStats
+}
+
+// blkLatencyBounds are the upper bounds of the latency histogram buckets.
+var blkLatencyBounds = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// blkStats are a block handler's counters. They're updated atomically by the
+// request goroutines.
+type blkStats struct {
+	read, write, flush, discard, writeZeroes blkOpStats
+	inFlight                                 atomic.Int64
+}
+
+type blkOpStats struct {
+	ops, bytes, errors atomic.Uint64
+	sum                atomic.Int64 // nanoseconds
+	counts             [len(blkLatencyBounds) + 1]atomic.Uint64
+}
+
+// op returns the counters for optype, or nil if it isn't counted.
+func (s *blkStats) op(optype uint32) *blkOpStats {
+	switch optype {
+	case blkTIn:
+		return &s.read
+	case blkTOut:
+		return &s.write
+	case blkTFlush:
+		return &s.flush
+	case blkTDiscard:
+		return &s.discard
+	case blkTWriteZeroes:
+		return &s.writeZeroes
+	}
+
+	return nil
+}
+
+// record counts a request that started at start and transferred n bytes.
+func (s *blkOpStats) record(start time.Time, n int, failed bool) {
+	d := time.Since(start)
+
+	s.ops.Add(1)
+	s.bytes.Add(uint64(n))
+	s.sum.Add(int64(d))
+
+	if failed {
+		s.errors.Add(1)
+	}
+
+	i := 0
+	for i < len(blkLatencyBounds) && d > blkLatencyBounds[i] {
+		i++
+	}
+
+	s.counts[i].Add(1)
+}
+
+func (s *blkOpStats) snapshot() BlockOpStats {
+	st := BlockOpStats{
+		Ops:    s.ops.Load(),
+		Bytes:  s.bytes.Load(),
+		Errors: s.errors.Load(),
+
+		Latency: LatencyHistogram{
+			Bounds: slices.Clone(blkLatencyBounds[:]),
+			Counts: make([]uint64, len(s.counts)),
+			Sum:    time.Duration(s.sum.Load()),
+		},
+	}
+
+	for i := range s.counts {
+		st.Latency.Counts[i] = s.counts[i].Load()
+	}
+
+	return st
+}
+
+// BlockStats returns a snapshot of the device's statistics. Counters are read
+// one at a time, so they may be slightly inconsistent with each other.
+func (h *blockHandler) BlockStats() BlockStats {
+	return BlockStats{
+		Read:        h.stats.read.snapshot(),
+		Write:       h.stats.write.snapshot(),
+		Flush:       h.stats.flush.snapshot(),
+		Discard:     h.stats.discard.snapshot(),
+		WriteZeroes: h.stats.writeZeroes.snapshot(),
+		InFlight:    h.stats.inFlight.Load(),
+	}
+}
@@ -0,0 +1,59 @@
+package virtio_test
+
+import (
+	"testing"
+
+	"github.com/c35s/hype/virtio"
+)
+
+func TestBlockStats(t *testing.T) {
+	bt := newBlkTest(t, virtio.BlockDevice{
+		Storage: &virtio.MemStorage{Bytes: make([]byte, 1<<20)},
+	}, 0)
+
+	for i := 0; i < 3; i++ {
+		bt.do(0, uint64(i), make([]byte, 4096), true)
+	}
+
+	bt.do(1, 0, make([]byte, 1024), false)
+	bt.do(1, 1<<20/512, make([]byte, 512), false) // out of range
+	bt.do(4, 0, nil, false)                       // not supported by MemStorage
+
+	stats := bt.h.(virtio.BlockStatsReporter).BlockStats()
+
+	tests := []struct {
+		name               string
+		got                virtio.BlockOpStats
+		ops, bytes, errors uint64
+	}{
+		{"read", stats.Read, 3, 3 * 4096, 0},
+		{"write", stats.Write, 2, 1024, 1},
+		{"flush", stats.Flush, 1, 0, 1},
+		{"discard", stats.Discard, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		if tt.got.Ops != tt.ops || tt.got.Bytes != tt.bytes || tt.got.Errors != tt.errors {
+			t.Errorf("%s: ops=%d bytes=%d errors=%d, want %d %d %d", tt.name,
+				tt.got.Ops, tt.got.Bytes, tt.got.Errors, tt.ops, tt.bytes, tt.errors)
+		}
+
+		h := tt.got.Latency
+		if len(h.Counts) != len(h.Bounds)+1 {
+			t.Fatalf("%s: %d counts for %d bounds", tt.name, len(h.Counts), len(h.Bounds))
+		}
+
+		var n uint64
+		for _, c := range h.Counts {
+			n += c
+		}
+
+		if n != tt.ops {
+			t.Errorf("%s: latency histogram has %d requests, want %d", tt.name, n, tt.ops)
+		}
+	}
+
+	if stats.InFlight != 0 {
+		t.Errorf("%d requests in flight", stats.InFlight)
+	}
+}
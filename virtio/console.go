@@ -1,87 +1,337 @@
 package virtio
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/c35s/hype/virtio/virtq"
 )
 
-// ConsoleDevice configures a virtio console device.
+// ConsoleDevice configures a virtio console device. Port 0 is the console
+// (hvc0 in a Linux guest). Additional named ports appear in a Linux guest as
+// /dev/virtio-ports/NAME.
 type ConsoleDevice struct {
 	In  io.Reader
 	Out io.Writer
+
+	// Ports are additional named ports. The device supports up to 6.
+	Ports []ConsolePort
+
+	// Resize, if set, receives the size of the console's terminal. The guest
+	// is told about the first size received after the console is ready, and
+	// each size after that. Closing the channel stops the device from watching it.
+	Resize <-chan ConsoleSize
+}
+
+// ConsolePort is a named console port. The guest reads what the host writes
+// to RW, and writes to RW what the guest writes to the port.
+type ConsolePort struct {
+	Name string
+	RW   io.ReadWriter
+}
+
+// ConsoleSize is the size of a console's terminal in characters.
+type ConsoleSize struct {
+	Cols uint16
+	Rows uint16
 }
 
 type consoleHandler struct {
-	cfg ConsoleDevice
-	wg  sync.WaitGroup
+	cfg      ConsoleDevice
+	features uint64
+	wg       sync.WaitGroup
+	doneC    chan struct{}
+
+	mu            sync.Mutex
+	size          ConsoleSize
+	consoleReady  bool // the driver is ready for resize messages
+	configChanged func()
+
+	ctrlMu  sync.Mutex
+	ctrlQ   virtq.Queue // device-to-driver control queue
+	ctrlOut [][]byte    // control messages waiting for buffers
+
+	inMu   sync.Mutex
+	inputs map[int]*consoleInput // by rx queue
+}
+
+// consoleInput reads a port's input on its own goroutine, so the rx queue
+// never waits for the host and Close doesn't wait for the reader.
+type consoleInput struct {
+	r     io.Reader
+	dataC chan []byte // closed after the reader fails
+	err   error       // the reader's error, set before dataC is closed
+}
+
+// consoleConfig has the same fields as struct virtio_console_config.
+type consoleConfig struct {
+	Cols       uint16
+	Rows       uint16
+	MaxNrPorts uint32
+	EmergWr    uint32
 }
 
+// features
+
+const (
+	consoleFSize      = 1 << 0 // configuration cols and rows are valid
+	consoleFMultiport = 1 << 1 // device has support for multiple ports; control virtqueues will be used
+)
+
+// queues; port n > 0 uses queues 2n+2 and 2n+3
+
+const (
+	consoleRxQ     = 0
+	consoleTxQ     = 1
+	consoleCtrlRxQ = 2 // device-to-driver control messages
+	consoleCtrlTxQ = 3 // driver-to-device control messages
+)
+
+// control events
+
 const (
-	consoleRxQ = 0
-	consoleTxQ = 1
+	consoleDeviceReady  = 0
+	consoleDeviceAdd    = 1
+	consoleDeviceRemove = 2
+	consolePortReady    = 3
+	consoleConsolePort  = 4
+	consoleResize       = 5
+	consolePortOpen     = 6
+	consolePortName     = 7
 )
 
+// consoleMaxPorts is the number of ports whose queues fit in the mmio bus's 16 queues.
+const consoleMaxPorts = 7
+
 func (cfg ConsoleDevice) NewHandler() (DeviceHandler, error) {
-	return &consoleHandler{cfg: cfg}, nil
+	if len(cfg.Ports) > consoleMaxPorts-1 {
+		return nil, fmt.Errorf("console device has %d ports; the max is %d", len(cfg.Ports), consoleMaxPorts-1)
+	}
+
+	for i, p := range cfg.Ports {
+		if p.Name == "" {
+			return nil, fmt.Errorf("console port %d has no name", i+1)
+		}
+	}
+
+	h := &consoleHandler{
+		cfg:   cfg,
+		doneC: make(chan struct{}),
+	}
+
+	if cfg.Resize != nil {
+		h.wg.Add(1)
+		go h.watchResize()
+	}
+
+	return h, nil
 }
 
 func (h *consoleHandler) GetType() DeviceID {
 	return ConsoleDeviceID
 }
 
-func (*consoleHandler) GetFeatures() uint64 {
-	return 0
+func (h *consoleHandler) GetFeatures() (features uint64) {
+	if h.cfg.Resize != nil {
+		features |= consoleFSize
+	}
+
+	if len(h.cfg.Ports) > 0 {
+		features |= consoleFMultiport
+	}
+
+	return
 }
 
-func (*consoleHandler) Ready(negotiatedFeatures uint64) error {
+func (h *consoleHandler) Ready(negotiatedFeatures uint64, configChanged func()) error {
+	h.mu.Lock()
+	h.features = negotiatedFeatures
+	h.configChanged = configChanged
+
+	// without control queues, the console is ready now
+	h.consoleReady = negotiatedFeatures&consoleFMultiport == 0
+	h.mu.Unlock()
+
 	return nil
 }
 
-func (h *consoleHandler) QueueReady(num int, q *virtq.Queue, notify <-chan struct{}) error {
-	switch num {
-	case consoleRxQ:
-		if h.cfg.In != nil {
-			h.wg.Add(1)
-			go func() {
-				defer h.wg.Done()
-				for range notify {
-					if err := h.handleRx(q); err != nil {
-						slog.Error("console rx: %v", err)
-					}
-				}
-			}()
+func (h *consoleHandler) QueueReady(num int, q virtq.Queue, notify <-chan struct{}) error {
+	h.mu.Lock()
+	multiport := h.features&consoleFMultiport != 0
+	h.mu.Unlock()
+
+	var handle func() error
+
+	switch {
+	case num == consoleCtrlRxQ && multiport:
+		h.ctrlMu.Lock()
+		h.ctrlQ = q
+		h.ctrlMu.Unlock()
+
+		handle = h.flushCtrl
+
+	case num == consoleCtrlTxQ && multiport:
+		handle = func() error { return h.handleCtrl(q) }
+
+	case num == consoleRxQ || num == consoleTxQ || (multiport && num/2-1 <= len(h.cfg.Ports)):
+		in, out := h.cfg.In, h.cfg.Out
+		if port := num/2 - 1; port > 0 {
+			in, out = h.cfg.Ports[port-1].RW, h.cfg.Ports[port-1].RW
 		}
 
-	case consoleTxQ:
-		if h.cfg.Out != nil {
+		if num%2 == 0 && in != nil {
 			h.wg.Add(1)
-			go func() {
-				defer h.wg.Done()
-				for range notify {
-					if err := h.handleTx(q); err != nil {
-						slog.Error("console tx: %v", err)
-					}
-				}
-			}()
+			go h.handleRx(max(num/2-1, 0), q, notify, h.input(num, in))
+		} else if num%2 == 1 && out != nil {
+			handle = func() error { return handleTx(q, out) }
 		}
 	}
 
+	if handle != nil {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for range notify {
+				if err := handle(); err != nil {
+					slog.Error("console queue", "num", num, "err", err)
+				}
+			}
+		}()
+	}
+
 	return nil
 }
 
 func (h *consoleHandler) ReadConfig(p []byte, off int) error {
+	h.mu.Lock()
+	cfg := consoleConfig{
+		Cols:       h.size.Cols,
+		Rows:       h.size.Rows,
+		MaxNrPorts: uint32(1 + len(h.cfg.Ports)),
+	}
+
+	h.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, cfg); err != nil {
+		return err
+	}
+
+	if raw := buf.Bytes(); off < len(raw) {
+		copy(p, raw[off:])
+	}
+
 	return nil
 }
 
+// Close stops the device. Inputs blocked in Read are abandoned, but inputs with
+// a SetReadDeadline method, like pipes and network connections, are interrupted.
 func (h *consoleHandler) Close() error {
+	close(h.doneC)
+
+	h.inMu.Lock()
+	for _, in := range h.inputs {
+		if d, ok := in.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+			d.SetReadDeadline(time.Now())
+		}
+	}
+
+	h.inMu.Unlock()
+
 	h.wg.Wait()
 	return nil
 }
 
-func (h *consoleHandler) handleRx(q *virtq.Queue) error {
+// input returns the input for rx queue num, starting its reader the first time.
+func (h *consoleHandler) input(num int, r io.Reader) *consoleInput {
+	h.inMu.Lock()
+	defer h.inMu.Unlock()
+
+	if in := h.inputs[num]; in != nil {
+		return in
+	}
+
+	if h.inputs == nil {
+		h.inputs = make(map[int]*consoleInput)
+	}
+
+	in := &consoleInput{r: r, dataC: make(chan []byte)}
+	h.inputs[num] = in
+
+	go func() {
+		defer close(in.dataC)
+		for {
+			buf := make([]byte, 4096)
+			n, err := r.Read(buf)
+
+			if n > 0 {
+				select {
+				case in.dataC <- buf[:n]:
+				case <-h.doneC:
+					return
+				}
+			}
+
+			if err != nil {
+				in.err = err
+				return
+			}
+		}
+	}()
+
+	return in
+}
+
+// watchResize tells the driver about each size received after the console is
+// ready. It returns when the handler is closed.
+func (h *consoleHandler) watchResize() {
+	defer h.wg.Done()
+	for {
+		select {
+		case size, ok := <-h.cfg.Resize:
+			if !ok {
+				return
+			}
+
+			h.mu.Lock()
+			h.size = size
+			ready, notify, features := h.consoleReady, h.configChanged, h.features
+			h.mu.Unlock()
+
+			if !ready {
+				continue
+			}
+
+			// multiport drivers only read the size from resize messages
+			if features&consoleFMultiport != 0 {
+				h.sendCtrl(0, consoleResize, 0, resizeMsg(size))
+			} else if features&consoleFSize != 0 && notify != nil {
+				notify()
+			}
+
+			if err := h.flushCtrl(); err != nil {
+				slog.Error("console resize", "err", err)
+			}
+
+		case <-h.doneC:
+			return
+		}
+	}
+}
+
+// resizeMsg returns the data of a resize message, which has the rows first.
+func resizeMsg(size ConsoleSize) []byte {
+	return binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, size.Rows), size.Cols)
+}
+
+// handleCtrl handles the control messages in q.
+func (h *consoleHandler) handleCtrl(q virtq.Queue) error {
 	for {
 		c, err := q.Next()
 		if err != nil {
@@ -89,29 +339,134 @@ func (h *consoleHandler) handleRx(q *virtq.Queue) error {
 		}
 
 		if c == nil {
-			break
+			return h.flushCtrl()
+		}
+
+		var msg []byte
+		for i, d := range c.Desc {
+			if d.IsWO() {
+				break
+			}
+
+			buf, err := c.Buf(i)
+			if err != nil {
+				return err
+			}
+
+			msg = append(msg, buf...)
+		}
+
+		if err := c.Release(0); err != nil {
+			return err
+		}
+
+		if len(msg) < 8 {
+			slog.Error("console control message is too short", "len", len(msg))
+			continue
+		}
+
+		h.control(binary.LittleEndian.Uint32(msg), binary.LittleEndian.Uint16(msg[4:]), binary.LittleEndian.Uint16(msg[6:]))
+	}
+}
+
+// control handles a control message from the driver.
+func (h *consoleHandler) control(id uint32, event, value uint16) {
+	switch event {
+	case consoleDeviceReady:
+		if value != 1 {
+			slog.Error("console driver failed to initialize")
+			return
+		}
+
+		for port := 0; port <= len(h.cfg.Ports); port++ {
+			h.sendCtrl(uint32(port), consoleDeviceAdd, 0, nil)
+		}
+
+	case consolePortReady:
+		if value != 1 || id > uint32(len(h.cfg.Ports)) {
+			slog.Error("console port failed to initialize", "id", id)
+			return
+		}
+
+		if id == 0 {
+			h.sendCtrl(0, consoleConsolePort, 1, nil)
+
+			h.mu.Lock()
+			h.consoleReady = true
+			size := h.size
+			h.mu.Unlock()
+
+			if size != (ConsoleSize{}) {
+				h.sendCtrl(0, consoleResize, 0, resizeMsg(size))
+			}
+		} else {
+			h.sendCtrl(id, consolePortName, 0, []byte(h.cfg.Ports[id-1].Name))
 		}
 
-		var n int
+		h.sendCtrl(id, consolePortOpen, 1, nil)
+
+	case consolePortOpen:
+		slog.Debug("console port open", "id", id, "open", value == 1)
+
+	default:
+		slog.Debug("console control message", "id", id, "event", event, "value", value)
+	}
+}
+
+// sendCtrl queues a control message for the driver. Call flushCtrl to send it.
+func (h *consoleHandler) sendCtrl(id uint32, event, value uint16, data []byte) {
+	msg := binary.LittleEndian.AppendUint32(nil, id)
+	msg = binary.LittleEndian.AppendUint16(msg, event)
+	msg = binary.LittleEndian.AppendUint16(msg, value)
+
+	h.ctrlMu.Lock()
+	h.ctrlOut = append(h.ctrlOut, append(msg, data...))
+	h.ctrlMu.Unlock()
+}
+
+// flushCtrl sends queued control messages until the driver runs out of buffers.
+// The rest are sent when it adds more.
+func (h *consoleHandler) flushCtrl() error {
+	h.ctrlMu.Lock()
+	defer h.ctrlMu.Unlock()
+
+	if h.ctrlQ == nil {
+		return nil
+	}
+
+	for len(h.ctrlOut) > 0 {
+		c, err := h.ctrlQ.Next()
+		if err != nil || c == nil {
+			return err
+		}
+
+		var bufs [][]byte
 		for i, d := range c.Desc {
 			if !d.IsWO() {
 				continue
 			}
 
-			buf, gbe := c.Buf(i)
-			if gbe != nil {
-				return gbe
+			buf, err := c.Buf(i)
+			if err != nil {
+				return err
 			}
 
-			n, err = h.cfg.In.Read(buf)
-			break
+			bufs = append(bufs, buf)
 		}
 
-		if err != nil && err != io.EOF {
-			return err
+		msg := h.ctrlOut[0]
+		h.ctrlOut = h.ctrlOut[1:]
+
+		n := sgCopy(bufs, msg)
+		if n < len(msg) {
+			err = errors.New("console control buffer is too small")
 		}
 
-		if err := c.Release(n); err != nil {
+		if rerr := c.Release(n); rerr != nil {
+			return rerr
+		}
+
+		if err != nil {
 			return err
 		}
 	}
@@ -119,7 +474,114 @@ func (h *consoleHandler) handleRx(q *virtq.Queue) error {
 	return nil
 }
 
-func (h *consoleHandler) handleTx(q *virtq.Queue) error {
+// handleRx copies input to the buffers in q as the guest makes them available.
+// Input waits until there's room for it. It returns when the handler is closed.
+//
+// At the end of the input, the console port sends the guest an end-of-file
+// character (^D), which a terminal in canonical mode turns into end of file.
+// Named ports tell the guest that the host closed the port, so reads return
+// end of file.
+func (h *consoleHandler) handleRx(port int, q virtq.Queue, notify <-chan struct{}, in *consoleInput) {
+	defer h.wg.Done()
+
+	var (
+		pending []byte
+		dataC   = in.dataC
+		err     error
+	)
+
+	for {
+		if pending, err = fillRx(q, pending); err != nil {
+			slog.Error("console rx", "port", port, "err", err)
+		}
+
+		// the input ended, and the guest has all of it
+		if dataC == nil && len(pending) == 0 {
+			if port > 0 {
+				h.sendCtrl(uint32(port), consolePortOpen, 0, nil)
+				if err := h.flushCtrl(); err != nil {
+					slog.Error("console rx", "port", port, "err", err)
+				}
+			}
+
+			return
+		}
+
+		// don't read more until the guest has room
+		var recvC <-chan []byte
+		if len(pending) == 0 {
+			recvC = dataC
+		}
+
+		select {
+		case _, ok := <-notify:
+			if !ok {
+				return
+			}
+
+		case data, ok := <-recvC:
+			if ok {
+				pending = data
+				continue
+			}
+
+			// closing the handler interrupts some inputs
+			select {
+			case <-h.doneC:
+				return
+			default:
+			}
+
+			if dataC = nil; in.err != io.EOF {
+				slog.Error("console input", "port", port, "err", in.err)
+			} else if port == 0 {
+				pending = []byte{0x04}
+			}
+
+		case <-h.doneC:
+			return
+		}
+	}
+}
+
+// fillRx copies data to the buffers available in q, returning what didn't fit.
+func fillRx(q virtq.Queue, data []byte) ([]byte, error) {
+	for len(data) > 0 {
+		c, err := q.Next()
+		if err != nil || c == nil {
+			return data, err
+		}
+
+		var bufs [][]byte
+		for i, d := range c.Desc {
+			if !d.IsWO() {
+				continue
+			}
+
+			buf, err := c.Buf(i)
+			if err != nil {
+				return data, err
+			}
+
+			bufs = append(bufs, buf)
+		}
+
+		n := sgCopy(bufs, data)
+		data = data[n:]
+
+		if err := c.Release(n); err != nil {
+			return data, err
+		}
+	}
+
+	return data, nil
+}
+
+// handleTx writes the buffers in q to w.
+func handleTx(q virtq.Queue, w io.Writer) error {
+	q.DisableNotify()
+	defer q.EnableNotify()
+
 	for {
 		c, err := q.Next()
 		if err != nil {
@@ -127,7 +589,12 @@ func (h *consoleHandler) handleTx(q *virtq.Queue) error {
 		}
 
 		if c == nil {
-			break
+			if !q.EnableNotify() {
+				break
+			}
+
+			q.DisableNotify()
+			continue
 		}
 
 		for i, d := range c.Desc {
@@ -140,7 +607,7 @@ func (h *consoleHandler) handleTx(q *virtq.Queue) error {
 				return err
 			}
 
-			if _, err := h.cfg.Out.Write(buf); err != nil {
+			if _, err := w.Write(buf); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,324 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/c35s/hype/virtio"
+	"github.com/c35s/hype/virtio/virtq"
+)
+
+const (
+	consoleFSize      = 1 << 0
+	consoleFMultiport = 1 << 1
+)
+
+// consolePort is a port backed by a pipe and a buffer.
+type consolePort struct {
+	*io.PipeReader
+	bytes.Buffer
+}
+
+func (p *consolePort) Read(b []byte) (int, error) {
+	return p.PipeReader.Read(b)
+}
+
+// ctrlMsg is a console control message.
+type ctrlMsg struct {
+	id           uint32
+	event, value uint16
+	data         string
+}
+
+// sendCtrl makes a control message available in the control tx queue.
+func (qt *blkTest) sendCtrl(head uint16, m ctrlMsg) {
+	addr := 0x100 + 0x10*uint64(head)
+	binary.LittleEndian.PutUint32(qt.mem[addr:], m.id)
+	binary.LittleEndian.PutUint16(qt.mem[addr+4:], m.event)
+	binary.LittleEndian.PutUint16(qt.mem[addr+6:], m.value)
+
+	qt.pushChain(head, virtq.SplitDesc{Addr: addr, Len: 8})
+}
+
+// ctrlMsgs returns the control messages in the used ring of the control rx
+// queue, which has a 64-byte buffer in each descriptor.
+func (qt *blkTest) ctrlMsgs() (msgs []ctrlMsg) {
+	used := binary.LittleEndian.Uint16(qt.devA[2:])
+	for i := uint16(0); i < used; i++ {
+		elem := qt.devA[4+8*(i%8):]
+		id, length := binary.LittleEndian.Uint32(elem), binary.LittleEndian.Uint32(elem[4:])
+		buf := qt.mem[0x1000+0x100*id:][:length]
+
+		msgs = append(msgs, ctrlMsg{
+			id:    binary.LittleEndian.Uint32(buf),
+			event: binary.LittleEndian.Uint16(buf[4:]),
+			value: binary.LittleEndian.Uint16(buf[6:]),
+			data:  string(buf[8:]),
+		})
+	}
+
+	return msgs
+}
+
+func TestConsoleMultiport(t *testing.T) {
+	sizeC := make(chan virtio.ConsoleSize)
+	pr, pw := io.Pipe()
+	port := &consolePort{PipeReader: pr}
+
+	h, err := virtio.ConsoleDevice{
+		Out:    io.Discard,
+		Ports:  []virtio.ConsolePort{{Name: "agent", RW: port}},
+		Resize: sizeC,
+	}.NewHandler()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { h.Close() })
+
+	features := h.GetFeatures()
+	if features != consoleFSize|consoleFMultiport {
+		t.Fatalf("features %#x", features)
+	}
+
+	if err := h.Ready(features, func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := make([]byte, 12)
+	if err := h.ReadConfig(cfg, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := binary.LittleEndian.Uint32(cfg[4:]); n != 2 {
+		t.Errorf("max_nr_ports %d != 2", n)
+	}
+
+	bt := &blkTest{t: t, h: h}
+	ctrlRx, ctrlTx := bt.queue(2), bt.queue(3)
+
+	for i := uint16(0); i < 8; i++ {
+		ctrlRx.pushChain(i, virtq.SplitDesc{Addr: 0x1000 + 0x100*uint64(i), Len: 64, Flags: virtq.DescFWrite})
+	}
+
+	// each message is answered after the device finishes reading the control
+	// tx queue, so waiting for the answers keeps the next push from racing it
+	recv := func(n int) {
+		for i := 0; i < n; i++ {
+			ctrlRx.wait()
+		}
+
+		ctrlTx.wait()
+	}
+
+	ctrlTx.sendCtrl(0, ctrlMsg{event: 0, value: 1}) // device ready
+	recv(2)
+
+	ctrlTx.sendCtrl(1, ctrlMsg{id: 0, event: 3, value: 1}) // port ready
+	recv(2)
+
+	ctrlTx.sendCtrl(2, ctrlMsg{id: 1, event: 3, value: 1})
+	recv(2)
+
+	sizeC <- virtio.ConsoleSize{Cols: 80, Rows: 24}
+	ctrlRx.wait()
+
+	want := []ctrlMsg{
+		{id: 0, event: 1},                        // device add
+		{id: 1, event: 1},                        // device add
+		{id: 0, event: 4, value: 1},              // console port
+		{id: 0, event: 6, value: 1},              // port open
+		{id: 1, event: 7, data: "agent"},         // port name
+		{id: 1, event: 6, value: 1},              // port open
+		{id: 0, event: 5, data: "\x18\x00P\x00"}, // resize to 24 rows, 80 cols
+	}
+
+	got := ctrlRx.ctrlMsgs()
+	if len(got) != len(want) {
+		t.Fatalf("got %d control messages, want %d: %+v", len(got), len(want), got)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("message %d: %+v != %+v", i, got[i], want[i])
+		}
+	}
+
+	// port 1 uses queues 4 and 5
+	rx, tx := bt.queue(4), bt.queue(5)
+
+	rx.pushChain(0, virtq.SplitDesc{Addr: 0x100, Len: 16, Flags: virtq.DescFWrite})
+	pw.Write([]byte("ping"))
+	rx.wait()
+
+	if got := string(rx.mem[0x100:0x104]); got != "ping" {
+		t.Errorf("port read %q", got)
+	}
+
+	copy(tx.mem[0x100:], "pong")
+	tx.pushChain(0, virtq.SplitDesc{Addr: 0x100, Len: 4})
+	tx.wait()
+
+	if got := port.String(); got != "pong" {
+		t.Errorf("port wrote %q", got)
+	}
+
+	// the end of the input closes the port
+	pw.Close()
+	ctrlRx.wait()
+
+	if got := ctrlRx.ctrlMsgs(); got[len(got)-1] != (ctrlMsg{id: 1, event: 6, value: 0}) {
+		t.Errorf("last message %+v isn't a port close", got[len(got)-1])
+	}
+}
+
+func TestConsoleInput(t *testing.T) {
+	pr, pw := io.Pipe()
+
+	bt := newConsoleTest(t, virtio.ConsoleDevice{In: pr})
+
+	// input is split across the available buffers
+	for i := uint16(0); i < 3; i++ {
+		bt.pushChain(i, virtq.SplitDesc{Addr: 0x100 + 0x10*uint64(i), Len: 4, Flags: virtq.DescFWrite})
+	}
+
+	pw.Write([]byte("0123456789"))
+	for i := 0; i < 3; i++ {
+		bt.wait()
+	}
+
+	got := string(bt.mem[0x100:0x104]) + string(bt.mem[0x110:0x114]) + string(bt.mem[0x120:0x122])
+	if got != "0123456789" {
+		t.Errorf("read %q", got)
+	}
+
+	// the end of the input is an end-of-file character
+	bt.pushChain(3, virtq.SplitDesc{Addr: 0x130, Len: 4, Flags: virtq.DescFWrite})
+	pw.Close()
+	bt.wait()
+
+	if used := binary.LittleEndian.Uint32(bt.devA[4+8*3+4:]); used != 1 || bt.mem[0x130] != 0x04 {
+		t.Errorf("read %d bytes %q at the end of the input", used, bt.mem[0x130:0x130+used])
+	}
+}
+
+func TestConsoleCloseBlockedInput(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	// a pipe read can't be interrupted, so the device must abandon it
+	in := &signalReader{r: pr, readC: make(chan struct{}, 1)}
+
+	h, err := virtio.ConsoleDevice{In: in}.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Ready(0, func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the guest wants input, so the device reads and blocks
+	bt := (&blkTest{t: t, h: h}).queue(0)
+	bt.pushChain(0, virtq.SplitDesc{Addr: 0x100, Len: 16, Flags: virtq.DescFWrite})
+
+	select {
+	case <-in.readC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the device didn't read the input")
+	}
+
+	doneC := make(chan error)
+	go func() { doneC <- h.Close() }()
+
+	select {
+	case <-doneC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close is waiting for the input")
+	}
+}
+
+// signalReader signals each call to Read before reading from r.
+type signalReader struct {
+	r     io.Reader
+	readC chan struct{}
+}
+
+func (sr *signalReader) Read(p []byte) (int, error) {
+	select {
+	case sr.readC <- struct{}{}:
+	default:
+	}
+
+	return sr.r.Read(p)
+}
+
+// newConsoleTest creates a handler for dev and makes queue 0 ready.
+func newConsoleTest(t *testing.T, dev virtio.ConsoleDevice) *blkTest {
+	t.Helper()
+
+	h, err := dev.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { h.Close() })
+
+	if err := h.Ready(0, func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	return (&blkTest{t: t, h: h}).queue(0)
+}
+
+func TestConsoleResize(t *testing.T) {
+	sizeC := make(chan virtio.ConsoleSize)
+
+	h, err := virtio.ConsoleDevice{Resize: sizeC}.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { h.Close() })
+
+	if f := h.GetFeatures(); f != consoleFSize {
+		t.Fatalf("features %#x", f)
+	}
+
+	changedC := make(chan struct{}, 1)
+	if err := h.Ready(consoleFSize, func() { changedC <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	sizeC <- virtio.ConsoleSize{Cols: 132, Rows: 43}
+
+	select {
+	case <-changedC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no config change")
+	}
+
+	cfg := make([]byte, 12)
+	if err := h.ReadConfig(cfg, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cols, rows := binary.LittleEndian.Uint16(cfg), binary.LittleEndian.Uint16(cfg[2:])
+	if cols != 132 || rows != 43 {
+		t.Errorf("config size %dx%d != 132x43", cols, rows)
+	}
+}
+
+func TestConsolePortLimits(t *testing.T) {
+	if _, err := (virtio.ConsoleDevice{Ports: make([]virtio.ConsolePort, 7)}).NewHandler(); err == nil {
+		t.Error("no error for too many ports")
+	}
+
+	if _, err := (virtio.ConsoleDevice{Ports: []virtio.ConsolePort{{}}}).NewHandler(); err == nil {
+		t.Error("no error for a port without a name")
+	}
+}
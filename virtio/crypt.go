@@ -0,0 +1,201 @@
+package virtio
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/xts"
+)
+
+// CryptStorage is block storage that encrypts the sectors of the underlying
+// storage with AES-XTS, using each sector's number as its tweak. It's
+// compatible with dm-crypt's aes-xts-plain64 cipher in plain mode, with sector
+// numbers counted in units of the sector size.
+//
+// CryptStorage is writable if the underlying storage implements io.WriterAt and
+// doesn't report that it's read-only. Writes to part of a sector re-encrypt the
+// whole sector.
+type CryptStorage struct {
+	stg BlockStorage
+	w   io.WriterAt
+	c   *xts.Cipher
+	ss  int64
+
+	mu sync.RWMutex // held exclusively by partial sector writes
+}
+
+// NewCryptStorage encrypts stg with key, which is two AES keys of the same
+// size: 32 bytes for AES-128-XTS or 64 bytes for AES-256-XTS. The sector size
+// must be a power of 2 >= 512. If zero, it is 512.
+func NewCryptStorage(stg BlockStorage, key []byte, sectorSize int) (*CryptStorage, error) {
+	ss := int64(sectorSize)
+	if ss == 0 {
+		ss = 512
+	}
+
+	if ss < 512 || ss&(ss-1) != 0 {
+		return nil, fmt.Errorf("crypt sector size %d is not a power of 2 >= 512", ss)
+	}
+
+	if len(key) != 32 && len(key) != 64 {
+		return nil, fmt.Errorf("crypt key is %d bytes, not 32 or 64", len(key))
+	}
+
+	// XTS is weak if the data and tweak keys are the same
+	if bytes.Equal(key[:len(key)/2], key[len(key)/2:]) {
+		return nil, errors.New("crypt key halves are the same")
+	}
+
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := &CryptStorage{
+		stg: stg,
+		c:   c,
+		ss:  ss,
+	}
+
+	if rr, ok := stg.(ReadOnlyReporter); !ok || !rr.ReadOnly() {
+		cs.w, _ = stg.(io.WriterAt)
+	}
+
+	return cs, nil
+}
+
+// ReadOnly returns true if the underlying storage isn't writable.
+func (cs *CryptStorage) ReadOnly() bool {
+	return cs.w == nil
+}
+
+// ReadAt reads and decrypts the sectors overlapping p.
+func (cs *CryptStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	size, err := cs.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	if off < 0 {
+		return 0, errors.New("crypt read at a negative offset")
+	}
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > size-off {
+		p, err = p[:size-off], io.EOF
+	}
+
+	// aligned reads are decrypted in place
+	start, end := off/cs.ss*cs.ss, (off+int64(len(p))+cs.ss-1)/cs.ss*cs.ss
+
+	buf := p
+	if start != off || end != off+int64(len(p)) {
+		buf = make([]byte, end-start)
+	}
+
+	if err := cs.readSectors(buf, start); err != nil {
+		return 0, err
+	}
+
+	copy(p, buf[off-start:])
+	return len(p), err
+}
+
+// WriteAt encrypts p and writes it to the underlying storage.
+func (cs *CryptStorage) WriteAt(p []byte, off int64) (n int, err error) {
+	if cs.w == nil {
+		return 0, errors.New("crypt storage is read-only")
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	start, end := off/cs.ss*cs.ss, (off+int64(len(p))+cs.ss-1)/cs.ss*cs.ss
+	partial := start != off || end != off+int64(len(p))
+
+	if partial {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+	} else {
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+	}
+
+	size, err := cs.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	if off < 0 || int64(len(p)) > size-off {
+		return 0, fmt.Errorf("crypt write of %d bytes at %d is outside the storage", len(p), off)
+	}
+
+	buf := make([]byte, end-start)
+
+	// merge p with the rest of the sectors at each end
+	if partial {
+		for _, sec := range []int64{start, end - cs.ss} {
+			if err := cs.readSectors(buf[sec-start:sec-start+cs.ss], sec); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	copy(buf[off-start:], p)
+
+	for i := int64(0); i < int64(len(buf)); i += cs.ss {
+		sec := buf[i : i+cs.ss]
+		cs.c.Encrypt(sec, sec, uint64((start+i)/cs.ss))
+	}
+
+	if _, err := cs.w.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// readSectors reads and decrypts whole sectors at off into p.
+func (cs *CryptStorage) readSectors(p []byte, off int64) error {
+	if _, err := cs.stg.ReadAt(p, off); err != nil && err != io.EOF {
+		return err
+	}
+
+	for i := int64(0); i < int64(len(p)); i += cs.ss {
+		sec := p[i : i+cs.ss]
+		cs.c.Decrypt(sec, sec, uint64((off+i)/cs.ss))
+	}
+
+	return nil
+}
+
+// Size returns the size of the underlying storage, rounded down to a whole
+// number of sectors.
+func (cs *CryptStorage) Size() (int64, error) {
+	size, err := cs.stg.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	return size / cs.ss * cs.ss, nil
+}
+
+// Sync syncs the underlying storage if it implements Syncer.
+func (cs *CryptStorage) Sync() error {
+	if s, ok := cs.stg.(Syncer); ok {
+		return s.Sync()
+	}
+
+	return nil
+}
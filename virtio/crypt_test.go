@@ -0,0 +1,149 @@
+package virtio_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"math/rand"
+	"testing"
+
+	"github.com/c35s/hype/virtio"
+	"golang.org/x/crypto/xts"
+)
+
+func TestCryptStorage(t *testing.T) {
+	key := make([]byte, 64)
+	rand.New(rand.NewSource(1)).Read(key)
+
+	for _, ss := range []int{512, 4096} {
+		ms := &virtio.MemStorage{Bytes: make([]byte, 1<<16+100)}
+
+		cs, err := virtio.NewCryptStorage(ms, key, ss)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sz, _ := cs.Size(); sz != 1<<16 {
+			t.Errorf("size %d != %d", sz, 1<<16)
+		}
+
+		// the plaintext mirrors what the storage should read back
+		plain := make([]byte, 1<<16)
+		rand.New(rand.NewSource(2)).Read(plain)
+
+		if _, err := cs.WriteAt(plain, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		writes := []struct{ off, n int }{
+			{0, 1},
+			{100, 1000},
+			{ss - 1, 2},
+			{ss, ss},
+			{3*ss + 7, 2*ss + 9},
+			{1<<16 - 10, 10},
+		}
+
+		for i, w := range writes {
+			p := bytes.Repeat([]byte{byte(i + 1)}, w.n)
+			if _, err := cs.WriteAt(p, int64(w.off)); err != nil {
+				t.Fatalf("write %+v: %v", w, err)
+			}
+
+			copy(plain[w.off:], p)
+		}
+
+		got := make([]byte, len(plain))
+		if _, err := cs.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, plain) {
+			t.Errorf("sector size %d: read doesn't match", ss)
+		}
+
+		// unaligned reads
+		if _, err := cs.ReadAt(got[:1234], 567); err != nil || !bytes.Equal(got[:1234], plain[567:567+1234]) {
+			t.Errorf("sector size %d: unaligned read doesn't match: %v", ss, err)
+		}
+
+		// each sector is encrypted with its number as the tweak
+		c, _ := xts.NewCipher(aes.NewCipher, key)
+		want := make([]byte, ss)
+		for sec := 0; sec < len(plain)/ss; sec++ {
+			c.Encrypt(want, plain[sec*ss:(sec+1)*ss], uint64(sec))
+			if !bytes.Equal(ms.Bytes[sec*ss:(sec+1)*ss], want) {
+				t.Fatalf("sector size %d: sector %d isn't encrypted with its tweak", ss, sec)
+			}
+		}
+
+		if _, err := cs.WriteAt(make([]byte, 2), 1<<16-1); err == nil {
+			t.Error("no error for a write past the end")
+		}
+	}
+}
+
+func TestCryptStorageErrors(t *testing.T) {
+	ms := &virtio.MemStorage{Bytes: make([]byte, 4096)}
+
+	key := make([]byte, 32)
+	if _, err := virtio.NewCryptStorage(ms, key, 0); err == nil {
+		t.Error("no error for a key with identical halves")
+	}
+
+	if _, err := virtio.NewCryptStorage(ms, key[:16], 0); err == nil {
+		t.Error("no error for a short key")
+	}
+
+	key[0] = 1
+	if _, err := virtio.NewCryptStorage(ms, key, 1000); err == nil {
+		t.Error("no error for a bad sector size")
+	}
+
+	// read-only storage
+	cs, err := virtio.NewCryptStorage(&virtio.HTTPStorage{}, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cs.WriteAt(make([]byte, 512), 0); err == nil {
+		t.Error("no error for a write to read-only storage")
+	}
+
+	// storage without WriteAt
+	if cs, err = virtio.NewCryptStorage(struct{ virtio.BlockStorage }{ms}, key, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReadOnlyDevice(t, cs)
+}
+
+func TestBlockCrypt(t *testing.T) {
+	key := make([]byte, 32)
+	rand.New(rand.NewSource(3)).Read(key)
+
+	ms := &virtio.MemStorage{Bytes: make([]byte, 1<<20)}
+	cs, err := virtio.NewCryptStorage(ms, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt := newBlkTest(t, virtio.BlockDevice{Storage: cs}, 0)
+
+	data := bytes.Repeat([]byte("secret!!"), 512)
+	if s := bt.do(1, 8, data, false); s != 0 {
+		t.Fatalf("write status %d", s)
+	}
+
+	if bytes.Contains(ms.Bytes, []byte("secret!!")) {
+		t.Error("plaintext reached the storage")
+	}
+
+	got := make([]byte, len(data))
+	if s := bt.do(0, 8, got, true); s != 0 {
+		t.Fatalf("read status %d", s)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("read doesn't match")
+	}
+}
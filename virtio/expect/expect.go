@@ -0,0 +1,347 @@
+// Package expect scripts interactions with a virtio console. A Console keeps
+// the console's recent output and a timestamped transcript, waits for output
+// matching a regexp, and sends input to the guest.
+package expect
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c35s/hype/virtio"
+)
+
+// Config configures a Console.
+type Config struct {
+
+	// LogSize is the number of bytes kept by the output log, the transcript,
+	// and the buffer searched by Expect. If zero, it is 1 MiB.
+	LogSize int
+
+	// Out, if set, receives a copy of the output.
+	Out io.Writer
+}
+
+// Console is the host side of a console. It's an io.Writer for the console's
+// output, and Input returns a reader for its input.
+type Console struct {
+	cfg   Config
+	in    *input
+	start time.Time
+
+	mu         sync.Mutex
+	log        tailBuffer // the most recent output
+	unmatched  tailBuffer // output that Expect hasn't consumed
+	transcript []Event    // the most recent input and output
+	tsize      int        // bytes of data in the transcript
+	wakeC      chan struct{}
+}
+
+// Event is a transcript entry.
+type Event struct {
+	Time  time.Time
+	Input bool // the host sent Data; otherwise the guest wrote it
+	Data  []byte
+}
+
+// ErrTimeout is returned by Expect when the output doesn't match in time.
+var ErrTimeout = errors.New("expect: timed out")
+
+// New creates a console.
+func New(cfg Config) *Console {
+	if cfg.LogSize == 0 {
+		cfg.LogSize = 1 << 20
+	}
+
+	return &Console{
+		cfg:       cfg,
+		in:        newInput(),
+		start:     time.Now(),
+		log:       tailBuffer{n: cfg.LogSize},
+		unmatched: tailBuffer{n: cfg.LogSize},
+		wakeC:     make(chan struct{}),
+	}
+}
+
+// Device returns a console device that reads its input from the console and
+// writes its output to it.
+func (c *Console) Device() *virtio.ConsoleDevice {
+	return &virtio.ConsoleDevice{
+		In:  c.Input(),
+		Out: c,
+	}
+}
+
+// Input returns the reader for the console's input. Reads block until input
+// is sent or the console is closed.
+func (c *Console) Input() io.Reader {
+	return c.in
+}
+
+// Write records output from the guest. The copy written to Config.Out is
+// complete before Expect sees the output.
+func (c *Console) Write(p []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n = len(p)
+	if c.cfg.Out != nil {
+		n, err = c.cfg.Out.Write(p)
+	}
+
+	c.log.write(p[:n])
+	c.unmatched.write(p[:n])
+	c.record(false, p[:n])
+
+	close(c.wakeC)
+	c.wakeC = make(chan struct{})
+
+	return n, err
+}
+
+// Send sends s to the guest. It doesn't wait for the guest to read it.
+func (c *Console) Send(s string) error {
+	if err := c.in.write([]byte(s)); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.record(true, []byte(s))
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Expect waits up to timeout for the output that Expect hasn't consumed to
+// match re. It consumes the output through the end of the match and returns
+// the match and its submatches. If the output doesn't match in time, Expect
+// returns ErrTimeout, wrapped with the end of the unmatched output.
+func (c *Console) Expect(re *regexp.Regexp, timeout time.Duration) ([]string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		c.mu.Lock()
+		out := c.unmatched.bytes()
+		m := re.FindSubmatchIndex(out)
+		if m != nil {
+			sub := make([]string, len(m)/2)
+			for i := range sub {
+				if m[2*i] >= 0 {
+					sub[i] = string(out[m[2*i]:m[2*i+1]])
+				}
+			}
+
+			c.unmatched.consume(m[1])
+			c.mu.Unlock()
+			return sub, nil
+		}
+
+		wakeC, tail := c.wakeC, string(out[max(len(out)-200, 0):])
+		c.mu.Unlock()
+
+		select {
+		case <-wakeC:
+		case <-timer.C:
+			return nil, fmt.Errorf("%w waiting for %q; output ends with %s", ErrTimeout, re, strconv.Quote(tail))
+		}
+	}
+}
+
+// ExpectString is like Expect, but waits for the literal string s.
+func (c *Console) ExpectString(s string, timeout time.Duration) error {
+	_, err := c.Expect(regexp.MustCompile(regexp.QuoteMeta(s)), timeout)
+	return err
+}
+
+// Log returns the console's most recent output.
+func (c *Console) Log() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.log.bytes()...)
+}
+
+// Transcript returns the console's most recent input and output.
+func (c *Console) Transcript() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Event(nil), c.transcript...)
+}
+
+// WriteTranscript writes the transcript to w, one event per line. Each line has
+// the time since the console was created, < for output or > for input, and the
+// quoted data.
+func (c *Console) WriteTranscript(w io.Writer) error {
+	var b strings.Builder
+	for _, e := range c.Transcript() {
+		dir := "<"
+		if e.Input {
+			dir = ">"
+		}
+
+		fmt.Fprintf(&b, "%10.6f %s %q\n", e.Time.Sub(c.start).Seconds(), dir, e.Data)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Close ends the console's input. Reads return io.EOF after the input sent
+// before Close.
+func (c *Console) Close() error {
+	c.in.close()
+	return nil
+}
+
+// record appends an event to the transcript, dropping the oldest events if
+// it's too big. The caller holds c.mu.
+func (c *Console) record(in bool, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	c.transcript = append(c.transcript, Event{
+		Time:  time.Now(),
+		Input: in,
+		Data:  append([]byte(nil), p...),
+	})
+
+	c.tsize += len(p)
+
+	var drop int
+	for c.tsize > c.cfg.LogSize && drop < len(c.transcript)-1 {
+		c.tsize -= len(c.transcript[drop].Data)
+		drop++
+	}
+
+	c.transcript = c.transcript[drop:]
+}
+
+// tailBuffer keeps the last n bytes written to it. Its slice grows to 2n bytes
+// before the tail is moved to the front, so each byte written is copied at most
+// once more, however small the writes.
+type tailBuffer struct {
+	buf []byte
+	n   int
+}
+
+func (tb *tailBuffer) write(p []byte) {
+	if len(p) >= tb.n {
+		tb.buf = append(tb.buf[:0], p[len(p)-tb.n:]...)
+		return
+	}
+
+	if len(tb.buf)+len(p) > 2*tb.n {
+		keep := tb.n - len(p)
+		tb.buf = append(tb.buf[:0], tb.buf[len(tb.buf)-keep:]...)
+	}
+
+	tb.buf = append(tb.buf, p...)
+}
+
+// bytes returns the last n bytes written, or fewer if fewer were written or
+// some were consumed. The slice is valid until the next write.
+func (tb *tailBuffer) bytes() []byte {
+	return tb.buf[max(len(tb.buf)-tb.n, 0):]
+}
+
+// consume drops the first k bytes returned by bytes.
+func (tb *tailBuffer) consume(k int) {
+	tb.buf = tb.bytes()[k:]
+}
+
+// input is a console's input. Reads wait for writes, and stop waiting at the
+// read deadline, so closing a console device interrupts them.
+type input struct {
+	mu       sync.Mutex
+	buf      []byte
+	closed   bool
+	deadline time.Time
+	wakeC    chan struct{} // closed and replaced when anything changes
+}
+
+func newInput() *input {
+	return &input{wakeC: make(chan struct{})}
+}
+
+func (in *input) Read(p []byte) (int, error) {
+	for {
+		in.mu.Lock()
+
+		switch {
+		case len(in.buf) > 0:
+			n := copy(p, in.buf)
+			in.buf = in.buf[n:]
+			in.mu.Unlock()
+			return n, nil
+
+		case in.closed:
+			in.mu.Unlock()
+			return 0, io.EOF
+
+		case !in.deadline.IsZero() && !time.Now().Before(in.deadline):
+			in.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		wakeC, deadline := in.wakeC, in.deadline
+		in.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-wakeC
+			continue
+		}
+
+		t := time.NewTimer(time.Until(deadline))
+		select {
+		case <-wakeC:
+		case <-t.C:
+		}
+
+		t.Stop()
+	}
+}
+
+// SetReadDeadline sets the time after which reads fail. A zero time means
+// reads don't time out.
+func (in *input) SetReadDeadline(t time.Time) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.deadline = t
+	in.wake()
+	return nil
+}
+
+func (in *input) write(p []byte) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.closed {
+		return errors.New("expect: console is closed")
+	}
+
+	in.buf = append(in.buf, p...)
+	in.wake()
+	return nil
+}
+
+func (in *input) close() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.closed = true
+	in.wake()
+}
+
+// wake wakes waiting reads. The caller holds in.mu.
+func (in *input) wake() {
+	close(in.wakeC)
+	in.wakeC = make(chan struct{})
+}
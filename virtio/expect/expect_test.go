@@ -0,0 +1,209 @@
+package expect_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c35s/hype/virtio/expect"
+)
+
+func TestExpect(t *testing.T) {
+	var mirror strings.Builder
+	c := expect.New(expect.Config{Out: &mirror})
+
+	go func() {
+		for _, s := range []string{"Linux version 6.1\r\n", "login: ", "root\r\n# "} {
+			time.Sleep(10 * time.Millisecond)
+			c.Write([]byte(s))
+		}
+	}()
+
+	m, err := c.Expect(regexp.MustCompile(`Linux version (\S+)`), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m) != 2 || m[1] != "6.1" {
+		t.Errorf("match %q", m)
+	}
+
+	if err := c.ExpectString("login: ", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a match consumes the output, so it doesn't match again
+	if err := c.ExpectString("login: ", 10*time.Millisecond); !errors.Is(err, expect.ErrTimeout) {
+		t.Errorf("second match: %v", err)
+	}
+
+	if err := c.ExpectString("# ", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(c.Log()); got != "Linux version 6.1\r\nlogin: root\r\n# " {
+		t.Errorf("log %q", got)
+	}
+
+	if mirror.String() != string(c.Log()) {
+		t.Errorf("mirror %q", mirror.String())
+	}
+}
+
+func TestExpectTimeout(t *testing.T) {
+	c := expect.New(expect.Config{})
+	c.Write([]byte("Kernel panic"))
+
+	_, err := c.Expect(regexp.MustCompile(`PASS`), 10*time.Millisecond)
+	if !errors.Is(err, expect.ErrTimeout) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	if !strings.Contains(err.Error(), "Kernel panic") {
+		t.Errorf("error %q doesn't include the output", err)
+	}
+}
+
+func TestLogSize(t *testing.T) {
+	c := expect.New(expect.Config{LogSize: 8})
+
+	c.Write([]byte("0123"))
+	c.Send("in")
+	c.Write([]byte("456789"))
+
+	if got := string(c.Log()); got != "23456789" {
+		t.Errorf("log %q", got)
+	}
+
+	// the transcript drops whole events
+	tr := c.Transcript()
+	if len(tr) != 2 || !tr[0].Input || string(tr[1].Data) != "456789" {
+		t.Errorf("transcript %+v", tr)
+	}
+
+	// Expect only sees the kept output
+	if err := c.ExpectString("0", 0); !errors.Is(err, expect.ErrTimeout) {
+		t.Errorf("matched dropped output: %v", err)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	c := expect.New(expect.Config{})
+
+	c.Write([]byte("login: "))
+	c.Send("root\n")
+
+	tr := c.Transcript()
+	if len(tr) != 2 {
+		t.Fatalf("%d events", len(tr))
+	}
+
+	if tr[0].Input || string(tr[0].Data) != "login: " || !tr[1].Input || string(tr[1].Data) != "root\n" {
+		t.Errorf("transcript %+v", tr)
+	}
+
+	if tr[1].Time.Before(tr[0].Time) {
+		t.Error("events are out of order")
+	}
+
+	var b strings.Builder
+	if err := c.WriteTranscript(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], ` < "login: "`) || !strings.HasSuffix(lines[1], ` > "root\n"`) {
+		t.Errorf("transcript:\n%s", b.String())
+	}
+}
+
+func TestSend(t *testing.T) {
+	c := expect.New(expect.Config{})
+	in := c.Input()
+
+	readC := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(in)
+		readC <- string(b)
+	}()
+
+	c.Send("echo ")
+	c.Send("hi\n")
+	c.Close()
+
+	select {
+	case got := <-readC:
+		if got != "echo hi\n" {
+			t.Errorf("read %q", got)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("input didn't end")
+	}
+
+	if err := c.Send("more"); err == nil {
+		t.Error("no error for input after close")
+	}
+}
+
+func TestInputDeadline(t *testing.T) {
+	c := expect.New(expect.Config{})
+
+	// the console device sets a read deadline to stop waiting for input
+	in := c.Input().(interface {
+		io.Reader
+		SetReadDeadline(time.Time) error
+	})
+
+	errC := make(chan error)
+	go func() {
+		_, err := in.Read(make([]byte, 1))
+		errC <- err
+	}()
+
+	in.SetReadDeadline(time.Now())
+
+	select {
+	case err := <-errC:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("read error %v", err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("read didn't stop at the deadline")
+	}
+}
+
+func TestLogSmallWrites(t *testing.T) {
+	c := expect.New(expect.Config{LogSize: 100})
+
+	var all []byte
+	for i := 0; i < 1000; i++ {
+		b := []byte{'a' + byte(i%26)}
+		all = append(all, b...)
+		c.Write(b)
+	}
+
+	if got, want := string(c.Log()), string(all[len(all)-100:]); got != want {
+		t.Errorf("log %q, want %q", got, want)
+	}
+
+	// Expect consumes up to the match and still searches only the kept output
+	m, err := c.Expect(regexp.MustCompile(`[a-z]{3}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := string(all[len(all)-100 : len(all)-97]); m[0] != want {
+		t.Errorf("match %q, want %q", m[0], want)
+	}
+
+	c.Write([]byte("end"))
+	if err := c.ExpectString(string(all[len(all)-97:])+"end", 0); err != nil {
+		t.Error(err)
+	}
+}
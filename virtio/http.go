@@ -0,0 +1,497 @@
+package virtio
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP storage is read-only block storage backed by an HTTP URL.
+// The server must support HEAD requests and GET requests with a Range header.
+//
+// The URL is fetched in chunks, which are cached in memory and optionally on
+// disk. Failed requests are retried with exponential backoff. The URL's ETag or
+// Last-Modified time is recorded by the first request and checked by the rest,
+// so the image can't change underneath a running guest. Close stops prefetching
+// and cancels the requests in flight.
+type HTTPStorage struct {
+	URL string
+
+	// Client is the HTTP client to use for requests. If nil, a client with a
+	// transport that keeps enough idle connections for concurrent prefetching
+	// is used.
+	Client *http.Client
+
+	// ChunkSize is the size of the ranges requested from the server, which are
+	// also the units of caching. If zero, it is 1 MiB.
+	ChunkSize int
+
+	// CacheSize is the maximum number of bytes of chunks to cache in memory.
+	// If zero, it is 64 MiB. If negative, chunks aren't cached in memory.
+	CacheSize int64
+
+	// CacheDir is a directory for a persistent on-disk chunk cache. Chunks are
+	// keyed by the URL and its ETag or Last-Modified time, so they are never read
+	// from the cache after the URL's content changes. The on-disk cache is not
+	// limited in size. If empty, chunks aren't cached on disk.
+	CacheDir string
+
+	// Readahead is the number of chunks following each read to prefetch. The
+	// storage prefetches with this many workers, and doesn't prefetch if chunks
+	// aren't cached in memory or on disk.
+	Readahead int
+
+	// Retries is the number of times to retry a failed request. If zero, it is 3.
+	// If negative, failed requests aren't retried.
+	Retries int
+
+	once      sync.Once
+	initErr   error
+	client    *http.Client
+	size      int64
+	etag      string
+	modified  string
+	chunkSize int64
+	maxChunks int
+
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+	raC    chan int64 // chunks to prefetch; nil if readahead is off
+	raWG   sync.WaitGroup
+
+	mu      sync.Mutex
+	lru     *list.List // cached chunks, most recently used first
+	cached  map[int64]*list.Element
+	fetches map[int64]*httpFetch
+	queued  map[int64]bool // chunks in raC
+}
+
+// httpChunk is a cached chunk.
+type httpChunk struct {
+	idx  int64
+	data []byte
+}
+
+// httpFetch is a chunk being fetched. Its fields are valid after done is closed.
+type httpFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+var (
+	// errHTTPChanged is returned when the URL's content changes.
+	errHTTPChanged = errors.New("block device http storage changed")
+
+	// errHTTPClosed is returned after the storage is closed.
+	errHTTPClosed = errors.New("block device http storage is closed")
+)
+
+const (
+	httpDefaultChunkSize = 1 << 20
+	httpDefaultCacheSize = 64 << 20
+	httpDefaultRetries   = 3
+	httpMaxIdleConns     = 16
+	httpBackoff          = 100 * time.Millisecond
+	httpMaxBackoff       = 5 * time.Second
+)
+
+// ReadAt reads from the backing URL at off. It fetches the chunks containing
+// the range concurrently, then starts prefetching the chunks that follow.
+func (hs *HTTPStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	if err := hs.init(); err != nil {
+		return 0, err
+	}
+
+	if off < 0 {
+		return 0, errors.New("block device http read at a negative offset")
+	}
+
+	if off >= hs.size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > hs.size-off {
+		p, err = p[:hs.size-off], io.EOF
+	}
+
+	if len(p) == 0 {
+		return 0, err
+	}
+
+	first, last := off/hs.chunkSize, (off+int64(len(p))-1)/hs.chunkSize
+
+	var (
+		chunks = make([][]byte, last-first+1)
+		errs   = make([]error, len(chunks))
+		wg     sync.WaitGroup
+	)
+
+	for i := range chunks[1:] {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chunks[i], errs[i] = hs.chunk(first + int64(i))
+		}(i + 1)
+	}
+
+	chunks[0], errs[0] = hs.chunk(first)
+	wg.Wait()
+
+	for i, c := range chunks {
+		if errs[i] != nil {
+			return n, errs[i]
+		}
+
+		n += copy(p[n:], c[off+int64(n)-(first+int64(i))*hs.chunkSize:])
+	}
+
+	hs.readahead(last + 1)
+	return n, err
+}
+
+// Size returns the Content-Length of the backing URL, which is read by a HEAD
+// request the first time the storage is used.
+func (hs *HTTPStorage) Size() (int64, error) {
+	if err := hs.init(); err != nil {
+		return 0, err
+	}
+
+	return hs.size, nil
+}
+
+// init sends a HEAD request to the backing URL, recording its size and validator.
+func (hs *HTTPStorage) init() error {
+	hs.once.Do(func() {
+		hs.client = hs.Client
+		if hs.client == nil {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.MaxIdleConnsPerHost = httpMaxIdleConns
+			hs.client = &http.Client{Transport: t}
+		}
+
+		hs.chunkSize = int64(hs.ChunkSize)
+		if hs.chunkSize <= 0 {
+			hs.chunkSize = httpDefaultChunkSize
+		}
+
+		cacheSize := hs.CacheSize
+		if cacheSize == 0 {
+			cacheSize = httpDefaultCacheSize
+		}
+
+		if cacheSize > 0 {
+			hs.maxChunks = int(max(cacheSize/hs.chunkSize, 1))
+		}
+
+		hs.lru = list.New()
+		hs.cached = make(map[int64]*list.Element)
+		hs.fetches = make(map[int64]*httpFetch)
+		hs.queued = make(map[int64]bool)
+
+		hs.ctx, hs.cancel = context.WithCancel(context.Background())
+
+		// prefetched chunks are useless if nothing keeps them
+		if hs.Readahead > 0 && (hs.maxChunks > 0 || hs.CacheDir != "") {
+			hs.raC = make(chan int64, hs.Readahead)
+			for i := 0; i < hs.Readahead; i++ {
+				hs.raWG.Add(1)
+				go hs.prefetch()
+			}
+		}
+
+		hs.initErr = hs.retry(func() (bool, error) {
+			res, err := hs.client.Head(hs.URL)
+			if err != nil {
+				return true, err
+			}
+
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				return retryable(res.StatusCode), fmt.Errorf("block device http request failed: HEAD %s: status %d", hs.URL, res.StatusCode)
+			}
+
+			if hs.size, err = strconv.ParseInt(res.Header.Get("content-length"), 10, 64); err != nil {
+				return false, fmt.Errorf("block device http request failed: HEAD %s: %w", hs.URL, err)
+			}
+
+			hs.etag = res.Header.Get("etag")
+			hs.modified = res.Header.Get("last-modified")
+			return false, nil
+		})
+
+		if hs.initErr == nil && hs.etag == "" && hs.modified == "" {
+			slog.Warn("block device http storage has no ETag or Last-Modified header; changes can't be detected", "url", hs.URL)
+		}
+	})
+
+	return hs.initErr
+}
+
+// chunk returns chunk idx from the cache, or fetches it. Concurrent callers
+// share a fetch. The returned slice must not be modified.
+func (hs *HTTPStorage) chunk(idx int64) ([]byte, error) {
+	hs.mu.Lock()
+
+	if e, ok := hs.cached[idx]; ok {
+		hs.lru.MoveToFront(e)
+		hs.mu.Unlock()
+		return e.Value.(*httpChunk).data, nil
+	}
+
+	if f, ok := hs.fetches[idx]; ok {
+		hs.mu.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+
+	f := &httpFetch{done: make(chan struct{})}
+	hs.fetches[idx] = f
+	hs.mu.Unlock()
+
+	f.data, f.err = hs.load(idx)
+
+	hs.mu.Lock()
+	delete(hs.fetches, idx)
+	if f.err == nil && hs.maxChunks > 0 {
+		hs.cached[idx] = hs.lru.PushFront(&httpChunk{idx: idx, data: f.data})
+		for hs.lru.Len() > hs.maxChunks {
+			delete(hs.cached, hs.lru.Remove(hs.lru.Back()).(*httpChunk).idx)
+		}
+	}
+
+	hs.mu.Unlock()
+
+	close(f.done)
+	return f.data, f.err
+}
+
+// readahead queues the chunks from idx that aren't cached, being fetched, or
+// already queued for prefetching. It drops them if the queue is full.
+func (hs *HTTPStorage) readahead(idx int64) {
+	if hs.raC == nil {
+		return
+	}
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for i := idx; i < idx+int64(hs.Readahead) && i*hs.chunkSize < hs.size; i++ {
+		if _, ok := hs.cached[i]; ok {
+			continue
+		}
+
+		if _, ok := hs.fetches[i]; ok || hs.queued[i] {
+			continue
+		}
+
+		select {
+		case hs.raC <- i:
+			hs.queued[i] = true
+
+		default:
+			return
+		}
+	}
+}
+
+// prefetch fetches queued chunks until the storage is closed.
+func (hs *HTTPStorage) prefetch() {
+	defer hs.raWG.Done()
+	for {
+		select {
+		case <-hs.ctx.Done():
+			return
+
+		case i := <-hs.raC:
+			hs.mu.Lock()
+			delete(hs.queued, i)
+			hs.mu.Unlock()
+
+			if _, err := hs.chunk(i); err != nil && hs.ctx.Err() == nil {
+				slog.Warn("block device http readahead", "url", hs.URL, "chunk", i, "err", err)
+			}
+		}
+	}
+}
+
+// Close stops prefetching and cancels the requests in flight. After the storage
+// is closed, reads of chunks that aren't cached fail.
+func (hs *HTTPStorage) Close() error {
+	// the storage can't be initialized after Close
+	hs.once.Do(func() { hs.initErr = errHTTPClosed })
+
+	if hs.cancel != nil {
+		hs.cancel()
+		hs.raWG.Wait()
+	}
+
+	return nil
+}
+
+// load reads chunk idx from the on-disk cache, or gets it from the backing URL.
+func (hs *HTTPStorage) load(idx int64) ([]byte, error) {
+	size := min(hs.chunkSize, hs.size-idx*hs.chunkSize)
+	path := hs.cachePath(idx)
+
+	if path != "" {
+		if data, err := os.ReadFile(path); err == nil && int64(len(data)) == size {
+			return data, nil
+		}
+	}
+
+	data := make([]byte, size)
+	err := hs.retry(func() (bool, error) {
+		return hs.get(data, idx*hs.chunkSize)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		if err := writeFileAtomic(path, data); err != nil {
+			slog.Warn("block device http cache", "url", hs.URL, "err", err)
+		}
+	}
+
+	return data, nil
+}
+
+// get fills p with the range of the backing URL at off. It returns true if
+// the request failed and should be retried.
+func (hs *HTTPStorage) get(p []byte, off int64) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(hs.ctx, http.MethodGet, hs.URL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	// weak ETags can't be used with If-Match
+	if hs.etag != "" && !strings.HasPrefix(hs.etag, "W/") {
+		req.Header.Set("if-match", hs.etag)
+	} else if hs.modified != "" {
+		req.Header.Set("if-unmodified-since", hs.modified)
+	}
+
+	res, err := hs.client.Do(req)
+	if err != nil {
+		if hs.ctx.Err() != nil {
+			return false, errHTTPClosed
+		}
+
+		return true, err
+	}
+
+	defer func() {
+		// drain the body so the connection can be reused
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return false, fmt.Errorf("%w: GET %s: precondition failed", errHTTPChanged, hs.URL)
+	}
+
+	if res.StatusCode != http.StatusPartialContent {
+		return retryable(res.StatusCode), fmt.Errorf("block device http request failed: GET %s: status %d != %d",
+			hs.URL, res.StatusCode, http.StatusPartialContent)
+	}
+
+	if etag := res.Header.Get("etag"); hs.etag != "" && etag != "" && etag != hs.etag {
+		return false, fmt.Errorf("%w: GET %s: ETag %s != %s", errHTTPChanged, hs.URL, etag, hs.etag)
+	}
+
+	if mod := res.Header.Get("last-modified"); hs.etag == "" && hs.modified != "" && mod != "" && mod != hs.modified {
+		return false, fmt.Errorf("%w: GET %s: Last-Modified %s != %s", errHTTPChanged, hs.URL, mod, hs.modified)
+	}
+
+	if _, err := io.ReadFull(res.Body, p); err != nil {
+		return true, fmt.Errorf("block device http request failed: GET %s: %w", hs.URL, err)
+	}
+
+	return false, nil
+}
+
+// retry calls f until it succeeds or returns an error that shouldn't be
+// retried, backing off exponentially between attempts.
+func (hs *HTTPStorage) retry(f func() (retry bool, err error)) error {
+	retries := hs.Retries
+	if retries == 0 {
+		retries = httpDefaultRetries
+	}
+
+	backoff := httpBackoff
+	for i := 0; ; i++ {
+		retry, err := f()
+		if err == nil || !retry || i >= retries {
+			return err
+		}
+
+		slog.Debug("block device http retry", "url", hs.URL, "err", err, "backoff", backoff)
+
+		select {
+		case <-hs.ctx.Done():
+			return errHTTPClosed
+
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, httpMaxBackoff)
+	}
+}
+
+// retryable returns true if a request that failed with status code should be retried.
+func retryable(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// cachePath returns the on-disk cache path for chunk idx, or the empty string
+// if chunks aren't cached on disk.
+func (hs *HTTPStorage) cachePath(idx int64) string {
+	if hs.CacheDir == "" || (hs.etag == "" && hs.modified == "") {
+		return ""
+	}
+
+	key := sha256.Sum256([]byte(strings.Join([]string{hs.URL, hs.etag, hs.modified, strconv.FormatInt(hs.chunkSize, 10)}, "\n")))
+	return filepath.Join(hs.CacheDir, hex.EncodeToString(key[:16]), strconv.FormatInt(idx, 10))
+}
+
+// writeFileAtomic writes data to a temporary file, then renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".chunk")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
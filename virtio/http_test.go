@@ -0,0 +1,260 @@
+package virtio_test
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c35s/hype/virtio"
+)
+
+// httpImage serves an image with an ETag, counting GET requests. It fails
+// the first failN requests with status 503.
+type httpImage struct {
+	mu    sync.Mutex
+	data  []byte
+	etag  string
+	gets  map[string]int // by range
+	failN int32
+}
+
+func (img *httpImage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.AddInt32(&img.failN, -1) >= 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	img.mu.Lock()
+	data, etag := img.data, img.etag
+	if r.Method == http.MethodGet {
+		img.gets[r.Header.Get("range")]++
+	}
+
+	img.mu.Unlock()
+
+	w.Header().Set("etag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (img *httpImage) getCount() (n int) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	for _, c := range img.gets {
+		n += c
+	}
+
+	return n
+}
+
+func newHTTPImage(t *testing.T, size int) (*httpImage, *httptest.Server) {
+	img := &httpImage{
+		data: make([]byte, size),
+		etag: `"v1"`,
+		gets: make(map[string]int),
+	}
+
+	rand.New(rand.NewSource(1)).Read(img.data)
+
+	srv := httptest.NewServer(img)
+	t.Cleanup(srv.Close)
+	return img, srv
+}
+
+func TestHTTPStorage(t *testing.T) {
+	img, srv := newHTTPImage(t, 10000)
+	hs := &virtio.HTTPStorage{URL: srv.URL, ChunkSize: 1024, Readahead: 2}
+
+	if sz, err := hs.Size(); err != nil || sz != 10000 {
+		t.Fatalf("size %d, %v", sz, err)
+	}
+
+	// a read spanning 3 chunks, then reads from cached and prefetched chunks
+	p := make([]byte, 4096)
+	if n, err := hs.ReadAt(p[:2000], 1000); err != nil || n != 2000 {
+		t.Fatalf("read n=%d err=%v", n, err)
+	}
+
+	if !bytes.Equal(p[:2000], img.data[1000:3000]) {
+		t.Fatal("read doesn't match")
+	}
+
+	// wait for the readahead of chunks 3 and 4
+	deadline := time.Now().Add(5 * time.Second)
+	for img.getCount() < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := hs.ReadAt(p[:2000], 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p[:2000], img.data[1024:3024]) {
+		t.Error("cached read doesn't match")
+	}
+
+	if n := img.getCount(); n != 5 {
+		t.Errorf("%d GETs != 5", n)
+	}
+
+	img.mu.Lock()
+	for r, n := range img.gets {
+		if n != 1 {
+			t.Errorf("range %s was fetched %d times", r, n)
+		}
+	}
+
+	img.mu.Unlock()
+
+	// the short last chunk
+	if n, err := hs.ReadAt(p[:100], 9950); n != 50 || err == nil {
+		t.Errorf("read past end: n=%d err=%v", n, err)
+	}
+
+	if !bytes.Equal(p[:50], img.data[9950:]) {
+		t.Error("last chunk doesn't match")
+	}
+
+	// the image changes underneath the storage
+	img.mu.Lock()
+	img.etag = `"v2"`
+	img.mu.Unlock()
+
+	if _, err := hs.ReadAt(p[:10], 8000); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("no changed error: %v", err)
+	}
+}
+
+func TestHTTPStorageRetry(t *testing.T) {
+	img, srv := newHTTPImage(t, 4096)
+	atomic.StoreInt32(&img.failN, 2)
+
+	hs := &virtio.HTTPStorage{URL: srv.URL, ChunkSize: 1024}
+
+	p := make([]byte, 1024)
+	if _, err := hs.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&img.failN, 2)
+	if _, err := hs.ReadAt(p, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p, img.data[1024:2048]) {
+		t.Error("read doesn't match")
+	}
+
+	atomic.StoreInt32(&img.failN, 2)
+	hs = &virtio.HTTPStorage{URL: srv.URL, Retries: -1}
+	if _, err := hs.Size(); err == nil {
+		t.Error("no error without retries")
+	}
+}
+
+func TestHTTPStorageDiskCache(t *testing.T) {
+	img, srv := newHTTPImage(t, 4096)
+	dir := t.TempDir()
+
+	p := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		hs := &virtio.HTTPStorage{URL: srv.URL, ChunkSize: 1024, CacheSize: -1, CacheDir: dir}
+		if _, err := hs.ReadAt(p, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(p, img.data) {
+			t.Fatalf("read %d doesn't match", i)
+		}
+	}
+
+	if n := img.getCount(); n != 4 {
+		t.Errorf("%d GETs != 4", n)
+	}
+
+	// a changed image isn't read from the cache
+	img.mu.Lock()
+	img.etag = `"v2"`
+	img.data = bytes.Repeat([]byte{1}, 4096)
+	img.mu.Unlock()
+
+	hs := &virtio.HTTPStorage{URL: srv.URL, ChunkSize: 1024, CacheDir: dir}
+	if _, err := hs.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p, img.data) {
+		t.Error("read stale chunks from the cache")
+	}
+}
+
+func TestHTTPStorageReadaheadUncached(t *testing.T) {
+	img, srv := newHTTPImage(t, 8192)
+
+	// nothing could keep the prefetched chunks
+	hs := &virtio.HTTPStorage{URL: srv.URL, ChunkSize: 1024, CacheSize: -1, Readahead: 4}
+	defer hs.Close()
+
+	if _, err := hs.ReadAt(make([]byte, 1024), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := img.getCount(); n != 1 {
+		t.Errorf("%d GETs != 1", n)
+	}
+}
+
+func TestHTTPStorageClose(t *testing.T) {
+	_, srv := newHTTPImage(t, 4096)
+
+	// GETs hang until they're canceled
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			<-r.Context().Done()
+			return
+		}
+
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	t.Cleanup(hang.Close)
+
+	hs := &virtio.HTTPStorage{URL: hang.URL, ChunkSize: 1024, Readahead: 2}
+
+	errC := make(chan error)
+	go func() {
+		_, err := hs.ReadAt(make([]byte, 1024), 0)
+		errC <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := hs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Error("no error from a read canceled by close")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't cancel the read")
+	}
+
+	// storage closed before it's used never sends a request
+	hs = &virtio.HTTPStorage{URL: "http://invalid.test"}
+	hs.Close()
+
+	if _, err := hs.Size(); err == nil {
+		t.Error("no error from closed storage")
+	}
+}
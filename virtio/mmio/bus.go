@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log/slog"
+	"os"
 	"sync"
 	"unsafe"
 
@@ -15,6 +16,12 @@ import (
 type Config struct {
 	MemAt  func(addr uint64, size int) ([]byte, error)
 	Notify func(irq int) error
+
+	// IOEventFD, if set, is called to attach (or detach, if assign is false) an
+	// eventfd that should be signaled when the guest writes data to the 4-byte
+	// register at addr. The bus uses it to receive queue notifications without
+	// handling an MMIO exit on the VCPU thread.
+	IOEventFD func(addr uint64, data uint32, fd int, assign bool) error
 }
 
 type Bus struct {
@@ -31,6 +38,14 @@ type device struct {
 	state   deviceState
 
 	qC map[int]chan struct{}
+	qE map[int]*queueEvent
+}
+
+// queueEvent forwards signals from a queue's ioeventfd to its notify channel.
+type queueEvent struct {
+	fd    int // don't call f.Fd: it makes reads blocking
+	f     *os.File
+	doneC chan struct{}
 }
 
 type deviceState struct {
@@ -107,6 +122,7 @@ func NewBus(devices []virtio.DeviceConfig, cfg Config) (*Bus, error) {
 
 			handler: h,
 			qC:      make(map[int]chan struct{}),
+			qE:      make(map[int]*queueEvent),
 		}
 
 		b.dev[i] = d
@@ -147,6 +163,12 @@ func (b *Bus) Devices() []DeviceInfo {
 	return dd
 }
 
+// Handler returns the handler of device i, in the order of the configs passed
+// to NewBus.
+func (b *Bus) Handler(i int) virtio.DeviceHandler {
+	return b.dev[i].handler
+}
+
 // Close closes all devices, returning the first error.
 func (b *Bus) Close() error {
 	for _, d := range b.dev {
@@ -166,36 +188,41 @@ func (d *device) HandleMMIO(off int, data []byte, isWrite bool) (err error) {
 		if err != nil && !(d.needsReset() || d.driverFailed()) {
 			notify := d.isOperatingNormally()
 			d.state.status |= statusNeedsReset
-			d.state.version++
-
-			if notify {
-				d.state.intStatus |= intStatusConfigChange
-				if err := d.bus.cfg.Notify(d.info.IRQ); err != nil {
-					slog.Error("virtio config change notification failed",
-						"irq", d.info.IRQ, "err", err)
-				}
-			}
+			d.configChanged(notify)
 		}
 	}()
 
+	// "The driver MUST only use 32 bit wide and aligned reads and writes" to
+	// the registers before the device-specific configuration space.
+	if off < regDeviceConfigStart && (len(data) != 4 || off%4 != 0) {
+		return unix.EINVAL
+	}
+
 	if isWrite {
 		return d.writeMMIO(off, data)
 	}
 
+	clear(data)
 	return d.readMMIO(off, data)
 }
 
-// Close closes the device's notification channels,
-// then calls the handler's Close method,
-// returning any error.
+// Close detaches the device's ioeventfds and closes its notification
+// channels, then calls the handler's Close method, returning any error.
 func (d *device) Close() error {
 	d.mu.Lock()
-	defer d.mu.Unlock()
+
+	if err := d.detachQueueEvents(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
 
 	for _, c := range d.qC {
 		close(c)
 	}
 
+	d.mu.Unlock()
+
+	// the handler's goroutines may need the lock to notify the driver before they stop
 	return d.handler.Close()
 }
 
@@ -218,7 +245,7 @@ func (d *device) readMMIO(off int, p []byte) error {
 		le.PutUint32(p, uint32(d.getFeatures()>>(32*d.state.deviceFeaturesSel)))
 
 	case regQueueNumMax:
-		le.PutUint32(p, 1<<15)
+		le.PutUint32(p, queueNumMax)
 
 	case regQueueReady:
 		le.PutUint32(p, d.selectedQueue().Ready)
@@ -235,12 +262,10 @@ func (d *device) readMMIO(off int, p []byte) error {
 	default:
 		switch {
 		case off >= regDeviceConfigStart:
-			if err := d.handler.ReadConfig(p, off-regDeviceConfigStart); err != nil {
-				panic(err)
-			}
+			return d.handler.ReadConfig(p, off-regDeviceConfigStart)
 
 		default:
-			panic(off)
+			return unix.EINVAL
 		}
 	}
 
@@ -300,7 +325,52 @@ func (d *device) writeMMIO(off int, p []byte) error {
 		return d.writeQueueDeviceHigh(le.Uint32(p))
 
 	default:
-		panic(off)
+		if off >= regDeviceConfigStart {
+			return d.writeConfig(p, off-regDeviceConfigStart)
+		}
+
+		return unix.EINVAL
+	}
+}
+
+// writeConfig passes a device configuration write to the handler. Every write
+// bumps the config generation. If the handler reports that the write changed
+// other fields, the device also sends a configuration change notification.
+func (d *device) writeConfig(p []byte, off int) error {
+	w, ok := d.handler.(virtio.ConfigWriter)
+	if !ok {
+		return unix.EPERM
+	}
+
+	changed, err := w.WriteConfig(p, off)
+	if err != nil {
+		return err
+	}
+
+	d.configChanged(changed && d.isOperatingNormally())
+	return nil
+}
+
+// handlerConfigChanged is the callback passed to the handler's Ready method.
+// It notifies the driver unless the device was reset or failed.
+func (d *device) handlerConfigChanged() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.configChanged(d.isOperatingNormally())
+}
+
+// configChanged bumps the config generation. If notify is true, it also sets
+// the config change interrupt status bit and notifies the driver.
+func (d *device) configChanged(notify bool) {
+	d.state.version++
+
+	if notify {
+		d.state.intStatus |= intStatusConfigChange
+		if err := d.bus.cfg.Notify(d.info.IRQ); err != nil {
+			slog.Error("virtio config change notification failed",
+				"irq", d.info.IRQ, "err", err)
+		}
 	}
 }
 
@@ -308,28 +378,27 @@ func (d *device) writeStatus(v uint32) error {
 	if v == 0 {
 		// reset
 		d.state = deviceState{}
-		return nil
+		return d.detachQueueEvents()
 	}
 
 	if v&statusNeedsReset > 0 || v < d.state.status {
-		panic("bad status")
+		return unix.EINVAL
 	}
 
 	d.state.status = v
 	d.state.version++
 
 	if v&statusFailed > 0 {
-		panic("driver failed")
+		slog.Warn("virtio driver failed", "type", d.info.Type, "irq", d.info.IRQ)
+		return nil
 	}
 
 	if d.isOperatingNormally() {
 		if d.state.driverFeatures&virtio.RequiredFeatures != virtio.RequiredFeatures {
-			panic("missing required feature bits")
+			return unix.EINVAL
 		}
 
-		if err := d.handler.Ready(d.state.driverFeatures); err != nil {
-			panic(err)
-		}
+		return d.handler.Ready(d.state.driverFeatures, d.handlerConfigChanged)
 	}
 
 	return nil
@@ -381,6 +450,10 @@ func (d *device) writeQueueSel(v uint32) error {
 		return unix.EPERM
 	}
 
+	if v >= uint32(len(d.state.queue)) {
+		return unix.EINVAL
+	}
+
 	d.state.queueSel = v
 	return nil
 }
@@ -390,6 +463,10 @@ func (d *device) writeQueueNum(v uint32) error {
 		return unix.EPERM
 	}
 
+	if v == 0 || v > queueNumMax {
+		return unix.EINVAL
+	}
+
 	d.selectedQueue().NumDesc = v
 	return nil
 }
@@ -461,24 +538,86 @@ func (d *device) writeQueueReady(v uint32) error {
 		return unix.EPERM
 	}
 
+	q, err := d.newQueue(d.selectedQueue())
+	if err != nil {
+		return err
+	}
+
 	d.selectedQueue().Ready = 1
 	d.state.version++
 
-	qs := d.selectedQueue()
+	qn := int(d.state.queueSel)
+	qc := make(chan struct{}, 1)
+	d.qC[qn] = qc
+
+	if d.bus.cfg.IOEventFD != nil {
+		qe, err := d.attachQueueEvent(qn, qc)
+		if err != nil {
+			return err
+		}
+
+		d.qE[qn] = qe
+	}
+
+	return d.handler.QueueReady(int(qn), q, qc)
+}
 
-	rngA, err := d.bus.cfg.MemAt(qs.DescAddr, int(16*qs.NumDesc))
+// newQueue creates a packed or split virtqueue, depending on the negotiated
+// features, backed by the guest memory described by qs.
+func (d *device) newQueue(qs *queueState) (virtq.Queue, error) {
+	qcfg := virtq.Config{
+		MemAt:    d.bus.cfg.MemAt,
+		EventIdx: d.state.driverFeatures&virtio.FEventIdx != 0,
+		Notify: func() error {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+
+			d.state.intStatus |= intStatusUsedBuffer
+			if err := d.bus.cfg.Notify(d.info.IRQ); err != nil {
+				return err
+			}
+
+			return nil
+		},
+	}
+
+	if qs.NumDesc == 0 || qs.NumDesc > queueNumMax {
+		return nil, unix.EINVAL
+	}
+
+	rngA, err := d.memAt(qs.DescAddr, int(16*qs.NumDesc), 16)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	drvA, err := d.bus.cfg.MemAt(qs.DriverAddr, 4)
+	if d.state.driverFeatures&virtio.FRingPacked == 0 {
+		drvA, err := d.memAt(qs.DriverAddr, virtq.SplitDriverAreaSize(int(qs.NumDesc)), 2)
+		if err != nil {
+			return nil, err
+		}
+
+		devA, err := d.memAt(qs.DeviceAddr, virtq.SplitDeviceAreaSize(int(qs.NumDesc)), 4)
+		if err != nil {
+			return nil, err
+		}
+
+		desc := unsafe.Slice((*virtq.SplitDesc)(unsafe.Pointer(&rngA[0])), qs.NumDesc)
+		q, err := virtq.NewSplit(desc, drvA, devA, qcfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return q, nil
+	}
+
+	drvA, err := d.memAt(qs.DriverAddr, 4, 4)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	devA, err := d.bus.cfg.MemAt(qs.DeviceAddr, 4)
+	devA, err := d.memAt(qs.DeviceAddr, 4, 4)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var (
@@ -487,26 +626,81 @@ func (d *device) writeQueueReady(v uint32) error {
 		devE = (*virtq.EventSuppress)(unsafe.Pointer(&devA[0]))
 	)
 
-	q := virtq.New(ring, drvE, devE, virtq.Config{
-		MemAt: d.bus.cfg.MemAt,
-		Notify: func() error {
-			d.mu.Lock()
-			defer d.mu.Unlock()
+	return virtq.NewPacked(ring, drvE, devE, qcfg), nil
+}
 
-			d.state.intStatus |= intStatusUsedBuffer
-			if err := d.bus.cfg.Notify(d.info.IRQ); err != nil {
-				return err
+// memAt returns size bytes of guest memory at addr. It returns EINVAL if addr
+// isn't a multiple of align, and EFAULT if the MemAt callback returns a short slice.
+func (d *device) memAt(addr uint64, size, align int) ([]byte, error) {
+	if addr%uint64(align) != 0 {
+		return nil, unix.EINVAL
+	}
+
+	p, err := d.bus.cfg.MemAt(addr, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p) != size {
+		return nil, unix.EFAULT
+	}
+
+	return p, nil
+}
+
+// attachQueueEvent creates an eventfd that is signaled when the driver writes qn
+// to the QueueNotify register. It starts a goroutine that forwards each signal to
+// the given channel.
+func (d *device) attachQueueEvent(qn int, c chan<- struct{}) (*queueEvent, error) {
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("create queue %d eventfd: %w", qn, err)
+	}
+
+	if err := d.bus.cfg.IOEventFD(d.info.Addr+regQueueNotify, uint32(qn), fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("attach queue %d eventfd: %w", qn, err)
+	}
+
+	qe := &queueEvent{
+		fd:    fd,
+		f:     os.NewFile(uintptr(fd), fmt.Sprintf("%v-queue-%d", d.info.Type, qn)),
+		doneC: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(qe.doneC)
+		buf := make([]byte, 8)
+		for {
+			// the read fails when the file is closed
+			if _, err := qe.f.Read(buf); err != nil {
+				return
 			}
 
-			return nil
-		},
-	})
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}()
 
-	qn := int(d.state.queueSel)
-	qc := make(chan struct{}, 1)
-	d.qC[qn] = qc
+	return qe, nil
+}
 
-	return d.handler.QueueReady(int(qn), q, qc)
+// detachQueueEvents detaches and closes all queue eventfds,
+// waiting for their goroutines to stop.
+func (d *device) detachQueueEvents() error {
+	for qn, qe := range d.qE {
+		if err := d.bus.cfg.IOEventFD(d.info.Addr+regQueueNotify, uint32(qn), qe.fd, false); err != nil {
+			return fmt.Errorf("detach queue %d eventfd: %w", qn, err)
+		}
+
+		qe.f.Close()
+		<-qe.doneC
+		delete(d.qE, qn)
+	}
+
+	return nil
 }
 
 func (d *device) writeQueueNotify(v uint32) error {
@@ -514,7 +708,7 @@ func (d *device) writeQueueNotify(v uint32) error {
 		return unix.EPERM
 	}
 
-	if d.state.queue[v].Ready != 1 {
+	if v >= uint32(len(d.state.queue)) || d.state.queue[v].Ready != 1 {
 		return unix.EPERM
 	}
 
@@ -540,7 +734,7 @@ func (d *device) writeInterruptAck(v uint32) error {
 }
 
 func (d *device) getFeatures() uint64 {
-	return virtio.RequiredFeatures | d.handler.GetFeatures()
+	return virtio.RequiredFeatures | virtio.OptionalFeatures | d.handler.GetFeatures()
 }
 
 func (d *device) isNegotiatingFeatures() bool {
@@ -0,0 +1,318 @@
+package mmio_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/c35s/hype/virtio"
+	"github.com/c35s/hype/virtio/mmio"
+	"github.com/c35s/hype/virtio/virtq"
+)
+
+// fuzzHandler records its queues so the fuzzer can drain them.
+type fuzzHandler struct {
+	queues map[int]virtq.Queue
+}
+
+func (h *fuzzHandler) NewHandler() (virtio.DeviceHandler, error) { return h, nil }
+func (h *fuzzHandler) GetType() virtio.DeviceID                  { return virtio.ConsoleDeviceID }
+func (h *fuzzHandler) GetFeatures() uint64                       { return 0 }
+func (h *fuzzHandler) Ready(uint64, func()) error                { return nil }
+func (h *fuzzHandler) ReadConfig(p []byte, off int) error        { return nil }
+func (h *fuzzHandler) Close() error                              { return nil }
+
+func (h *fuzzHandler) QueueReady(num int, q virtq.Queue, notify <-chan struct{}) error {
+	h.queues[num] = q
+	return nil
+}
+
+// mmioOp encodes a register access for the fuzzer: a flags byte (bit 0 is set
+// for writes, bits 1-2 select a 1, 2, 4, or 8 byte access), a 2-byte offset,
+// and a 4-byte value.
+func mmioOp(write bool, off uint16, v uint32) []byte {
+	op := make([]byte, 7)
+	if write {
+		op[0] = 1 | 2<<1
+	} else {
+		op[0] = 2 << 1
+	}
+
+	binary.LittleEndian.PutUint16(op[1:], off)
+	binary.LittleEndian.PutUint32(op[3:], v)
+	return op
+}
+
+func FuzzBus(f *testing.F) {
+	var (
+		rf  uint64 = virtio.RequiredFeatures | virtio.FEventIdx
+		ops []byte
+	)
+
+	// a split queue handshake followed by a notification
+	for _, op := range []struct {
+		off uint16
+		v   uint32
+	}{
+		{0x070, 1},                // status: acknowledge
+		{0x070, 3},                // status: driver
+		{0x024, 1},                // driver features sel
+		{0x020, uint32(rf >> 32)}, // driver features
+		{0x024, 0},                // driver features sel
+		{0x020, uint32(rf)},       // driver features
+		{0x070, 11},               // status: features ok
+		{0x030, 0},                // queue sel
+		{0x038, 4},                // queue num
+		{0x080, 0x1000},           // queue desc low
+		{0x090, 0x2000},           // queue driver low
+		{0x0a0, 0x3000},           // queue device low
+		{0x044, 1},                // queue ready
+		{0x070, 15},               // status: driver ok
+		{0x050, 0},                // queue notify
+	} {
+		ops = append(ops, mmioOp(true, op.off, op.v)...)
+	}
+
+	ops = append(ops, mmioOp(false, 0x060, 0)...)
+
+	mem := make([]byte, 0x4000)
+	binary.LittleEndian.PutUint64(mem[0x1000:], 0x3800)
+	binary.LittleEndian.PutUint32(mem[0x1008:], 16)
+	binary.LittleEndian.PutUint16(mem[0x100c:], virtq.DescFWrite)
+	binary.LittleEndian.PutUint16(mem[0x2002:], 1)
+
+	f.Add(ops, mem)
+	f.Add(mmioOp(true, 0x030, 0xffffffff), []byte{})
+
+	f.Fuzz(func(t *testing.T, ops, mem []byte) {
+		if len(mem) > 1<<16 {
+			mem = mem[:1<<16]
+		}
+
+		// copy into a fresh allocation so the queues' atomic accesses are aligned
+		mem = append(make([]byte, 0, len(mem)), mem...)
+
+		h := &fuzzHandler{queues: make(map[int]virtq.Queue)}
+		bus, err := mmio.NewBus([]virtio.DeviceConfig{h}, mmio.Config{
+			MemAt: func(addr uint64, size int) ([]byte, error) {
+				if size < 0 || addr > uint64(len(mem)) || uint64(size) > uint64(len(mem))-addr {
+					return nil, errors.New("out of range")
+				}
+
+				return mem[addr : addr+uint64(size)], nil
+			},
+
+			Notify: func(irq int) error { return nil },
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		base := bus.Devices()[0].Addr
+		for ; len(ops) >= 7; ops = ops[7:] {
+			data := make([]byte, 1<<(ops[0]>>1&3))
+			copy(data, ops[3:7])
+
+			addr := base + uint64(binary.LittleEndian.Uint16(ops[1:]))%0x1000
+			bus.HandleMMIO(addr, data, ops[0]&1 != 0)
+
+			for _, q := range h.queues {
+				q.DisableNotify()
+				for i := 0; i < 64; i++ {
+					c, err := q.Next()
+					if err != nil || c == nil {
+						break
+					}
+
+					for j := range c.Desc {
+						c.Buf(j)
+					}
+
+					c.Use(0)
+				}
+
+				q.Flush()
+				q.EnableNotify()
+			}
+		}
+
+		if err := bus.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// configHandler is a handler with a writable config space.
+type configHandler struct {
+	fuzzHandler
+	cfg     [8]byte
+	changed bool
+
+	configChanged func()
+}
+
+func (h *configHandler) NewHandler() (virtio.DeviceHandler, error) { return h, nil }
+
+func (h *configHandler) Ready(negotiatedFeatures uint64, configChanged func()) error {
+	h.configChanged = configChanged
+	return nil
+}
+
+func (h *configHandler) ReadConfig(p []byte, off int) error {
+	if off < len(h.cfg) {
+		copy(p, h.cfg[off:])
+	}
+
+	return nil
+}
+
+func (h *configHandler) WriteConfig(p []byte, off int) (bool, error) {
+	if off+len(p) > len(h.cfg) {
+		return false, errors.New("out of range")
+	}
+
+	copy(h.cfg[off:], p)
+	return h.changed, nil
+}
+
+// startDevice negotiates the required features and sets DRIVER_OK.
+func startDevice(t *testing.T, bus *mmio.Bus) {
+	t.Helper()
+
+	var rf uint64 = virtio.RequiredFeatures
+	for _, op := range []struct {
+		off uint16
+		v   uint32
+	}{
+		{0x070, 1},                // status: acknowledge
+		{0x070, 3},                // status: driver
+		{0x024, 1},                // driver features sel
+		{0x020, uint32(rf >> 32)}, // driver features
+		{0x070, 11},               // status: features ok
+		{0x070, 15},               // status: driver ok
+	} {
+		if err := writeReg(bus, op.off, op.v); err != nil {
+			t.Fatalf("write %#x: %v", op.off, err)
+		}
+	}
+}
+
+func writeReg(bus *mmio.Bus, off uint16, v uint32) error {
+	_, err := bus.HandleMMIO(bus.Devices()[0].Addr+uint64(off), binary.LittleEndian.AppendUint32(nil, v), true)
+	return err
+}
+
+func readReg(t *testing.T, bus *mmio.Bus, off uint16) uint32 {
+	t.Helper()
+
+	p := make([]byte, 4)
+	if _, err := bus.HandleMMIO(bus.Devices()[0].Addr+uint64(off), p, false); err != nil {
+		t.Fatalf("read %#x: %v", off, err)
+	}
+
+	return binary.LittleEndian.Uint32(p)
+}
+
+func TestWriteConfig(t *testing.T) {
+	for _, changed := range []bool{false, true} {
+		h := &configHandler{changed: changed}
+
+		notified := 0
+		bus, err := mmio.NewBus([]virtio.DeviceConfig{h}, mmio.Config{
+			Notify: func(irq int) error { notified++; return nil },
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		startDevice(t, bus)
+		gen := readReg(t, bus, 0x0fc)
+
+		if err := writeReg(bus, 0x104, 0xc35); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := readReg(t, bus, 0x104); v != 0xc35 {
+			t.Errorf("changed=%v: config %#x != 0xc35", changed, v)
+		}
+
+		if g := readReg(t, bus, 0x0fc); g == gen {
+			t.Errorf("changed=%v: config generation not bumped", changed)
+		}
+
+		isr := readReg(t, bus, 0x060)
+		if changed && (isr&2 == 0 || notified != 1) {
+			t.Errorf("changed=%v: isr=%#x notified=%d", changed, isr, notified)
+		}
+
+		if !changed && (isr != 0 || notified != 0) {
+			t.Errorf("changed=%v: isr=%#x notified=%d", changed, isr, notified)
+		}
+	}
+
+	t.Run("read only", func(t *testing.T) {
+		h := &fuzzHandler{queues: make(map[int]virtq.Queue)}
+		bus, err := mmio.NewBus([]virtio.DeviceConfig{h}, mmio.Config{
+			Notify: func(irq int) error { return nil },
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		startDevice(t, bus)
+
+		if err := writeReg(bus, 0x100, 1); err == nil {
+			t.Error("no error writing a read-only config")
+		}
+
+		if status := readReg(t, bus, 0x070); status&64 == 0 {
+			t.Errorf("status %#x doesn't need reset", status)
+		}
+	})
+}
+
+func TestConfigChanged(t *testing.T) {
+	h := new(configHandler)
+
+	notified := 0
+	bus, err := mmio.NewBus([]virtio.DeviceConfig{h}, mmio.Config{
+		Notify: func(irq int) error { notified++; return nil },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startDevice(t, bus)
+	gen := readReg(t, bus, 0x0fc)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.configChanged()
+	}()
+
+	<-done
+
+	if g := readReg(t, bus, 0x0fc); g == gen {
+		t.Error("config generation not bumped")
+	}
+
+	if isr := readReg(t, bus, 0x060); isr&2 == 0 || notified != 1 {
+		t.Errorf("isr=%#x notified=%d", isr, notified)
+	}
+
+	// after a reset, the callback only bumps the generation
+	if err := writeReg(bus, 0x070, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	h.configChanged()
+
+	if isr := readReg(t, bus, 0x060); isr != 0 || notified != 1 {
+		t.Errorf("after reset: isr=%#x notified=%d", isr, notified)
+	}
+}
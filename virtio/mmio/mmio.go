@@ -46,3 +46,7 @@ const (
 	regConfigGeneration  = 0x0fc // configuration atomicity value (R)
 	regDeviceConfigStart = 0x100 // device specific configuration space >= 0x100 (RW)
 )
+
+// maximum virtqueue size, reported by regQueueNumMax
+
+const queueNumMax = 1 << 15
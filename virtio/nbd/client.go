@@ -0,0 +1,578 @@
+package nbd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Client is block storage backed by an NBD export. It pipelines concurrent
+// requests over one connection.
+type Client struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	size       int64
+	flags      uint16
+	structured bool
+	maxPayload int
+
+	wmu sync.Mutex // serializes requests
+
+	mu      sync.Mutex
+	cookie  uint64
+	pending map[uint64]*call
+	err     error // set when the connection fails
+	doneC   chan struct{}
+}
+
+// call is a request waiting for its reply.
+type call struct {
+	off  uint64
+	buf  []byte // read destination
+	err  error  // the first error chunk of a structured reply
+	done chan error
+}
+
+// errClosed is returned by requests after the client is closed.
+var errClosed = errors.New("nbd: client closed")
+
+// Dial connects to the NBD server at addr on network, which is usually "tcp" or
+// "unix", and negotiates the named export.
+func Dial(network, addr, export string) (*Client, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewClient(conn, export)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewClient negotiates the named export over conn. The client owns conn
+// after NewClient returns successfully.
+func NewClient(conn net.Conn, export string) (*Client, error) {
+	if len(export) > maxExportName {
+		return nil, fmt.Errorf("nbd: export name is longer than %d bytes", maxExportName)
+	}
+
+	c := &Client{
+		conn:       conn,
+		r:          bufio.NewReader(conn),
+		maxPayload: maxPayload,
+		pending:    make(map[uint64]*call),
+		doneC:      make(chan struct{}),
+	}
+
+	if err := c.negotiate(export); err != nil {
+		return nil, err
+	}
+
+	go c.receive()
+	return c, nil
+}
+
+func (c *Client) negotiate(export string) error {
+	var hello struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}
+
+	if err := readFull(c.r, &hello); err != nil {
+		return fmt.Errorf("nbd: read handshake: %w", err)
+	}
+
+	if hello.Magic != nbdMagic || hello.OptMagic != nbdOptMagic {
+		return errors.New("nbd: server doesn't support newstyle negotiation")
+	}
+
+	if hello.Flags&flagFixedNewstyle == 0 {
+		return errors.New("nbd: server doesn't support fixed newstyle negotiation")
+	}
+
+	clientFlags := uint32(flagFixedNewstyle | hello.Flags&flagNoZeroes)
+	if _, err := c.conn.Write(be.AppendUint32(nil, clientFlags)); err != nil {
+		return err
+	}
+
+	// structured replies are optional
+	err := c.option(optStructuredReply, nil, func(typ uint32, data []byte) error { return nil })
+	if oe := (*optionError)(nil); errors.As(err, &oe) {
+		err = nil
+	} else if err == nil {
+		c.structured = true
+	}
+
+	if err != nil {
+		return err
+	}
+
+	req := be.AppendUint32(nil, uint32(len(export)))
+	req = append(req, export...)
+	req = be.AppendUint16(req, 1)
+	req = be.AppendUint16(req, infoBlockSize)
+
+	var gotExport bool
+	err = c.option(optGo, req, func(typ uint32, data []byte) error {
+		if typ != repInfo || len(data) < 2 {
+			return nil
+		}
+
+		switch be.Uint16(data) {
+		case infoExport:
+			if len(data) != 12 {
+				return fmt.Errorf("nbd: bad export info length %d", len(data))
+			}
+
+			c.size, c.flags, gotExport = int64(be.Uint64(data[2:])), be.Uint16(data[10:]), true
+
+		case infoBlockSize:
+			if len(data) != 14 {
+				return fmt.Errorf("nbd: bad block size info length %d", len(data))
+			}
+
+			c.maxPayload = int(min(be.Uint32(data[10:]), maxPayload))
+		}
+
+		return nil
+	})
+
+	// fall back to NBD_OPT_EXPORT_NAME for old servers
+	if oe := (*optionError)(nil); errors.As(err, &oe) && oe.typ == repErrUnsup {
+		return c.exportName(export, hello.Flags&flagNoZeroes != 0)
+	}
+
+	if err == nil && !gotExport {
+		err = errors.New("nbd: server didn't send export info")
+	}
+
+	if c.size < 0 || c.maxPayload < 512 {
+		err = errors.New("nbd: bad export info")
+	}
+
+	return err
+}
+
+// option sends an option and calls f with each reply until the server acks
+// it. It returns an *optionError if the server replies with an error.
+func (c *Client) option(opt uint32, data []byte, f func(typ uint32, data []byte) error) error {
+	req := be.AppendUint64(nil, nbdOptMagic)
+	req = be.AppendUint32(req, opt)
+	req = be.AppendUint32(req, uint32(len(data)))
+
+	if _, err := c.conn.Write(append(req, data...)); err != nil {
+		return err
+	}
+
+	for {
+		var rep optionReply
+		if err := readFull(c.r, &rep); err != nil {
+			return fmt.Errorf("nbd: read option reply: %w", err)
+		}
+
+		if rep.Magic != nbdOptReplyMagic || rep.Option != opt || rep.Length > maxPayload {
+			return fmt.Errorf("nbd: bad reply to option %d", opt)
+		}
+
+		data := make([]byte, rep.Length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return fmt.Errorf("nbd: read option reply: %w", err)
+		}
+
+		switch {
+		case rep.Type == repAck:
+			return nil
+
+		case rep.Type&(1<<31) != 0:
+			return &optionError{opt: opt, typ: rep.Type, msg: string(data)}
+
+		default:
+			if err := f(rep.Type, data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exportName selects the export with NBD_OPT_EXPORT_NAME, which ends negotiation.
+func (c *Client) exportName(export string, noZeroes bool) error {
+	req := be.AppendUint64(nil, nbdOptMagic)
+	req = be.AppendUint32(req, optExportName)
+	req = be.AppendUint32(req, uint32(len(export)))
+
+	if _, err := c.conn.Write(append(req, export...)); err != nil {
+		return err
+	}
+
+	var info struct {
+		Size  uint64
+		Flags uint16
+	}
+
+	if err := readFull(c.r, &info); err != nil {
+		return fmt.Errorf("nbd: export %q: %w", export, err)
+	}
+
+	if !noZeroes {
+		if _, err := io.ReadFull(c.r, make([]byte, 124)); err != nil {
+			return err
+		}
+	}
+
+	c.size, c.flags = int64(info.Size), info.Flags
+	if c.size < 0 {
+		return errors.New("nbd: bad export size")
+	}
+
+	return nil
+}
+
+// receive reads replies and completes their calls until the connection fails.
+func (c *Client) receive() {
+	defer close(c.doneC)
+
+	err := c.receiveReplies()
+
+	c.mu.Lock()
+	c.err = err
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	for _, cl := range pending {
+		cl.done <- err
+	}
+}
+
+func (c *Client) receiveReplies() error {
+	for {
+		var magic uint32
+		if err := readFull(c.r, &magic); err != nil {
+			return err
+		}
+
+		var err error
+		switch magic {
+		case simpleReplyMagic:
+			err = c.receiveSimple()
+
+		case structuredReplyMagic:
+			err = c.receiveStructured()
+
+		default:
+			err = fmt.Errorf("nbd: bad reply magic %#x", magic)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) receiveSimple() error {
+	var rep struct {
+		Error  uint32
+		Cookie uint64
+	}
+
+	if err := readFull(c.r, &rep); err != nil {
+		return err
+	}
+
+	cl, err := c.take(rep.Cookie, true)
+	if err != nil {
+		return err
+	}
+
+	if rep.Error != 0 {
+		cl.done <- replyError(rep.Error)
+		return nil
+	}
+
+	if _, err := io.ReadFull(c.r, cl.buf); err != nil {
+		return err
+	}
+
+	cl.done <- nil
+	return nil
+}
+
+func (c *Client) receiveStructured() error {
+	var rep struct {
+		Flags  uint16
+		Type   uint16
+		Cookie uint64
+		Length uint32
+	}
+
+	if err := readFull(c.r, &rep); err != nil {
+		return err
+	}
+
+	if rep.Length > uint32(c.maxPayload)+8 {
+		return fmt.Errorf("nbd: reply chunk is too long (%d bytes)", rep.Length)
+	}
+
+	done := rep.Flags&replyFlagDone != 0
+	cl, err := c.take(rep.Cookie, done)
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, rep.Length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch rep.Type {
+	case replyTypeNone:
+
+	case replyTypeOffsetData, replyTypeOffsetHole:
+		if len(payload) < 8 || be.Uint64(payload) < cl.off {
+			return errors.New("nbd: bad reply chunk offset")
+		}
+
+		start := be.Uint64(payload) - cl.off
+
+		var n uint64
+		if rep.Type == replyTypeOffsetData {
+			n = uint64(len(payload) - 8)
+		} else if len(payload) == 12 {
+			n = uint64(be.Uint32(payload[8:]))
+		} else {
+			return errors.New("nbd: bad hole chunk")
+		}
+
+		if start > uint64(len(cl.buf)) || n > uint64(len(cl.buf))-start {
+			return errors.New("nbd: reply chunk is outside the request")
+		}
+
+		if rep.Type == replyTypeOffsetData {
+			copy(cl.buf[start:], payload[8:])
+		} else {
+			clear(cl.buf[start : start+n])
+		}
+
+	case replyTypeError, replyTypeErrorOff:
+		if len(payload) < 6 {
+			return errors.New("nbd: bad error chunk")
+		}
+
+		if cl.err == nil {
+			cl.err = replyError(be.Uint32(payload))
+		}
+
+	default:
+		// unknown error types carry an error code, and everything else may be ignored
+		if rep.Type&(1<<15) != 0 && cl.err == nil {
+			cl.err = unix.EIO
+		}
+	}
+
+	if done {
+		cl.done <- cl.err
+	}
+
+	return nil
+}
+
+// take returns the call with cookie, removing it from the pending calls if done.
+func (c *Client) take(cookie uint64, done bool) (*call, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.pending[cookie]
+	if !ok {
+		return nil, fmt.Errorf("nbd: reply to unknown cookie %d", cookie)
+	}
+
+	if done {
+		delete(c.pending, cookie)
+	}
+
+	return cl, nil
+}
+
+func replyError(code uint32) error {
+	return fmt.Errorf("nbd: %w", unix.Errno(code))
+}
+
+// do sends a request and waits for its reply. Reads are copied into buf.
+func (c *Client) do(typ, flags uint16, off uint64, length uint32, data, buf []byte) error {
+	cl := &call{off: off, buf: buf, done: make(chan error, 1)}
+
+	c.mu.Lock()
+	if c.pending == nil {
+		err := c.err
+		c.mu.Unlock()
+		return fmt.Errorf("nbd: connection failed: %w", err)
+	}
+
+	c.cookie++
+	cookie := c.cookie
+	c.pending[cookie] = cl
+	c.mu.Unlock()
+
+	req := be.AppendUint32(nil, requestMagic)
+	req = be.AppendUint16(req, flags)
+	req = be.AppendUint16(req, typ)
+	req = be.AppendUint64(req, cookie)
+	req = be.AppendUint64(req, off)
+	req = be.AppendUint32(req, length)
+
+	c.wmu.Lock()
+	bufs := net.Buffers{req, data}
+	_, err := bufs.WriteTo(c.conn)
+	c.wmu.Unlock()
+
+	if err != nil {
+		// fail the connection so the reader completes the call
+		c.conn.Close()
+	}
+
+	return <-cl.done
+}
+
+// ReadAt reads from the export at off.
+func (c *Client) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, unix.EINVAL
+	}
+
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > c.size-off {
+		p, err = p[:c.size-off], io.EOF
+	}
+
+	for n < len(p) {
+		k := min(len(p)-n, c.maxPayload)
+		if rerr := c.do(cmdRead, 0, uint64(off)+uint64(n), uint32(k), nil, p[n:n+k]); rerr != nil {
+			return n, rerr
+		}
+
+		n += k
+	}
+
+	return n, err
+}
+
+// WriteAt writes to the export at off.
+func (c *Client) WriteAt(p []byte, off int64) (n int, err error) {
+	if c.ReadOnly() {
+		return 0, fmt.Errorf("nbd: %w", unix.EPERM)
+	}
+
+	for n < len(p) {
+		k := min(len(p)-n, c.maxPayload)
+		if err := c.do(cmdWrite, 0, uint64(off)+uint64(n), uint32(k), p[n:n+k], nil); err != nil {
+			return n, err
+		}
+
+		n += k
+	}
+
+	return n, nil
+}
+
+// Size returns the size of the export in bytes.
+func (c *Client) Size() (int64, error) {
+	return c.size, nil
+}
+
+// ReadOnly returns true if the server doesn't allow writes to the export.
+func (c *Client) ReadOnly() bool {
+	return c.flags&flagReadOnly != 0
+}
+
+// Sync flushes the server's write cache, if it has one.
+func (c *Client) Sync() error {
+	if c.flags&flagSendFlush == 0 {
+		return nil
+	}
+
+	return c.do(cmdFlush, 0, 0, 0, nil, nil)
+}
+
+// Discard trims n bytes of the export at off, if the server supports it.
+func (c *Client) Discard(off, n int64) error {
+	if c.flags&flagSendTrim == 0 {
+		return nil
+	}
+
+	return c.split(cmdTrim, off, n)
+}
+
+// WriteZeroesAt zeroes n bytes of the export at off. If the server doesn't
+// support the write zeroes command, WriteZeroesAt writes zeroes instead.
+func (c *Client) WriteZeroesAt(off, n int64) error {
+	if c.flags&flagSendWriteZeroes != 0 {
+		return c.split(cmdWriteZeroes, off, n)
+	}
+
+	zero := make([]byte, min(n, int64(c.maxPayload)))
+	for n > 0 {
+		k, err := c.WriteAt(zero[:min(n, int64(len(zero)))], off)
+		if err != nil {
+			return err
+		}
+
+		off += int64(k)
+		n -= int64(k)
+	}
+
+	return nil
+}
+
+// split sends a command without a payload for each 1 GiB of n bytes at off.
+func (c *Client) split(typ uint16, off, n int64) error {
+	if c.ReadOnly() {
+		return fmt.Errorf("nbd: %w", unix.EPERM)
+	}
+
+	for n > 0 {
+		k := min(n, 1<<30)
+		if err := c.do(typ, 0, uint64(off), uint32(k), nil, nil); err != nil {
+			return err
+		}
+
+		off += k
+		n -= k
+	}
+
+	return nil
+}
+
+// Close disconnects from the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	open := c.pending != nil
+	c.mu.Unlock()
+
+	if open {
+		req := be.AppendUint32(nil, requestMagic)
+		req = be.AppendUint16(req, 0)
+		req = be.AppendUint16(req, cmdDisc)
+		req = append(req, make([]byte, 8+8+4)...)
+
+		c.wmu.Lock()
+		c.conn.Write(req)
+		c.wmu.Unlock()
+	}
+
+	err := c.conn.Close()
+	<-c.doneC
+	return err
+}
@@ -0,0 +1,159 @@
+// Package nbd implements a client and server for the network block device
+// protocol. The client is block storage for virtio block devices, and the
+// server serves any block storage. Both use fixed newstyle negotiation and
+// structured replies.
+//
+// See https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md.
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// handshake magic numbers and flags
+
+const (
+	nbdMagic         = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptMagic      = 0x49484156454f5054 // "IHAVEOPT"
+	nbdOptReplyMagic = 0x0003e889045565a9
+
+	flagFixedNewstyle = 1 << 0 // server and client: fixed newstyle negotiation
+	flagNoZeroes      = 1 << 1 // server and client: no zero padding after NBD_OPT_EXPORT_NAME
+)
+
+// options
+
+const (
+	optExportName      = 1
+	optAbort           = 2
+	optList            = 3
+	optInfo            = 6
+	optGo              = 7
+	optStructuredReply = 8
+)
+
+// option replies
+
+const (
+	repAck    = 1
+	repServer = 2
+	repInfo   = 3
+
+	repErrUnsup   = 1<<31 | 1
+	repErrPolicy  = 1<<31 | 2
+	repErrInvalid = 1<<31 | 3
+	repErrUnknown = 1<<31 | 6
+)
+
+// info types
+
+const (
+	infoExport    = 0
+	infoBlockSize = 3
+)
+
+// transmission flags
+
+const (
+	flagHasFlags        = 1 << 0
+	flagReadOnly        = 1 << 1
+	flagSendFlush       = 1 << 2
+	flagSendFUA         = 1 << 3
+	flagSendTrim        = 1 << 5
+	flagSendWriteZeroes = 1 << 6
+)
+
+// commands and command flags
+
+const (
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+
+	cmdFlagFUA = 1 << 0
+)
+
+// request and reply magic numbers
+
+const (
+	requestMagic         = 0x25609513
+	simpleReplyMagic     = 0x67446698
+	structuredReplyMagic = 0x668e33ef
+)
+
+// structured reply chunk types and flags
+
+const (
+	replyTypeNone       = 0
+	replyTypeOffsetData = 1
+	replyTypeOffsetHole = 2
+	replyTypeError      = 1<<15 | 1
+	replyTypeErrorOff   = 1<<15 | 2
+
+	replyFlagDone = 1 << 0
+)
+
+const (
+	// maxPayload is the largest read or write request, and the largest option.
+	maxPayload = 32 << 20
+
+	// maxExportName is the longest export name.
+	maxExportName = 4096
+)
+
+var be = binary.BigEndian
+
+// request is the header of a transmission request.
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Cookie uint64
+	Offset uint64
+	Length uint32
+}
+
+// optionReply is the header of an option reply.
+type optionReply struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+// errno returns the NBD error code for err. NBD error codes are Linux errnos.
+func errno(err error) uint32 {
+	var e unix.Errno
+	if errors.As(err, &e) {
+		switch e {
+		case unix.EPERM, unix.EIO, unix.ENOMEM, unix.EINVAL, unix.ENOSPC, unix.EOVERFLOW, unix.ENOTSUP, unix.ESHUTDOWN:
+			return uint32(e)
+		}
+	}
+
+	return uint32(unix.EIO)
+}
+
+// readFull reads a fixed-size value from r.
+func readFull(r io.Reader, v any) error {
+	return binary.Read(r, be, v)
+}
+
+// optionError is an error reply to an option.
+type optionError struct {
+	opt uint32
+	typ uint32
+	msg string
+}
+
+func (e *optionError) Error() string {
+	return fmt.Sprintf("nbd option %d failed: error %#x: %s", e.opt, e.typ, e.msg)
+}
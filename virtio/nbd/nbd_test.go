@@ -0,0 +1,198 @@
+package nbd_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/c35s/hype/virtio"
+	"github.com/c35s/hype/virtio/nbd"
+	"golang.org/x/sys/unix"
+)
+
+// the client supports the block device's optional storage interfaces
+var _ interface {
+	io.WriterAt
+	virtio.Syncer
+	virtio.Discarder
+	virtio.ZeroWriter
+} = (*nbd.Client)(nil)
+
+// serve starts a server for exports on network and returns its address.
+func serve(t *testing.T, network string, exports map[string]nbd.Export) string {
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(t.TempDir(), "nbd.sock")
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	srv := &nbd.Server{Exports: exports}
+	go srv.Serve(l)
+
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, network, addr, export string) *nbd.Client {
+	c, err := nbd.Dial(network, addr, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientServer(t *testing.T) {
+	for _, network := range []string{"unix", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			ms := &virtio.MemStorage{Bytes: make([]byte, 1<<20)}
+			rand.New(rand.NewSource(1)).Read(ms.Bytes)
+
+			addr := serve(t, network, map[string]nbd.Export{"disk": {Storage: ms}})
+			c := dial(t, network, addr, "disk")
+
+			if sz, err := c.Size(); err != nil || sz != 1<<20 {
+				t.Fatalf("size %d, %v", sz, err)
+			}
+
+			if c.ReadOnly() {
+				t.Error("writable export is read-only")
+			}
+
+			p := make([]byte, 8192)
+			if _, err := c.ReadAt(p, 4096); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(p, ms.Bytes[4096:4096+8192]) {
+				t.Error("read doesn't match")
+			}
+
+			want := bytes.Repeat([]byte{0xab}, 3000)
+			if _, err := c.WriteAt(want, 100); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]byte, len(want))
+			if _, err := c.ReadAt(got, 100); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Error("write doesn't match")
+			}
+
+			if err := c.Discard(0, 4096); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.WriteZeroesAt(65536, 65536); err != nil {
+				t.Fatal(err)
+			}
+
+			got = make([]byte, 131072)
+			if _, err := c.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got[:4096], make([]byte, 4096)) || !bytes.Equal(got[65536:], make([]byte, 65536)) {
+				t.Error("discarded or zeroed bytes aren't zero")
+			}
+
+			// out of range requests
+			if n, err := c.ReadAt(p, 1<<20-100); n != 100 || err != io.EOF {
+				t.Errorf("read past end: n=%d err=%v", n, err)
+			}
+
+			if _, err := c.WriteAt(p, 1<<20-100); !errors.Is(err, unix.ENOSPC) {
+				t.Errorf("write past end: %v", err)
+			}
+
+			// the connection still works after errors
+			if _, err := c.ReadAt(p[:10], 0); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	ms := &virtio.MemStorage{Bytes: make([]byte, 1<<20)}
+	addr := serve(t, "unix", map[string]nbd.Export{"": {Storage: ms}})
+	c := dial(t, "unix", addr, "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		i := i
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			want := bytes.Repeat([]byte{byte(i)}, 32768)
+			off := int64(i) * 32768
+
+			if _, err := c.WriteAt(want, off); err != nil {
+				t.Error(err)
+				return
+			}
+
+			got := make([]byte, len(want))
+			if _, err := c.ReadAt(got, off); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("request %d: read doesn't match", i)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestClientReadOnly(t *testing.T) {
+	ms := &virtio.MemStorage{Bytes: make([]byte, 65536)}
+	addr := serve(t, "tcp", map[string]nbd.Export{
+		"ro":      {Storage: ms, ReadOnly: true},
+		"nowrite": {Storage: struct{ virtio.BlockStorage }{ms}}, // hides WriteAt
+	})
+
+	c := dial(t, "tcp", addr, "ro")
+	if !c.ReadOnly() {
+		t.Fatal("read-only export is writable")
+	}
+
+	if _, err := c.WriteAt(make([]byte, 512), 0); !errors.Is(err, unix.EPERM) {
+		t.Errorf("write to read-only export: %v", err)
+	}
+
+	if _, err := c.ReadAt(make([]byte, 512), 0); err != nil {
+		t.Error(err)
+	}
+
+	c = dial(t, "tcp", addr, "nowrite")
+	if !c.ReadOnly() {
+		t.Error("export without io.WriterAt is writable")
+	}
+
+	if _, err := nbd.Dial("tcp", addr, "missing"); err == nil {
+		t.Error("no error for an unknown export")
+	}
+}
@@ -0,0 +1,477 @@
+package nbd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/c35s/hype/virtio"
+	"golang.org/x/sys/unix"
+)
+
+// Export is block storage served by a Server.
+type Export struct {
+	Storage virtio.BlockStorage
+
+	// ReadOnly prevents clients from writing to the storage. Storage that
+	// doesn't implement io.WriterAt is always read-only.
+	ReadOnly bool
+
+	// Description is sent to clients that list the server's exports.
+	Description string
+}
+
+// Server serves block storage over NBD. Clients that don't name an export
+// get the one named "".
+type Server struct {
+	Exports map[string]Export
+}
+
+// session is a negotiated connection.
+type session struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	exp        Export
+	w          io.WriterAt
+	size       int64
+	structured bool
+
+	wmu sync.Mutex // serializes replies
+	wg  sync.WaitGroup
+	sem chan struct{}
+}
+
+// maxInFlight is the number of requests handled concurrently per connection.
+const maxInFlight = 64
+
+// Serve accepts connections from l and serves each one in a new goroutine.
+// It returns when l.Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				slog.Warn("nbd serve", "remote", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+// ServeConn negotiates an export with the client on conn, then serves its
+// requests until it disconnects. It closes conn.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	ss := &session{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		sem:  make(chan struct{}, maxInFlight),
+	}
+
+	ok, err := s.negotiate(ss)
+	if err != nil || !ok {
+		return err
+	}
+
+	return ss.transmit()
+}
+
+// negotiate runs the handshake and option haggling. It returns false if the
+// client aborted.
+func (s *Server) negotiate(ss *session) (bool, error) {
+	hello := be.AppendUint64(nil, nbdMagic)
+	hello = be.AppendUint64(hello, nbdOptMagic)
+	hello = be.AppendUint16(hello, flagFixedNewstyle|flagNoZeroes)
+
+	if _, err := ss.conn.Write(hello); err != nil {
+		return false, err
+	}
+
+	var clientFlags uint32
+	if err := readFull(ss.r, &clientFlags); err != nil {
+		return false, err
+	}
+
+	if clientFlags&^(flagFixedNewstyle|flagNoZeroes) != 0 {
+		return false, fmt.Errorf("nbd: unknown client flags %#x", clientFlags)
+	}
+
+	for {
+		var opt struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+
+		// clients may hang up instead of aborting
+		if err := readFull(ss.r, &opt); err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		if opt.Magic != nbdOptMagic {
+			return false, fmt.Errorf("nbd: bad option magic %#x", opt.Magic)
+		}
+
+		if opt.Length > maxPayload {
+			return false, fmt.Errorf("nbd: option %d is too long (%d bytes)", opt.Option, opt.Length)
+		}
+
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(ss.r, data); err != nil {
+			return false, err
+		}
+
+		switch opt.Option {
+		case optExportName:
+			exp, ok := s.Exports[string(data)]
+			if !ok {
+				return false, fmt.Errorf("nbd: unknown export %q", data)
+			}
+
+			if err := ss.start(exp); err != nil {
+				return false, err
+			}
+
+			reply := be.AppendUint64(nil, uint64(ss.size))
+			reply = be.AppendUint16(reply, ss.flags())
+			if clientFlags&flagNoZeroes == 0 {
+				reply = append(reply, make([]byte, 124)...)
+			}
+
+			_, err := ss.conn.Write(reply)
+			return err == nil, err
+
+		case optAbort:
+			return false, ss.optReply(opt.Option, repAck, nil)
+
+		case optList:
+			if len(data) != 0 {
+				if err := ss.optReply(opt.Option, repErrInvalid, nil); err != nil {
+					return false, err
+				}
+
+				continue
+			}
+
+			for name, exp := range s.Exports {
+				server := be.AppendUint32(nil, uint32(len(name)))
+				server = append(server, name...)
+				server = append(server, exp.Description...)
+
+				if err := ss.optReply(opt.Option, repServer, server); err != nil {
+					return false, err
+				}
+			}
+
+			if err := ss.optReply(opt.Option, repAck, nil); err != nil {
+				return false, err
+			}
+
+		case optStructuredReply:
+			typ := uint32(repAck)
+			if len(data) != 0 {
+				typ = repErrInvalid
+			} else {
+				ss.structured = true
+			}
+
+			if err := ss.optReply(opt.Option, typ, nil); err != nil {
+				return false, err
+			}
+
+		case optInfo, optGo:
+			done, err := s.info(ss, opt.Option, data)
+			if err != nil || done {
+				return done, err
+			}
+
+		default:
+			if err := ss.optReply(opt.Option, repErrUnsup, nil); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// info handles NBD_OPT_INFO and NBD_OPT_GO. It returns true if the client
+// chose an export.
+func (s *Server) info(ss *session, opt uint32, data []byte) (bool, error) {
+	if len(data) < 4 || be.Uint32(data) > maxExportName || len(data) < 4+int(be.Uint32(data))+2 {
+		return false, ss.optReply(opt, repErrInvalid, nil)
+	}
+
+	n := be.Uint32(data)
+	name := string(data[4 : 4+n])
+	if nreq := int(be.Uint16(data[4+n:])); len(data) != 4+int(n)+2+2*nreq {
+		return false, ss.optReply(opt, repErrInvalid, nil)
+	}
+
+	exp, ok := s.Exports[name]
+	if !ok {
+		return false, ss.optReply(opt, repErrUnknown, []byte("unknown export"))
+	}
+
+	if err := ss.start(exp); err != nil {
+		return false, ss.optReply(opt, repErrPolicy, []byte(err.Error()))
+	}
+
+	info := be.AppendUint16(nil, infoExport)
+	info = be.AppendUint64(info, uint64(ss.size))
+	info = be.AppendUint16(info, ss.flags())
+	if err := ss.optReply(opt, repInfo, info); err != nil {
+		return false, err
+	}
+
+	// any request size is fine, but 4K is preferred
+	info = be.AppendUint16(nil, infoBlockSize)
+	info = be.AppendUint32(info, 1)
+	info = be.AppendUint32(info, 4096)
+	info = be.AppendUint32(info, maxPayload)
+	if err := ss.optReply(opt, repInfo, info); err != nil {
+		return false, err
+	}
+
+	if err := ss.optReply(opt, repAck, nil); err != nil {
+		return false, err
+	}
+
+	return opt == optGo, nil
+}
+
+// start selects exp for transmission.
+func (ss *session) start(exp Export) error {
+	size, err := exp.Storage.Size()
+	if err != nil {
+		return fmt.Errorf("nbd: export size: %w", err)
+	}
+
+	ss.exp, ss.size, ss.w = exp, size, nil
+	if !exp.ReadOnly {
+		ss.w, _ = exp.Storage.(io.WriterAt)
+	}
+
+	return nil
+}
+
+// flags returns the transmission flags of the session's export.
+func (ss *session) flags() uint16 {
+	if ss.w == nil {
+		return flagHasFlags | flagReadOnly
+	}
+
+	flags := uint16(flagHasFlags | flagSendWriteZeroes)
+	if _, ok := ss.exp.Storage.(virtio.Syncer); ok {
+		flags |= flagSendFlush | flagSendFUA
+	}
+
+	if _, ok := ss.exp.Storage.(virtio.Discarder); ok {
+		flags |= flagSendTrim
+	}
+
+	return flags
+}
+
+func (ss *session) optReply(opt, typ uint32, data []byte) error {
+	reply := be.AppendUint64(nil, nbdOptReplyMagic)
+	reply = be.AppendUint32(reply, opt)
+	reply = be.AppendUint32(reply, typ)
+	reply = be.AppendUint32(reply, uint32(len(data)))
+	_, err := ss.conn.Write(append(reply, data...))
+	return err
+}
+
+// transmit handles requests concurrently until the client disconnects.
+func (ss *session) transmit() error {
+	defer ss.wg.Wait()
+
+	for {
+		var req request
+		if err := readFull(ss.r, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		if req.Magic != requestMagic {
+			return fmt.Errorf("nbd: bad request magic %#x", req.Magic)
+		}
+
+		var data []byte
+		switch req.Type {
+		case cmdDisc:
+			return nil
+
+		case cmdWrite:
+			// the connection can't be resynchronized after a bad write
+			if req.Length > maxPayload {
+				return fmt.Errorf("nbd: write is too long (%d bytes)", req.Length)
+			}
+
+			data = make([]byte, req.Length)
+			if _, err := io.ReadFull(ss.r, data); err != nil {
+				return err
+			}
+		}
+
+		ss.sem <- struct{}{}
+		ss.wg.Add(1)
+		go func() {
+			defer func() {
+				<-ss.sem
+				ss.wg.Done()
+			}()
+
+			if err := ss.handle(req, data); err != nil {
+				slog.Warn("nbd reply", "remote", ss.conn.RemoteAddr(), "err", err)
+				ss.conn.Close()
+			}
+		}()
+	}
+}
+
+// handle executes req and replies to it. It returns an error only if the
+// reply can't be sent.
+func (ss *session) handle(req request, data []byte) error {
+	off, n := int64(req.Offset), int64(req.Length)
+	inRange := off >= 0 && n <= ss.size-off
+
+	switch req.Type {
+	case cmdRead:
+		if !inRange || n > maxPayload {
+			return ss.reply(req, unix.EINVAL, nil)
+		}
+
+		buf := make([]byte, n)
+		k, err := ss.exp.Storage.ReadAt(buf, off)
+		if err == io.EOF && k == len(buf) {
+			err = nil
+		}
+
+		return ss.reply(req, err, buf)
+
+	case cmdWrite, cmdWriteZeroes, cmdTrim:
+		if ss.w == nil {
+			return ss.reply(req, unix.EPERM, nil)
+		}
+
+		if !inRange {
+			return ss.reply(req, unix.ENOSPC, nil)
+		}
+
+		var err error
+		switch req.Type {
+		case cmdWrite:
+			_, err = ss.w.WriteAt(data, off)
+
+		case cmdWriteZeroes:
+			err = ss.writeZeroes(off, n)
+
+		case cmdTrim:
+			if d, ok := ss.exp.Storage.(virtio.Discarder); ok {
+				err = d.Discard(off, n)
+			}
+		}
+
+		if err == nil && req.Flags&cmdFlagFUA != 0 {
+			err = ss.sync()
+		}
+
+		return ss.reply(req, err, nil)
+
+	case cmdFlush:
+		return ss.reply(req, ss.sync(), nil)
+
+	default:
+		return ss.reply(req, unix.EINVAL, nil)
+	}
+}
+
+func (ss *session) sync() error {
+	if s, ok := ss.exp.Storage.(virtio.Syncer); ok && ss.w != nil {
+		return s.Sync()
+	}
+
+	return nil
+}
+
+// writeZeroes zeroes n bytes of the export at off, writing zeroes if the
+// storage doesn't implement virtio.ZeroWriter.
+func (ss *session) writeZeroes(off, n int64) error {
+	if z, ok := ss.exp.Storage.(virtio.ZeroWriter); ok {
+		return z.WriteZeroesAt(off, n)
+	}
+
+	zero := make([]byte, min(n, 1<<20))
+	for n > 0 {
+		k, err := ss.w.WriteAt(zero[:min(n, int64(len(zero)))], off)
+		if err != nil {
+			return err
+		}
+
+		off += int64(k)
+		n -= int64(k)
+	}
+
+	return nil
+}
+
+// reply sends the reply to req. Reads get a structured reply if the client
+// negotiated them; everything else gets a simple reply.
+func (ss *session) reply(req request, err error, data []byte) error {
+	var msg []byte
+
+	switch {
+	case req.Type == cmdRead && ss.structured && err != nil:
+		msg = be.AppendUint32(nil, structuredReplyMagic)
+		msg = be.AppendUint16(msg, replyFlagDone)
+		msg = be.AppendUint16(msg, replyTypeError)
+		msg = be.AppendUint64(msg, req.Cookie)
+		msg = be.AppendUint32(msg, 6)
+		msg = be.AppendUint32(msg, errno(err))
+		msg = be.AppendUint16(msg, 0)
+
+	case req.Type == cmdRead && ss.structured:
+		msg = be.AppendUint32(nil, structuredReplyMagic)
+		msg = be.AppendUint16(msg, replyFlagDone)
+		msg = be.AppendUint16(msg, replyTypeOffsetData)
+		msg = be.AppendUint64(msg, req.Cookie)
+		msg = be.AppendUint32(msg, uint32(8+len(data)))
+		msg = be.AppendUint64(msg, req.Offset)
+
+	default:
+		var code uint32
+		if err != nil {
+			code = errno(err)
+		}
+
+		msg = be.AppendUint32(nil, simpleReplyMagic)
+		msg = be.AppendUint32(msg, code)
+		msg = be.AppendUint64(msg, req.Cookie)
+	}
+
+	if err != nil {
+		slog.Debug("nbd request failed", "type", req.Type, "offset", req.Offset, "length", req.Length, "err", err)
+		data = nil
+	}
+
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+
+	bufs := net.Buffers{msg, data}
+	_, werr := bufs.WriteTo(ss.conn)
+	return werr
+}
@@ -0,0 +1,342 @@
+package virtio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// OverlayStorage is read-write block storage that layers writes over read-only
+// base storage. Written blocks are stored in a delta and tracked in a bitmap;
+// everything else is read from the base. Many overlays can share one base.
+//
+// The bitmap is kept in memory, so the overlay lasts only as long as the
+// storage. Close discards the overlay or commits it to the base.
+type OverlayStorage struct {
+	base  BlockStorage
+	delta OverlayDelta
+	bs    int64
+	size  int64
+
+	commitOnClose bool
+
+	mu    sync.RWMutex
+	dirty []uint64 // bitmap of blocks in the delta
+}
+
+// OverlayConfig configures an OverlayStorage.
+type OverlayConfig struct {
+
+	// Delta stores written blocks at their offsets in the base, so a sparse
+	// file only takes up as much space as the blocks written to it. If Delta is
+	// nil, written blocks are stored in memory.
+	Delta OverlayDelta
+
+	// BlockSize is the size of the blocks tracked by the bitmap. Writing to part
+	// of a block copies the rest of it from the base. It must be a power of 2 >= 512.
+	// If zero, it is 4096.
+	BlockSize int
+
+	// CommitOnClose causes Close to write the overlay to the base, which must
+	// implement io.WriterAt. Otherwise, Close discards the overlay.
+	CommitOnClose bool
+}
+
+// OverlayDelta stores an overlay's written blocks. FileStorage and MemStorage
+// are both suitable. If the delta implements Discarder, discarded blocks are
+// deallocated from it.
+type OverlayDelta interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// memDelta is a sparse in-memory delta.
+type memDelta struct {
+	bs     int64
+	size   int64
+	blocks map[int64][]byte
+}
+
+// NewOverlayStorage creates an overlay over base.
+func NewOverlayStorage(base BlockStorage, cfg OverlayConfig) (*OverlayStorage, error) {
+	bs := int64(cfg.BlockSize)
+	if bs == 0 {
+		bs = 4096
+	}
+
+	if bs < 512 || bs&(bs-1) != 0 {
+		return nil, fmt.Errorf("overlay block size %d is not a power of 2 >= 512", bs)
+	}
+
+	if cfg.CommitOnClose {
+		if _, ok := base.(io.WriterAt); !ok {
+			return nil, errors.New("overlay can't commit to read-only base storage")
+		}
+	}
+
+	size, err := base.Size()
+	if err != nil {
+		return nil, fmt.Errorf("overlay base size: %w", err)
+	}
+
+	delta := cfg.Delta
+	if delta == nil {
+		delta = &memDelta{bs: bs, size: size, blocks: make(map[int64][]byte)}
+	}
+
+	return &OverlayStorage{
+		base:          base,
+		delta:         delta,
+		bs:            bs,
+		size:          size,
+		commitOnClose: cfg.CommitOnClose,
+		dirty:         make([]uint64, ((size+bs-1)/bs+63)/64),
+	}, nil
+}
+
+// ReadAt reads from the overlay at off, reading unwritten blocks from the base.
+func (ov *OverlayStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	ov.mu.RLock()
+	defer ov.mu.RUnlock()
+
+	if off < 0 {
+		return 0, errors.New("overlay read at a negative offset")
+	}
+
+	if off >= ov.size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > ov.size-off {
+		p, err = p[:ov.size-off], io.EOF
+	}
+
+	// read runs of blocks from the same layer
+	for n < len(p) {
+		blk := (off + int64(n)) / ov.bs
+		inDelta := ov.isDirty(blk)
+
+		end := blk + 1
+		for end*ov.bs < off+int64(len(p)) && ov.isDirty(end) == inDelta {
+			end++
+		}
+
+		k := int(min(end*ov.bs-off, int64(len(p)))) - n
+
+		var rerr error
+		if inDelta {
+			_, rerr = ov.delta.ReadAt(p[n:n+k], off+int64(n))
+		} else {
+			_, rerr = ov.base.ReadAt(p[n:n+k], off+int64(n))
+		}
+
+		if rerr != nil && rerr != io.EOF {
+			return n, rerr
+		}
+
+		n += k
+	}
+
+	return n, err
+}
+
+// WriteAt writes p to the delta at off. Before writing to part of a block that
+// isn't in the delta, it copies the block from the base.
+func (ov *OverlayStorage) WriteAt(p []byte, off int64) (n int, err error) {
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	if off < 0 || int64(len(p)) > ov.size-off {
+		return 0, fmt.Errorf("overlay write of %d bytes at %d is outside the storage", len(p), off)
+	}
+
+	// copy the partial blocks at each end
+	for _, blk := range []int64{off / ov.bs, (off + int64(len(p)) - 1) / ov.bs} {
+		if len(p) > 0 && !ov.isDirty(blk) && (blk*ov.bs < off || min((blk+1)*ov.bs, ov.size) > off+int64(len(p))) {
+			if err := ov.copyUp(blk); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if n, err = ov.delta.WriteAt(p, off); err != nil {
+		return n, err
+	}
+
+	for blk := off / ov.bs; blk*ov.bs < off+int64(len(p)); blk++ {
+		ov.dirty[blk/64] |= 1 << (blk % 64)
+	}
+
+	return n, nil
+}
+
+// copyUp copies block blk from the base to the delta and marks it dirty.
+func (ov *OverlayStorage) copyUp(blk int64) error {
+	buf := make([]byte, min(ov.bs, ov.size-blk*ov.bs))
+	if _, err := ov.base.ReadAt(buf, blk*ov.bs); err != nil && err != io.EOF {
+		return err
+	}
+
+	if _, err := ov.delta.WriteAt(buf, blk*ov.bs); err != nil {
+		return err
+	}
+
+	ov.dirty[blk/64] |= 1 << (blk % 64)
+	return nil
+}
+
+func (ov *OverlayStorage) isDirty(blk int64) bool {
+	return ov.dirty[blk/64]&(1<<(blk%64)) != 0
+}
+
+// Size returns the size of the base storage.
+func (ov *OverlayStorage) Size() (int64, error) {
+	return ov.size, nil
+}
+
+// Sync syncs the delta if it implements Syncer.
+func (ov *OverlayStorage) Sync() error {
+	if s, ok := ov.delta.(Syncer); ok {
+		return s.Sync()
+	}
+
+	return nil
+}
+
+// Discard drops the whole blocks between off and off+n from the overlay, so they
+// read from the base again.
+func (ov *OverlayStorage) Discard(off, n int64) error {
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	start, end := (off+ov.bs-1)/ov.bs, min(off+n, ov.size)/ov.bs
+	if min(off+n, ov.size) == ov.size {
+		end = (ov.size + ov.bs - 1) / ov.bs
+	}
+
+	for blk := start; blk < end; blk++ {
+		ov.dirty[blk/64] &^= 1 << (blk % 64)
+	}
+
+	if d, ok := ov.delta.(Discarder); ok && start < end {
+		return d.Discard(start*ov.bs, min(end*ov.bs, ov.size)-start*ov.bs)
+	}
+
+	return nil
+}
+
+// Commit writes the blocks in the overlay to the base, which must implement
+// io.WriterAt, then empties the overlay.
+func (ov *OverlayStorage) Commit() error {
+	w, ok := ov.base.(io.WriterAt)
+	if !ok {
+		return errors.New("overlay can't commit to read-only base storage")
+	}
+
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	buf := make([]byte, ov.bs)
+	for blk := int64(0); blk*ov.bs < ov.size; blk++ {
+		if !ov.isDirty(blk) {
+			continue
+		}
+
+		p := buf[:min(ov.bs, ov.size-blk*ov.bs)]
+		if _, err := ov.delta.ReadAt(p, blk*ov.bs); err != nil && err != io.EOF {
+			return err
+		}
+
+		if _, err := w.WriteAt(p, blk*ov.bs); err != nil {
+			return err
+		}
+	}
+
+	if s, ok := ov.base.(Syncer); ok {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return ov.reset()
+}
+
+// Revert empties the overlay, discarding everything written to it.
+func (ov *OverlayStorage) Revert() error {
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	return ov.reset()
+}
+
+func (ov *OverlayStorage) reset() error {
+	clear(ov.dirty)
+
+	if md, ok := ov.delta.(*memDelta); ok {
+		clear(md.blocks)
+		return nil
+	}
+
+	if d, ok := ov.delta.(Discarder); ok {
+		return d.Discard(0, ov.size)
+	}
+
+	return nil
+}
+
+// Close commits the overlay if it was created with CommitOnClose, and
+// discards it otherwise. It doesn't close the base or the delta.
+func (ov *OverlayStorage) Close() error {
+	if ov.commitOnClose {
+		return ov.Commit()
+	}
+
+	return ov.Revert()
+}
+
+// ReadAt copies from the blocks overlapping off into p.
+func (md *memDelta) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		blk, boff := (off+int64(n))/md.bs, (off+int64(n))%md.bs
+
+		var k int
+		if b, ok := md.blocks[blk]; ok {
+			k = copy(p[n:], b[boff:])
+		} else {
+			k = int(min(int64(len(p)-n), md.bs-boff))
+			clear(p[n : n+k])
+		}
+
+		n += k
+	}
+
+	return n, nil
+}
+
+// WriteAt copies p into the blocks overlapping off, allocating them as needed.
+func (md *memDelta) WriteAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		blk, boff := (off+int64(n))/md.bs, (off+int64(n))%md.bs
+
+		b, ok := md.blocks[blk]
+		if !ok {
+			b = make([]byte, md.bs)
+			md.blocks[blk] = b
+		}
+
+		n += copy(b[boff:], p[n:])
+	}
+
+	return n, nil
+}
+
+// Discard frees the whole blocks between off and off+n. The partial block at
+// the end of the storage is whole if the range reaches the end.
+func (md *memDelta) Discard(off, n int64) error {
+	for blk := (off + md.bs - 1) / md.bs; blk*md.bs < off+n && min((blk+1)*md.bs, md.size) <= off+n; blk++ {
+		delete(md.blocks, blk)
+	}
+
+	return nil
+}
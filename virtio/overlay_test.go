@@ -0,0 +1,193 @@
+package virtio_test
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c35s/hype/virtio"
+)
+
+func TestOverlayStorage(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "delta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	deltas := map[string]virtio.OverlayDelta{
+		"mem":  nil,
+		"file": &virtio.FileStorage{File: f},
+	}
+
+	for name, delta := range deltas {
+		t.Run(name, func(t *testing.T) {
+			// the base isn't a multiple of the block size
+			orig := make([]byte, 100000)
+			rand.New(rand.NewSource(1)).Read(orig)
+			base := &virtio.MemStorage{Bytes: bytes.Clone(orig)}
+
+			ov, err := virtio.NewOverlayStorage(base, virtio.OverlayConfig{Delta: delta, BlockSize: 1024})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rng := rand.New(rand.NewSource(2))
+			want := bytes.Clone(orig)
+
+			for i := 0; i < 100; i++ {
+				p := make([]byte, rng.Intn(5000)+1)
+				rng.Read(p)
+
+				off := rng.Int63n(int64(len(want) - len(p)))
+				if i%10 == 0 {
+					off = int64(len(want) - len(p))
+				}
+
+				if _, err := ov.WriteAt(p, off); err != nil {
+					t.Fatal(err)
+				}
+
+				copy(want[off:], p)
+			}
+
+			got := make([]byte, len(want))
+			if _, err := ov.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Fatal("overlay doesn't match writes")
+			}
+
+			if !bytes.Equal(base.Bytes, orig) {
+				t.Fatal("base changed")
+			}
+
+			// discarded blocks read from the base again, including the last partial block
+			if err := ov.Discard(1500, 3000); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ov.Discard(99000, 1000); err != nil {
+				t.Fatal(err)
+			}
+
+			copy(want[2048:4096], orig[2048:4096])
+			copy(want[99328:], orig[99328:])
+
+			if _, err := ov.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Error("discarded blocks don't match the base")
+			}
+
+			if err := ov.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(base.Bytes, want) {
+				t.Error("committed base doesn't match writes")
+			}
+
+			// reverted writes disappear
+			if _, err := ov.WriteAt([]byte("reverted"), 10); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ov.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := ov.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Error("overlay isn't empty after close")
+			}
+		})
+	}
+}
+
+func TestOverlayShared(t *testing.T) {
+	base := &virtio.MemStorage{Bytes: bytes.Repeat([]byte{0xaa}, 1<<16)}
+
+	var bts []*blkTest
+	for i := 0; i < 2; i++ {
+		ov, err := virtio.NewOverlayStorage(base, virtio.OverlayConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts = append(bts, newBlkTest(t, virtio.BlockDevice{Storage: ov}, 0))
+	}
+
+	for i, bt := range bts {
+		if s := bt.do(1, 1, bytes.Repeat([]byte{byte(i)}, 512), false); s != 0 {
+			t.Fatalf("overlay %d: write status %d", i, s)
+		}
+	}
+
+	for i, bt := range bts {
+		data := make([]byte, 1024)
+		if s := bt.do(0, 0, data, true); s != 0 {
+			t.Fatalf("overlay %d: read status %d", i, s)
+		}
+
+		if !bytes.Equal(data[:512], bytes.Repeat([]byte{0xaa}, 512)) || !bytes.Equal(data[512:], bytes.Repeat([]byte{byte(i)}, 512)) {
+			t.Errorf("overlay %d doesn't see only its own write", i)
+		}
+	}
+
+	if !bytes.Equal(base.Bytes, bytes.Repeat([]byte{0xaa}, 1<<16)) {
+		t.Error("base changed")
+	}
+
+	if _, err := virtio.NewOverlayStorage(&virtio.HTTPStorage{}, virtio.OverlayConfig{CommitOnClose: true}); err == nil {
+		t.Error("no error committing to read-only storage")
+	}
+}
+
+func TestOverlayCloseStorage(t *testing.T) {
+	base := &virtio.MemStorage{Bytes: make([]byte, 1<<16)}
+
+	ov, err := virtio.NewOverlayStorage(base, virtio.OverlayConfig{CommitOnClose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := virtio.BlockDevice{Storage: ov, CloseStorage: true}.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Ready(0, func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the device commits the overlay; this runs after the queue stops
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(base.Bytes[1024:1536], bytes.Repeat([]byte{0x55}, 512)) {
+			t.Error("close didn't commit the overlay")
+		}
+	})
+
+	bt := (&blkTest{t: t, h: h}).queue(0)
+	if s := bt.do(1, 2, bytes.Repeat([]byte{0x55}, 512), false); s != 0 {
+		t.Fatalf("write status %d", s)
+	}
+
+	if base.Bytes[1024] != 0 {
+		t.Fatal("write reached the base before close")
+	}
+}
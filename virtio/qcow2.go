@@ -0,0 +1,1109 @@
+package virtio
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// QCOW2Storage is block storage backed by a qcow2 version 2 or 3 image. It reads
+// and writes standard and zero clusters, and reads compressed clusters. Clusters
+// that aren't allocated in the image are read from the backing storage, if any.
+// Writing to one allocates a cluster in the image, filled from the backing storage.
+//
+// Images with encryption, external data files, extended L2 entries, or zstd
+// compression are unsupported. Images with internal snapshots are read-only.
+//
+// Metadata is written through to the image as it changes, so the image is
+// consistent at all times except for leaked clusters. The image's L2 tables and
+// refcount blocks are cached in memory as they are used.
+type QCOW2Storage struct {
+	f        *os.File
+	backing  BlockStorage
+	readOnly bool
+	closers  []io.Closer
+
+	hdr          qcow2Header
+	clusterBits  uint
+	clusterSize  int64
+	backingSize  int64
+	refcountBits uint
+	refblockLen  int64 // refcounts per refcount block
+
+	mu   sync.RWMutex
+	l1   []uint64 // L1 table
+	rt   []uint64 // refcount table
+	end  int64    // cluster-aligned end of the image file
+	free int64    // index of the first cluster that might be free
+
+	cacheMu sync.Mutex
+	tables  map[int64][]byte // L2 tables and refcount blocks by offset
+}
+
+// qcow2Header has the same layout as the qcow2 header. Version 2 headers end
+// after SnapshotsOffset.
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+var be = binary.BigEndian
+
+const (
+	qcow2Magic = 0x514649fb // "QFI\xfb"
+
+	qcow2V2HeaderLen = 72
+	qcow2V3HeaderLen = 104
+
+	// header field offsets
+	qcow2HdrRefcountTable = 48
+	qcow2HdrAutoclear     = 88
+
+	// incompatible feature bits
+	qcow2IncDirty       = 1 << 0
+	qcow2IncCorrupt     = 1 << 1
+	qcow2IncCompression = 1 << 3
+
+	// header extension types
+	qcow2ExtEnd           = 0
+	qcow2ExtBackingFormat = 0xe2792aca
+
+	// L1 and L2 entry bits
+	qcow2OffsetMask = 0x00fffffffffffe00 // host offset in L1 and standard L2 entries
+	qcow2Copied     = 1 << 63            // refcount is exactly 1
+	qcow2Compressed = 1 << 62            // L2 entry is a compressed cluster descriptor
+	qcow2Zero       = 1 << 0             // version 3 L2 entry reads as zeroes
+
+	qcow2MaxL1Size        = 1 << 22 // same as qemu
+	qcow2MaxRefcountTable = 1 << 23 // bytes
+	qcow2MaxBackingName   = 1023
+	qcow2MaxBackingDepth  = 16
+)
+
+// IsQCOW2 returns true if r starts with the qcow2 magic number.
+func IsQCOW2(r io.ReaderAt) bool {
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return false
+	}
+
+	return be.Uint32(magic[:]) == qcow2Magic
+}
+
+// OpenQCOW2 opens the qcow2 image file name. If the image has a backing file,
+// OpenQCOW2 opens the rest of the backing chain read-only. Relative backing file
+// names are relative to the directory containing the image. Backing files that
+// aren't qcow2 images are raw images.
+func OpenQCOW2(name string, readOnly bool) (*QCOW2Storage, error) {
+	return openQCOW2(name, readOnly, 0)
+}
+
+func openQCOW2(name string, readOnly bool, depth int) (qs *QCOW2Storage, err error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	hdr, err := readQCOW2Header(f)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2 %s: %w", name, err)
+	}
+
+	var backing BlockStorage
+	var closers []io.Closer
+
+	if hdr.BackingFileOffset != 0 {
+		if depth == qcow2MaxBackingDepth {
+			return nil, fmt.Errorf("qcow2 %s: backing chain is longer than %d", name, qcow2MaxBackingDepth)
+		}
+
+		bname, bfmt, err := readQCOW2Backing(f, hdr)
+		if err != nil {
+			return nil, fmt.Errorf("qcow2 %s: %w", name, err)
+		}
+
+		if !filepath.IsAbs(bname) {
+			bname = filepath.Join(filepath.Dir(name), bname)
+		}
+
+		bf, err := os.Open(bname)
+		if err != nil {
+			return nil, fmt.Errorf("qcow2 %s: open backing file: %w", name, err)
+		}
+
+		if bfmt == "qcow2" || (bfmt == "" && IsQCOW2(bf)) {
+			bf.Close()
+
+			bqs, err := openQCOW2(bname, true, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			backing, closers = bqs, []io.Closer{bqs}
+		} else if bfmt == "" || bfmt == "raw" {
+			backing, closers = &FileStorage{File: bf}, []io.Closer{bf}
+		} else {
+			bf.Close()
+			return nil, fmt.Errorf("qcow2 %s: unsupported backing file format %q", name, bfmt)
+		}
+	}
+
+	qs, err = newQCOW2(f, hdr, backing, readOnly)
+	if err != nil {
+		for _, c := range closers {
+			c.Close()
+		}
+
+		return nil, fmt.Errorf("qcow2 %s: %w", name, err)
+	}
+
+	qs.closers = append(closers, f)
+	return qs, nil
+}
+
+// NewQCOW2Storage creates storage for the qcow2 image f. If the image has a
+// backing file, unallocated clusters are read from backing instead; its backing
+// file name is ignored. The caller is responsible for closing f and backing.
+func NewQCOW2Storage(f *os.File, backing BlockStorage, readOnly bool) (*QCOW2Storage, error) {
+	hdr, err := readQCOW2Header(f)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+
+	if hdr.BackingFileOffset != 0 && backing == nil {
+		return nil, errors.New("qcow2: image has a backing file but no backing storage")
+	}
+
+	if hdr.BackingFileOffset == 0 {
+		backing = nil
+	}
+
+	qs, err := newQCOW2(f, hdr, backing, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+
+	return qs, nil
+}
+
+// readQCOW2Header reads and validates the header of the image f.
+func readQCOW2Header(f *os.File) (hdr qcow2Header, err error) {
+	buf := make([]byte, qcow2V3HeaderLen)
+	if n, err := f.ReadAt(buf, 0); n < qcow2V2HeaderLen {
+		return hdr, fmt.Errorf("read header: %w", err)
+	}
+
+	if err := binary.Read(bytes.NewReader(buf), be, &hdr); err != nil {
+		return hdr, err
+	}
+
+	if hdr.Magic != qcow2Magic {
+		return hdr, errors.New("not a qcow2 image")
+	}
+
+	switch hdr.Version {
+	case 2:
+		hdr.IncompatibleFeatures = 0
+		hdr.CompatibleFeatures = 0
+		hdr.AutoclearFeatures = 0
+		hdr.RefcountOrder = 4
+		hdr.HeaderLength = qcow2V2HeaderLen
+
+	case 3:
+		if hdr.HeaderLength < qcow2V3HeaderLen || hdr.HeaderLength%8 != 0 {
+			return hdr, fmt.Errorf("invalid header length %d", hdr.HeaderLength)
+		}
+
+	default:
+		return hdr, fmt.Errorf("unsupported version %d", hdr.Version)
+	}
+
+	if unknown := hdr.IncompatibleFeatures &^ (qcow2IncDirty | qcow2IncCorrupt | qcow2IncCompression); unknown != 0 {
+		return hdr, fmt.Errorf("unsupported incompatible features %#x", unknown)
+	}
+
+	// the compression type follows the v3 header
+	if hdr.IncompatibleFeatures&qcow2IncCompression != 0 {
+		var ct [1]byte
+		if hdr.HeaderLength <= qcow2V3HeaderLen {
+			return hdr, errors.New("missing compression type")
+		}
+
+		if _, err := f.ReadAt(ct[:], qcow2V3HeaderLen); err != nil {
+			return hdr, fmt.Errorf("read compression type: %w", err)
+		}
+
+		if ct[0] != 0 {
+			return hdr, fmt.Errorf("unsupported compression type %d", ct[0])
+		}
+	}
+
+	switch {
+	case hdr.ClusterBits < 9 || hdr.ClusterBits > 21:
+		return hdr, fmt.Errorf("invalid cluster bits %d", hdr.ClusterBits)
+
+	case hdr.CryptMethod != 0:
+		return hdr, errors.New("encrypted images are unsupported")
+
+	case hdr.RefcountOrder > 6:
+		return hdr, fmt.Errorf("invalid refcount order %d", hdr.RefcountOrder)
+
+	case hdr.Size > 1<<62:
+		return hdr, fmt.Errorf("invalid size %d", hdr.Size)
+
+	case hdr.L1Size > qcow2MaxL1Size:
+		return hdr, fmt.Errorf("L1 size %d is larger than %d", hdr.L1Size, qcow2MaxL1Size)
+
+	case uint64(hdr.RefcountTableClusters)<<hdr.ClusterBits > qcow2MaxRefcountTable:
+		return hdr, fmt.Errorf("refcount table is larger than %d bytes", qcow2MaxRefcountTable)
+
+	case hdr.BackingFileSize > qcow2MaxBackingName:
+		return hdr, fmt.Errorf("backing file name is longer than %d bytes", qcow2MaxBackingName)
+	}
+
+	mask := uint64(1)<<hdr.ClusterBits - 1
+	if hdr.L1TableOffset&mask != 0 || hdr.RefcountTableOffset&mask != 0 {
+		return hdr, errors.New("misaligned L1 or refcount table")
+	}
+
+	// each L2 table maps a cluster of 8-byte entries
+	l2Bytes := uint64(1) << (2*hdr.ClusterBits - 3)
+	if need := (hdr.Size + l2Bytes - 1) / l2Bytes; uint64(hdr.L1Size) < need {
+		return hdr, fmt.Errorf("L1 size %d is too small for size %d", hdr.L1Size, hdr.Size)
+	}
+
+	return hdr, nil
+}
+
+// readQCOW2Backing reads the backing file name and format of the image f.
+// The format is empty if the image doesn't specify it.
+func readQCOW2Backing(f *os.File, hdr qcow2Header) (name, format string, err error) {
+	buf := make([]byte, hdr.BackingFileSize)
+	if _, err := f.ReadAt(buf, int64(hdr.BackingFileOffset)); err != nil {
+		return "", "", fmt.Errorf("read backing file name: %w", err)
+	}
+
+	name = string(buf)
+
+	// header extensions follow the header, up to the end of the first cluster
+	end := int64(1) << hdr.ClusterBits
+	for off := int64(hdr.HeaderLength); off+8 <= end; {
+		var ext [8]byte
+		if _, err := f.ReadAt(ext[:], off); err != nil {
+			return "", "", fmt.Errorf("read header extension: %w", err)
+		}
+
+		typ, n := be.Uint32(ext[:]), int64(be.Uint32(ext[4:]))
+		if typ == qcow2ExtEnd {
+			break
+		}
+
+		if off+8+n > end {
+			return "", "", errors.New("header extension overflows the first cluster")
+		}
+
+		if typ == qcow2ExtBackingFormat {
+			buf := make([]byte, n)
+			if _, err := f.ReadAt(buf, off+8); err != nil {
+				return "", "", fmt.Errorf("read backing format: %w", err)
+			}
+
+			format = string(buf)
+		}
+
+		off += 8 + (n+7)&^7
+	}
+
+	return name, format, nil
+}
+
+func newQCOW2(f *os.File, hdr qcow2Header, backing BlockStorage, readOnly bool) (*QCOW2Storage, error) {
+	if !readOnly {
+		switch {
+		case hdr.IncompatibleFeatures&qcow2IncDirty != 0:
+			return nil, errors.New("image is dirty; repair it with qemu-img check -r all")
+
+		case hdr.IncompatibleFeatures&qcow2IncCorrupt != 0:
+			return nil, errors.New("image is corrupt; it can only be opened read-only")
+
+		case hdr.NbSnapshots != 0:
+			return nil, errors.New("images with internal snapshots can only be opened read-only")
+		}
+	}
+
+	qs := &QCOW2Storage{
+		f:            f,
+		backing:      backing,
+		readOnly:     readOnly,
+		hdr:          hdr,
+		clusterBits:  uint(hdr.ClusterBits),
+		clusterSize:  1 << hdr.ClusterBits,
+		refcountBits: 1 << hdr.RefcountOrder,
+		tables:       make(map[int64][]byte),
+	}
+
+	qs.refblockLen = qs.clusterSize * 8 / int64(qs.refcountBits)
+
+	if backing != nil {
+		sz, err := backing.Size()
+		if err != nil {
+			return nil, fmt.Errorf("backing storage size: %w", err)
+		}
+
+		qs.backingSize = sz
+	}
+
+	var err error
+	if qs.l1, err = qs.readTable(int64(hdr.L1TableOffset), int(hdr.L1Size)); err != nil {
+		return nil, fmt.Errorf("read L1 table: %w", err)
+	}
+
+	rtLen := int(int64(hdr.RefcountTableClusters) * qs.clusterSize / 8)
+	if qs.rt, err = qs.readTable(int64(hdr.RefcountTableOffset), rtLen); err != nil {
+		return nil, fmt.Errorf("read refcount table: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	qs.end = (info.Size() + qs.clusterSize - 1) &^ (qs.clusterSize - 1)
+
+	// writers must clear autoclear features they don't support, which is all of them
+	if !readOnly && hdr.AutoclearFeatures != 0 {
+		if _, err := f.WriteAt(make([]byte, 8), qcow2HdrAutoclear); err != nil {
+			return nil, fmt.Errorf("clear autoclear features: %w", err)
+		}
+
+		qs.hdr.AutoclearFeatures = 0
+	}
+
+	return qs, nil
+}
+
+// readTable reads a table of n big-endian uint64s at off.
+func (qs *QCOW2Storage) readTable(off int64, n int) ([]uint64, error) {
+	buf := make([]byte, n*8)
+	if _, err := qs.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+
+	t := make([]uint64, n)
+	for i := range t {
+		t[i] = be.Uint64(buf[i*8:])
+	}
+
+	return t, nil
+}
+
+// ReadAt reads from the image at off.
+func (qs *QCOW2Storage) ReadAt(p []byte, off int64) (n int, err error) {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+
+	size := int64(qs.hdr.Size)
+	if off < 0 {
+		return 0, errors.New("qcow2 read at a negative offset")
+	}
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > size-off {
+		p, err = p[:size-off], io.EOF
+	}
+
+	for n < len(p) {
+		k := int(min(int64(len(p)-n), qs.clusterSize-off&(qs.clusterSize-1)))
+		if rerr := qs.readCluster(p[n:n+k], off); rerr != nil {
+			return n, rerr
+		}
+
+		n += k
+		off += int64(k)
+	}
+
+	return n, err
+}
+
+// readCluster reads len(p) bytes at off, which must be within one cluster.
+func (qs *QCOW2Storage) readCluster(p []byte, off int64) error {
+	e, err := qs.l2Entry(off)
+	if err != nil {
+		return err
+	}
+
+	host := int64(e & qcow2OffsetMask)
+	switch {
+	case e&qcow2Compressed != 0:
+		return qs.readCompressed(p, e, off&(qs.clusterSize-1))
+
+	case e&qcow2Zero != 0 && qs.hdr.Version >= 3:
+		clear(p)
+		return nil
+
+	case host != 0:
+		n, err := qs.f.ReadAt(p, host+off&(qs.clusterSize-1))
+		if err == io.EOF {
+			// the file may end before the end of its last cluster
+			clear(p[n:])
+			err = nil
+		}
+
+		return err
+
+	default:
+		return qs.readBacking(p, off)
+	}
+}
+
+// readBacking reads from the backing storage at off. Everything past the end
+// of the backing storage reads as zeroes.
+func (qs *QCOW2Storage) readBacking(p []byte, off int64) error {
+	var n int
+	if off < qs.backingSize {
+		var err error
+		n, err = qs.backing.ReadAt(p[:min(int64(len(p)), qs.backingSize-off)], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	clear(p[n:])
+	return nil
+}
+
+// readCompressed decompresses the cluster described by e and copies it from
+// off into p.
+func (qs *QCOW2Storage) readCompressed(p []byte, e uint64, off int64) error {
+	host, size := qs.compressedRange(e)
+
+	buf := make([]byte, size)
+	n, err := qs.f.ReadAt(buf, host)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	cluster := make([]byte, qs.clusterSize)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(buf[:n])), cluster); err != nil {
+		return fmt.Errorf("qcow2 decompress cluster at %#x: %w", host, err)
+	}
+
+	copy(p, cluster[off:])
+	return nil
+}
+
+// compressedRange returns the host offset and maximum size of the compressed
+// data described by e.
+func (qs *QCOW2Storage) compressedRange(e uint64) (host, size int64) {
+	x := 62 - (qs.clusterBits - 8)
+	host = int64(e & (1<<x - 1))
+	sectors := int64(e>>x) & (1<<(62-x) - 1)
+	return host, (sectors+1)*512 - host&511
+}
+
+// l2Entry returns the L2 entry that maps off, or zero if off is unallocated.
+func (qs *QCOW2Storage) l2Entry(off int64) (uint64, error) {
+	l1i, l2i := qs.index(off)
+
+	l2off := int64(qs.l1[l1i] & qcow2OffsetMask)
+	if l2off == 0 {
+		return 0, nil
+	}
+
+	l2, err := qs.table(l2off)
+	if err != nil {
+		return 0, err
+	}
+
+	e := be.Uint64(l2[l2i*8:])
+	return e, qs.checkEntry(e)
+}
+
+// checkEntry returns an error if the standard L2 entry e has a misaligned
+// host offset.
+func (qs *QCOW2Storage) checkEntry(e uint64) error {
+	if e&qcow2Compressed == 0 && int64(e&qcow2OffsetMask)&(qs.clusterSize-1) != 0 {
+		return fmt.Errorf("qcow2 L2 entry %#x is misaligned", e)
+	}
+
+	return nil
+}
+
+// index returns the L1 and L2 table indexes that map off.
+func (qs *QCOW2Storage) index(off int64) (l1i, l2i int64) {
+	cluster := off >> qs.clusterBits
+	l2Len := qs.clusterSize / 8
+	return cluster / l2Len, cluster % l2Len
+}
+
+// table returns the cluster-sized L2 table or refcount block at off, reading
+// it into the cache if necessary.
+func (qs *QCOW2Storage) table(off int64) ([]byte, error) {
+	qs.cacheMu.Lock()
+	defer qs.cacheMu.Unlock()
+
+	if t, ok := qs.tables[off]; ok {
+		return t, nil
+	}
+
+	if off&(qs.clusterSize-1) != 0 {
+		return nil, fmt.Errorf("qcow2 table at %#x is misaligned", off)
+	}
+
+	t := make([]byte, qs.clusterSize)
+	if _, err := qs.f.ReadAt(t, off); err != nil {
+		return nil, fmt.Errorf("qcow2 read table at %#x: %w", off, err)
+	}
+
+	qs.tables[off] = t
+	return t, nil
+}
+
+// Size returns the virtual size of the image in bytes.
+func (qs *QCOW2Storage) Size() (int64, error) {
+	return int64(qs.hdr.Size), nil
+}
+
+// ReadOnly returns true if the image was opened read-only.
+func (qs *QCOW2Storage) ReadOnly() bool {
+	return qs.readOnly
+}
+
+// WriteAt writes to the image at off, allocating clusters as necessary.
+func (qs *QCOW2Storage) WriteAt(p []byte, off int64) (n int, err error) {
+	if qs.readOnly {
+		return 0, errors.New("qcow2 image is read-only")
+	}
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	return qs.writeAt(p, off)
+}
+
+func (qs *QCOW2Storage) writeAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || int64(len(p)) > int64(qs.hdr.Size)-off {
+		return 0, fmt.Errorf("qcow2 write of %d bytes at %d is outside the image", len(p), off)
+	}
+
+	for n < len(p) {
+		k := int(min(int64(len(p)-n), qs.clusterSize-off&(qs.clusterSize-1)))
+		if err := qs.writeCluster(p[n:n+k], off); err != nil {
+			return n, err
+		}
+
+		n += k
+		off += int64(k)
+	}
+
+	return n, nil
+}
+
+// writeCluster writes len(p) bytes at off, which must be within one cluster.
+// If the cluster isn't allocated, it allocates one and fills the rest of it
+// from the current contents.
+func (qs *QCOW2Storage) writeCluster(p []byte, off int64) error {
+	l2, l2off, l2i, err := qs.l2ForWrite(off)
+	if err != nil {
+		return err
+	}
+
+	e := be.Uint64(l2[l2i*8:])
+	if err := qs.checkEntry(e); err != nil {
+		return err
+	}
+
+	host := int64(e & qcow2OffsetMask)
+	inoff := off & (qs.clusterSize - 1)
+
+	if e&(qcow2Compressed|qcow2Zero) == 0 && host != 0 {
+		_, err := qs.f.WriteAt(p, host+inoff)
+		return err
+	}
+
+	cluster := p
+	if int64(len(p)) < qs.clusterSize {
+		cluster = make([]byte, qs.clusterSize)
+		if err := qs.readCluster(cluster, off-inoff); err != nil {
+			return err
+		}
+
+		copy(cluster[inoff:], p)
+	}
+
+	// a preallocated zero cluster is reused
+	if e&qcow2Compressed != 0 || host == 0 {
+		if host, err = qs.alloc(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := qs.f.WriteAt(cluster, host); err != nil {
+		return err
+	}
+
+	if err := qs.setL2Entry(l2, l2off, l2i, uint64(host)|qcow2Copied); err != nil {
+		return err
+	}
+
+	if e&qcow2Compressed != 0 {
+		return qs.releaseCompressed(e)
+	}
+
+	return nil
+}
+
+// l2ForWrite returns the L2 table that maps off, its offset, and the index of
+// off's entry, allocating the table if necessary.
+func (qs *QCOW2Storage) l2ForWrite(off int64) (l2 []byte, l2off, l2i int64, err error) {
+	l1i, l2i := qs.index(off)
+
+	if l2off = int64(qs.l1[l1i] & qcow2OffsetMask); l2off != 0 {
+		l2, err = qs.table(l2off)
+		return l2, l2off, l2i, err
+	}
+
+	if l2off, err = qs.alloc(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	l2 = make([]byte, qs.clusterSize)
+	if _, err := qs.f.WriteAt(l2, l2off); err != nil {
+		return nil, 0, 0, err
+	}
+
+	qs.cacheMu.Lock()
+	qs.tables[l2off] = l2
+	qs.cacheMu.Unlock()
+
+	e := uint64(l2off) | qcow2Copied
+	if _, err := qs.f.WriteAt(be.AppendUint64(nil, e), int64(qs.hdr.L1TableOffset)+l1i*8); err != nil {
+		return nil, 0, 0, err
+	}
+
+	qs.l1[l1i] = e
+	return l2, l2off, l2i, nil
+}
+
+// setL2Entry sets entry l2i of the L2 table at l2off.
+func (qs *QCOW2Storage) setL2Entry(l2 []byte, l2off, l2i int64, e uint64) error {
+	be.PutUint64(l2[l2i*8:], e)
+	_, err := qs.f.WriteAt(l2[l2i*8:l2i*8+8], l2off+l2i*8)
+	return err
+}
+
+// alloc allocates a cluster and returns its offset.
+func (qs *QCOW2Storage) alloc() (int64, error) {
+	idx, err := qs.allocIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := qs.setRefcount(idx, 1); err != nil {
+		return 0, err
+	}
+
+	return idx << qs.clusterBits, nil
+}
+
+// allocIndex finds a free cluster without setting its refcount. Clusters at
+// or after the returned index are free.
+func (qs *QCOW2Storage) allocIndex() (int64, error) {
+	for end := qs.end >> qs.clusterBits; qs.free < end; qs.free++ {
+		rc, err := qs.refcount(qs.free)
+		if err != nil {
+			return 0, err
+		}
+
+		if rc == 0 {
+			qs.free++
+			return qs.free - 1, nil
+		}
+	}
+
+	qs.end += qs.clusterSize
+	qs.free = qs.end >> qs.clusterBits
+	return qs.free - 1, nil
+}
+
+// refcount returns the refcount of the cluster at idx.
+func (qs *QCOW2Storage) refcount(idx int64) (uint64, error) {
+	ti, bi := idx/qs.refblockLen, idx%qs.refblockLen
+	if ti >= int64(len(qs.rt)) || qs.rt[ti]&qcow2OffsetMask == 0 {
+		return 0, nil
+	}
+
+	rb, err := qs.table(int64(qs.rt[ti] & qcow2OffsetMask))
+	if err != nil {
+		return 0, err
+	}
+
+	return qs.getRefcount(rb, bi), nil
+}
+
+func (qs *QCOW2Storage) getRefcount(rb []byte, bi int64) uint64 {
+	switch b := qs.refcountBits; {
+	case b < 8:
+		perByte := 8 / int64(b)
+		return uint64(rb[bi/perByte]>>(uint(bi%perByte)*b)) & (1<<b - 1)
+
+	default:
+		var v uint64
+		for _, c := range rb[bi*int64(b/8) : (bi+1)*int64(b/8)] {
+			v = v<<8 | uint64(c)
+		}
+
+		return v
+	}
+}
+
+// setRefcount sets the refcount of the cluster at idx, allocating a refcount
+// block and growing the refcount table if necessary.
+func (qs *QCOW2Storage) setRefcount(idx int64, v uint64) error {
+	if qs.refcountBits < 64 && v >= 1<<qs.refcountBits {
+		return fmt.Errorf("qcow2 refcount %d overflows %d bits", v, qs.refcountBits)
+	}
+
+	ti, bi := idx/qs.refblockLen, idx%qs.refblockLen
+	if ti >= int64(len(qs.rt)) {
+		if err := qs.growRefcountTable(ti + 1); err != nil {
+			return err
+		}
+	}
+
+	if qs.rt[ti]&qcow2OffsetMask == 0 {
+		if err := qs.allocRefblock(ti); err != nil {
+			return err
+		}
+	}
+
+	rboff := int64(qs.rt[ti] & qcow2OffsetMask)
+	rb, err := qs.table(rboff)
+	if err != nil {
+		return err
+	}
+
+	var lo, hi int64
+	switch b := qs.refcountBits; {
+	case b < 8:
+		perByte := 8 / int64(b)
+		shift := uint(bi%perByte) * b
+		lo, hi = bi/perByte, bi/perByte+1
+		rb[lo] = rb[lo]&^byte((1<<b-1)<<shift) | byte(v<<shift)
+
+	default:
+		lo, hi = bi*int64(b/8), (bi+1)*int64(b/8)
+		for i, x := hi-1, v; i >= lo; i, x = i-1, x>>8 {
+			rb[i] = byte(x)
+		}
+	}
+
+	if _, err := qs.f.WriteAt(rb[lo:hi], rboff+lo); err != nil {
+		return err
+	}
+
+	if v == 0 && idx < qs.free {
+		qs.free = idx
+	}
+
+	return nil
+}
+
+// allocRefblock allocates refcount block ti. The block may describe itself.
+func (qs *QCOW2Storage) allocRefblock(ti int64) error {
+	idx, err := qs.allocIndex()
+	if err != nil {
+		return err
+	}
+
+	off := idx << qs.clusterBits
+	rb := make([]byte, qs.clusterSize)
+	if _, err := qs.f.WriteAt(rb, off); err != nil {
+		return err
+	}
+
+	qs.cacheMu.Lock()
+	qs.tables[off] = rb
+	qs.cacheMu.Unlock()
+
+	if err := qs.setRefcountTableEntry(ti, uint64(off)); err != nil {
+		return err
+	}
+
+	return qs.setRefcount(idx, 1)
+}
+
+func (qs *QCOW2Storage) setRefcountTableEntry(ti int64, e uint64) error {
+	if _, err := qs.f.WriteAt(be.AppendUint64(nil, e), int64(qs.hdr.RefcountTableOffset)+ti*8); err != nil {
+		return err
+	}
+
+	qs.rt[ti] = e
+	return nil
+}
+
+// growRefcountTable moves the refcount table to the end of the image, making
+// room for at least n entries.
+func (qs *QCOW2Storage) growRefcountTable(n int64) error {
+	n = max(n, int64(len(qs.rt))*2)
+
+	// the new table must also describe its own clusters
+	off := qs.end
+	var clusters int64
+	for {
+		clusters = (n*8 + qs.clusterSize - 1) >> qs.clusterBits
+		if last := (off>>qs.clusterBits + clusters) / qs.refblockLen; last < n {
+			break
+		}
+
+		n *= 2
+	}
+
+	if clusters<<qs.clusterBits > qcow2MaxRefcountTable {
+		return errors.New("qcow2 refcount table is full")
+	}
+
+	rt := make([]uint64, clusters<<qs.clusterBits/8)
+	copy(rt, qs.rt)
+
+	buf := make([]byte, 0, len(rt)*8)
+	for _, e := range rt {
+		buf = be.AppendUint64(buf, e)
+	}
+
+	if _, err := qs.f.WriteAt(buf, off); err != nil {
+		return err
+	}
+
+	// keep the new table's clusters from being allocated before their refcounts are set
+	free := qs.free
+	qs.end += clusters << qs.clusterBits
+	qs.free = qs.end >> qs.clusterBits
+
+	var hdr [12]byte
+	be.PutUint64(hdr[:], uint64(off))
+	be.PutUint32(hdr[8:], uint32(clusters))
+	if _, err := qs.f.WriteAt(hdr[:], qcow2HdrRefcountTable); err != nil {
+		return err
+	}
+
+	oldOff, oldClusters := int64(qs.hdr.RefcountTableOffset), int64(qs.hdr.RefcountTableClusters)
+	qs.hdr.RefcountTableOffset, qs.hdr.RefcountTableClusters = uint64(off), uint32(clusters)
+	qs.rt = rt
+
+	for i := int64(0); i < clusters; i++ {
+		if err := qs.setRefcount(off>>qs.clusterBits+i, 1); err != nil {
+			return err
+		}
+	}
+
+	for i := int64(0); i < oldClusters; i++ {
+		if err := qs.setRefcount(oldOff>>qs.clusterBits+i, 0); err != nil {
+			return err
+		}
+	}
+
+	qs.free = min(qs.free, free)
+	return nil
+}
+
+// releaseCompressed decrements the refcounts of the clusters that hold the
+// compressed cluster described by e.
+func (qs *QCOW2Storage) releaseCompressed(e uint64) error {
+	host, size := qs.compressedRange(e)
+	for idx := host >> qs.clusterBits; idx <= (host+size-1)>>qs.clusterBits; idx++ {
+		if err := qs.release(idx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// release decrements the refcount of the cluster at idx. If the cluster becomes
+// free, release punches a hole in the image file to deallocate it.
+func (qs *QCOW2Storage) release(idx int64) error {
+	rc, err := qs.refcount(idx)
+	if err != nil || rc == 0 {
+		return err
+	}
+
+	if err := qs.setRefcount(idx, rc-1); err != nil {
+		return err
+	}
+
+	if rc == 1 {
+		qs.cacheMu.Lock()
+		delete(qs.tables, idx<<qs.clusterBits)
+		qs.cacheMu.Unlock()
+
+		// only an optimization
+		unix.Fallocate(int(qs.f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, idx<<qs.clusterBits, qs.clusterSize)
+	}
+
+	return nil
+}
+
+// Sync commits the image file's contents to durable storage.
+func (qs *QCOW2Storage) Sync() error {
+	return qs.f.Sync()
+}
+
+// Discard deallocates the whole clusters between off and off+n. Deallocated
+// clusters read as zeroes. Version 2 images with backing files can't represent
+// zero clusters, so Discard does nothing to them.
+func (qs *QCOW2Storage) Discard(off, n int64) error {
+	if qs.readOnly {
+		return errors.New("qcow2 image is read-only")
+	}
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	start, end := qs.wholeClusters(off, n)
+	for ; start < end; start += qs.clusterSize {
+		if _, err := qs.deallocate(start); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteZeroesAt zeroes n bytes of the image at off. It deallocates the whole
+// clusters in the range if it can, and writes zeroes to the rest.
+func (qs *QCOW2Storage) WriteZeroesAt(off, n int64) error {
+	if qs.readOnly {
+		return errors.New("qcow2 image is read-only")
+	}
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	if off < 0 || n > int64(qs.hdr.Size)-off {
+		return fmt.Errorf("qcow2 write zeroes of %d bytes at %d is outside the image", n, off)
+	}
+
+	var zero []byte
+	for end := off + n; off < end; {
+		k := min(end-off, qs.clusterSize-off&(qs.clusterSize-1))
+
+		if k == qs.clusterSize {
+			ok, err := qs.deallocate(off)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				off += k
+				continue
+			}
+		}
+
+		if zero == nil {
+			zero = make([]byte, qs.clusterSize)
+		}
+
+		if _, err := qs.writeAt(zero[:k], off); err != nil {
+			return err
+		}
+
+		off += k
+	}
+
+	return nil
+}
+
+// wholeClusters returns the range of the whole clusters between off and off+n.
+func (qs *QCOW2Storage) wholeClusters(off, n int64) (start, end int64) {
+	start = (off + qs.clusterSize - 1) &^ (qs.clusterSize - 1)
+	end = min(off+n, int64(qs.hdr.Size)) &^ (qs.clusterSize - 1)
+	return start, end
+}
+
+// deallocate makes the cluster at off read as zeroes, releasing its host
+// cluster. It returns false if the image can't represent zero clusters.
+func (qs *QCOW2Storage) deallocate(off int64) (bool, error) {
+	var zero uint64
+	if qs.backing != nil {
+		if qs.hdr.Version < 3 {
+			return false, nil
+		}
+
+		zero = qcow2Zero
+	}
+
+	if e, err := qs.l2Entry(off); err != nil || e == zero {
+		return err == nil, err
+	}
+
+	l2, l2off, l2i, err := qs.l2ForWrite(off)
+	if err != nil {
+		return false, err
+	}
+
+	e := be.Uint64(l2[l2i*8:])
+	if err := qs.setL2Entry(l2, l2off, l2i, zero); err != nil {
+		return false, err
+	}
+
+	if e&qcow2Compressed != 0 {
+		return true, qs.releaseCompressed(e)
+	}
+
+	if host := int64(e & qcow2OffsetMask); host != 0 {
+		return true, qs.release(host >> qs.clusterBits)
+	}
+
+	return true, nil
+}
+
+// Close closes the image file. If the storage was opened with OpenQCOW2, Close
+// also closes the backing chain.
+func (qs *QCOW2Storage) Close() error {
+	var errs []error
+	for _, c := range qs.closers {
+		errs = append(errs, c.Close())
+	}
+
+	return errors.Join(errs...)
+}
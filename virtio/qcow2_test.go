@@ -0,0 +1,523 @@
+package virtio_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c35s/hype/virtio"
+)
+
+var be = binary.BigEndian
+
+// qcow2Image describes a blank qcow2 image for createQCOW2.
+type qcow2Image struct {
+	version       uint32
+	clusterBits   uint32
+	refcountOrder uint32
+	size          uint64
+	backing       string
+	backingFormat string
+}
+
+// createQCOW2 writes a blank image to name. Cluster 0 holds the header, cluster
+// 1 the refcount table, cluster 2 the first refcount block, and cluster 3 the
+// L1 table.
+func createQCOW2(t *testing.T, name string, img qcow2Image) {
+	t.Helper()
+
+	cs := uint64(1) << img.clusterBits
+	l1Size := (img.size + cs*cs/8 - 1) / (cs * cs / 8)
+	l1Clusters := (l1Size*8 + cs - 1) / cs
+
+	buf := make([]byte, (3+l1Clusters)*cs)
+
+	hdrLen := 72
+	if img.version == 3 {
+		hdrLen = 104
+	}
+
+	be.PutUint32(buf[0:], 0x514649fb)
+	be.PutUint32(buf[4:], img.version)
+	be.PutUint32(buf[20:], img.clusterBits)
+	be.PutUint64(buf[24:], img.size)
+	be.PutUint32(buf[36:], uint32(l1Size))
+	be.PutUint64(buf[40:], 3*cs)
+	be.PutUint64(buf[48:], cs)
+	be.PutUint32(buf[56:], 1)
+
+	if img.version == 3 {
+		be.PutUint32(buf[96:], img.refcountOrder)
+		be.PutUint32(buf[100:], uint32(hdrLen))
+	} else {
+		img.refcountOrder = 4
+	}
+
+	// header extensions, then the backing file name
+	off := hdrLen
+	if img.backingFormat != "" {
+		be.PutUint32(buf[off:], 0xe2792aca)
+		be.PutUint32(buf[off+4:], uint32(len(img.backingFormat)))
+		copy(buf[off+8:], img.backingFormat)
+		off += 8 + (len(img.backingFormat)+7)&^7
+	}
+
+	off += 8
+
+	if img.backing != "" {
+		be.PutUint64(buf[8:], uint64(off))
+		be.PutUint32(buf[16:], uint32(len(img.backing)))
+		copy(buf[off:], img.backing)
+	}
+
+	be.PutUint64(buf[cs:], 2*cs)
+	for i := uint64(0); i < 3+l1Clusters; i++ {
+		putRefcount(buf[2*cs:3*cs], img.refcountOrder, i, 1)
+	}
+
+	if err := os.WriteFile(name, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putRefcount(rb []byte, order uint32, i, v uint64) {
+	bits := uint64(1) << order
+	if bits < 8 {
+		rb[i*bits/8] |= byte(v << (i * bits % 8))
+		return
+	}
+
+	for j := i*bits/8 + bits/8 - 1; j >= i*bits/8 && v > 0; j-- {
+		rb[j] = byte(v)
+		v >>= 8
+	}
+}
+
+func getRefcount(rb []byte, order uint32, i uint64) uint64 {
+	bits := uint64(1) << order
+	if bits < 8 {
+		return uint64(rb[i*bits/8]>>(i*bits%8)) & (1<<bits - 1)
+	}
+
+	var v uint64
+	for _, c := range rb[i*bits/8 : i*bits/8+bits/8] {
+		v = v<<8 | uint64(c)
+	}
+
+	return v
+}
+
+// checkQCOW2 walks the image's metadata and checks that each cluster's refcount
+// is the number of references to it.
+func checkQCOW2(t *testing.T, name string) {
+	t.Helper()
+
+	img, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		cb     = be.Uint32(img[20:])
+		cs     = uint64(1) << cb
+		l1Size = uint64(be.Uint32(img[36:]))
+		l1Off  = be.Uint64(img[40:])
+		rtOff  = be.Uint64(img[48:])
+		rtLen  = uint64(be.Uint32(img[56:])) * cs / 8
+		order  = uint32(4)
+		refs   = make(map[uint64]uint64)
+	)
+
+	if be.Uint32(img[4:]) == 3 {
+		order = be.Uint32(img[96:])
+	}
+
+	ref := func(off, n uint64) {
+		for c := off / cs; c < (off+n+cs-1)/cs; c++ {
+			refs[c]++
+		}
+	}
+
+	ref(0, cs)
+	ref(l1Off, l1Size*8)
+	ref(rtOff, rtLen*8)
+
+	for i := uint64(0); i < rtLen; i++ {
+		if rb := be.Uint64(img[rtOff+i*8:]); rb != 0 {
+			ref(rb, cs)
+		}
+	}
+
+	for i := uint64(0); i < l1Size; i++ {
+		l2 := be.Uint64(img[l1Off+i*8:]) & 0x00fffffffffffe00
+		if l2 == 0 {
+			continue
+		}
+
+		ref(l2, cs)
+		for j := uint64(0); j < cs/8; j++ {
+			e := be.Uint64(img[l2+j*8:])
+			if e&(1<<62) != 0 {
+				x := 62 - (cb - 8)
+				host := e & (1<<x - 1)
+				ref(host, ((e>>x)&(1<<(62-x)-1)+1)*512-host%512)
+			} else if host := e & 0x00fffffffffffe00; host != 0 {
+				ref(host, cs)
+			}
+		}
+	}
+
+	perBlock := cs * 8 >> order
+	for c := uint64(0); c < (uint64(len(img))+cs-1)/cs; c++ {
+		var rc uint64
+		if c/perBlock < rtLen {
+			if rb := be.Uint64(img[rtOff+c/perBlock*8:]); rb != 0 {
+				rc = getRefcount(img[rb:rb+cs], order, c%perBlock)
+			}
+		}
+
+		if rc != refs[c] {
+			t.Errorf("cluster %d: refcount %d != %d references", c, rc, refs[c])
+		}
+	}
+}
+
+func TestQCOW2ReadWrite(t *testing.T) {
+	for name, img := range map[string]qcow2Image{
+		"v2":          {version: 2, clusterBits: 16, size: 64 << 20},
+		"v3":          {version: 3, clusterBits: 16, refcountOrder: 4, size: 64 << 20},
+		"small":       {version: 3, clusterBits: 9, refcountOrder: 6, size: 4 << 20},
+		"1-bit":       {version: 3, clusterBits: 12, refcountOrder: 0, size: 16<<20 + 1000},
+		"odd cluster": {version: 3, clusterBits: 10, refcountOrder: 3, size: 8 << 20},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk.qcow2")
+			createQCOW2(t, path, img)
+
+			qs, err := virtio.OpenQCOW2(path, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sz, _ := qs.Size(); sz != int64(img.size) {
+				t.Fatalf("size %d != %d", sz, img.size)
+			}
+
+			// random writes, checked against memory
+			var (
+				rng  = rand.New(rand.NewSource(1))
+				want = make([]byte, img.size)
+			)
+
+			for i := 0; i < 200; i++ {
+				p := make([]byte, rng.Intn(20000)+1)
+				rng.Read(p)
+
+				off := rng.Int63n(int64(img.size) - int64(len(p)))
+				if i%10 == 0 {
+					off = int64(img.size) - int64(len(p))
+				}
+
+				if _, err := qs.WriteAt(p, off); err != nil {
+					t.Fatalf("write %d at %d: %v", len(p), off, err)
+				}
+
+				copy(want[off:], p)
+			}
+
+			// fill 3 MiB so small images outgrow their refcount tables
+			fill := make([]byte, 3<<20)
+			rng.Read(fill)
+
+			if _, err := qs.WriteAt(fill, 1<<20); err != nil {
+				t.Fatal(err)
+			}
+
+			copy(want[1<<20:], fill)
+
+			// zero and discard a few ranges
+			for i := 0; i < 20; i++ {
+				off, n := rng.Int63n(int64(img.size)/2), rng.Int63n(1<<17)
+				if err := qs.WriteZeroesAt(off, n); err != nil {
+					t.Fatal(err)
+				}
+
+				clear(want[off : off+n])
+
+				if err := qs.Discard(off+n, n); err != nil {
+					t.Fatal(err)
+				}
+
+				// discarded whole clusters read as zeroes, the rest is unchanged
+				cs := int64(1) << img.clusterBits
+				start, end := (off+n+cs-1)&^(cs-1), (off+2*n)&^(cs-1)
+				if start < end {
+					clear(want[start:end])
+				}
+			}
+
+			if err := qs.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := qs.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			checkQCOW2(t, path)
+
+			qs, err = virtio.OpenQCOW2(path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer qs.Close()
+
+			got := make([]byte, img.size)
+			if n, err := qs.ReadAt(got, 0); err != nil || n != len(got) {
+				t.Fatalf("read n=%d err=%v", n, err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Error("read after reopen doesn't match writes")
+			}
+
+			if _, err := qs.WriteAt(got[:1], 0); err == nil {
+				t.Error("no error writing a read-only image")
+			}
+
+			checkReadOnlyDevice(t, qs)
+
+			if n, err := qs.ReadAt(got[:10], int64(img.size)-5); n != 5 || err != io.EOF {
+				t.Errorf("read past end: n=%d err=%v", n, err)
+			}
+		})
+	}
+}
+
+func TestQCOW2Backing(t *testing.T) {
+	dir := t.TempDir()
+
+	base := bytes.Repeat([]byte("base"), 1<<18) // 1 MiB
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// base.raw <- mid.qcow2 <- top.qcow2, with a larger virtual size
+	createQCOW2(t, filepath.Join(dir, "mid.qcow2"), qcow2Image{
+		version:       3,
+		clusterBits:   16,
+		refcountOrder: 4,
+		size:          1 << 20,
+		backing:       "base.raw",
+		backingFormat: "raw",
+	})
+
+	createQCOW2(t, filepath.Join(dir, "top.qcow2"), qcow2Image{
+		version:       3,
+		clusterBits:   12,
+		refcountOrder: 4,
+		size:          2 << 20,
+		backing:       filepath.Join(dir, "mid.qcow2"),
+	})
+
+	mid, err := virtio.OpenQCOW2(filepath.Join(dir, "mid.qcow2"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mid.WriteAt([]byte("mid!"), 1<<16+100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mid.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	top, err := virtio.OpenQCOW2(filepath.Join(dir, "top.qcow2"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer top.Close()
+
+	want := make([]byte, 2<<20)
+	copy(want, base)
+	copy(want[1<<16+100:], "mid!")
+
+	if _, err := top.WriteAt([]byte("top!"), 1<<16+200); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(want[1<<16+200:], "top!")
+
+	// a discarded cluster in an image with a backing file reads as zeroes
+	if err := top.Discard(1<<17, 1<<12); err != nil {
+		t.Fatal(err)
+	}
+
+	clear(want[1<<17 : 1<<17+1<<12])
+
+	got := make([]byte, len(want))
+	if _, err := top.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Error("top doesn't read through the backing chain")
+	}
+
+	if b, err := os.ReadFile(filepath.Join(dir, "base.raw")); err != nil || !bytes.Equal(b, base) {
+		t.Error("base changed")
+	}
+
+	checkQCOW2(t, filepath.Join(dir, "mid.qcow2"))
+	checkQCOW2(t, filepath.Join(dir, "top.qcow2"))
+}
+
+func TestQCOW2Compressed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	createQCOW2(t, path, qcow2Image{version: 3, clusterBits: 16, refcountOrder: 4, size: 1 << 20})
+
+	// allocate the L2 table and cluster 0
+	qs, err := virtio.OpenQCOW2(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := qs.WriteAt([]byte{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	qs.Close()
+
+	// append compressed data for cluster 1 at an odd offset in a new cluster
+	cluster := bytes.Repeat([]byte("compressed"), 1<<16/10+1)[:1<<16]
+
+	var zbuf bytes.Buffer
+	zw, _ := flate.NewWriter(&zbuf, flate.BestCompression)
+	zw.Write(cluster)
+	zw.Close()
+
+	img, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := uint64(len(img)) + 300
+	img = append(img, make([]byte, 300)...)
+	img = append(img, zbuf.Bytes()...)
+
+	l2 := be.Uint64(img[3<<16:]) & 0x00fffffffffffe00
+	x := uint64(62 - (16 - 8))
+	sectors := (host%512+uint64(zbuf.Len())+511)/512 - 1
+	be.PutUint64(img[l2+8:], 1<<62|sectors<<x|host)
+
+	// refcount block at cluster 2
+	putRefcount(img[2<<16:3<<16], 4, host>>16, 1)
+
+	if err := os.WriteFile(path, img, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	checkQCOW2(t, path)
+
+	qs, err = virtio.OpenQCOW2(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 1<<16)
+	if _, err := qs.ReadAt(got, 1<<16); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, cluster) {
+		t.Fatal("compressed cluster doesn't match")
+	}
+
+	// writing to a compressed cluster decompresses it into a new one
+	if _, err := qs.WriteAt([]byte("new"), 1<<16+5); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(cluster[5:], "new")
+
+	if _, err := qs.ReadAt(got, 1<<16); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, cluster) {
+		t.Error("rewritten cluster doesn't match")
+	}
+
+	qs.Close()
+	checkQCOW2(t, path)
+}
+
+func TestQCOW2Block(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	createQCOW2(t, path, qcow2Image{version: 3, clusterBits: 16, refcountOrder: 4, size: 1 << 20})
+
+	qs, err := virtio.OpenQCOW2(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer qs.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if !virtio.IsQCOW2(f) {
+		t.Error("IsQCOW2 is false")
+	}
+
+	bt := newBlkTest(t, virtio.BlockDevice{Storage: qs}, 0)
+
+	data := bytes.Repeat([]byte{0x55}, 4096)
+	if s := bt.do(1, 100, data, false); s != 0 {
+		t.Fatalf("write status %d", s)
+	}
+
+	data = make([]byte, 8192)
+	if s := bt.do(0, 96, data, true); s != 0 {
+		t.Fatalf("read status %d", s)
+	}
+
+	if !bytes.Equal(data[:2048], make([]byte, 2048)) || !bytes.Equal(data[2048:6144], bytes.Repeat([]byte{0x55}, 4096)) {
+		t.Error("read doesn't match write")
+	}
+}
+
+// checkReadOnlyDevice checks that a block device backed by stg is read-only and
+// doesn't offer discard or write zeroes.
+func checkReadOnlyDevice(t *testing.T, stg virtio.BlockStorage) {
+	t.Helper()
+
+	h, err := virtio.BlockDevice{Storage: stg}.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer h.Close()
+
+	const (
+		fRO          = 1 << 4
+		fDiscard     = 1 << 12
+		fWriteZeroes = 1 << 13
+	)
+
+	if f := h.GetFeatures(); f&fRO == 0 || f&(fDiscard|fWriteZeroes) != 0 {
+		t.Errorf("features %#x of a read-only device", f)
+	}
+}
@@ -0,0 +1,169 @@
+package virtio
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// RateLimit is a device throughput limit. Zero rates are unlimited.
+type RateLimit struct {
+
+	// BytesPerSec is the sustained data rate in bytes per second.
+	BytesPerSec int64
+
+	// BytesBurst is the number of bytes an idle device may transfer at once.
+	// If it's zero, the burst is one second of data.
+	BytesBurst int64
+
+	// OpsPerSec is the sustained request rate in requests per second.
+	OpsPerSec int64
+
+	// OpsBurst is the number of requests an idle device may make at once. If
+	// it's zero, the burst is one second of requests.
+	OpsBurst int64
+}
+
+// RateLimiter limits the throughput of one or more devices with token buckets.
+// Devices that share a limiter share its limit. The zero RateLimiter is
+// unlimited. It's safe to change the limit while the devices are running.
+type RateLimiter struct {
+	mu      sync.Mutex
+	lim     RateLimit
+	bytes   tokenBucket
+	ops     tokenBucket
+	changed chan struct{} // closed and replaced when the limit changes
+}
+
+// NewRateLimiter returns a limiter with the given limit.
+func NewRateLimiter(lim RateLimit) (*RateLimiter, error) {
+	rl := new(RateLimiter)
+	if err := rl.SetLimit(lim); err != nil {
+		return nil, err
+	}
+
+	return rl, nil
+}
+
+// Limit returns the current limit.
+func (rl *RateLimiter) Limit() RateLimit {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.lim
+}
+
+// SetLimit changes the limit. Requests waiting for the old limit are
+// reconsidered under the new one.
+func (rl *RateLimiter) SetLimit(lim RateLimit) error {
+	if lim.BytesPerSec < 0 || lim.BytesBurst < 0 || lim.OpsPerSec < 0 || lim.OpsBurst < 0 {
+		return errors.New("rate limit is negative")
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.bytes.set(now, lim.BytesPerSec, lim.BytesBurst)
+	rl.ops.set(now, lim.OpsPerSec, lim.OpsBurst)
+	rl.lim = lim
+
+	if rl.changed != nil {
+		close(rl.changed)
+		rl.changed = nil
+	}
+
+	return nil
+}
+
+// Wait blocks until a request transferring n bytes is allowed, then takes its
+// tokens. Requests larger than the burst wait for a full bucket and leave it
+// in debt. Wait returns false without taking tokens if cancel is closed first.
+func (rl *RateLimiter) Wait(n int64, cancel <-chan struct{}) bool {
+	for {
+		rl.mu.Lock()
+
+		now := time.Now()
+		delay := max(rl.bytes.delay(now, n), rl.ops.delay(now, 1))
+		if delay == 0 {
+			rl.bytes.take(n)
+			rl.ops.take(1)
+			rl.mu.Unlock()
+			return true
+		}
+
+		if rl.changed == nil {
+			rl.changed = make(chan struct{})
+		}
+
+		changed := rl.changed
+		rl.mu.Unlock()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-changed:
+			t.Stop()
+
+		case <-cancel:
+			t.Stop()
+			return false
+		}
+	}
+}
+
+// tokenBucket is one of a limiter's buckets. A zero rate is unlimited.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64 // bucket size
+	tokens float64 // may be negative after a request larger than the burst
+	last   time.Time
+}
+
+// set changes the bucket's rate and burst. A bucket that was unlimited
+// starts full.
+func (b *tokenBucket) set(now time.Time, rate, burst int64) {
+	if burst == 0 {
+		burst = rate
+	}
+
+	if b.rate == 0 {
+		b.tokens = float64(burst)
+	} else {
+		b.refill(now)
+	}
+
+	b.rate, b.burst = float64(rate), float64(burst)
+	b.tokens = min(b.tokens, b.burst)
+	b.last = now
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens = min(b.burst, b.tokens+d.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// delay returns how long until the bucket has enough tokens for n.
+func (b *tokenBucket) delay(now time.Time, n int64) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+
+	b.refill(now)
+
+	need := min(float64(n), b.burst) - b.tokens
+	if need <= 0 {
+		return 0
+	}
+
+	return max(time.Duration(need/b.rate*float64(time.Second)), time.Millisecond)
+}
+
+// take removes n tokens from the bucket.
+func (b *tokenBucket) take(n int64) {
+	if b.rate != 0 {
+		b.tokens -= float64(n)
+	}
+}
@@ -0,0 +1,122 @@
+package virtio_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/c35s/hype/virtio"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		lim   virtio.RateLimit
+		n     int64 // bytes per request
+		count int
+		min   time.Duration
+	}{
+		{"unlimited", virtio.RateLimit{}, 1 << 30, 100, 0},
+		{"ops", virtio.RateLimit{OpsPerSec: 100, OpsBurst: 1}, 0, 11, 100 * time.Millisecond},
+		{"bytes", virtio.RateLimit{BytesPerSec: 10000, BytesBurst: 1000}, 1000, 3, 200 * time.Millisecond},
+		{"large requests", virtio.RateLimit{BytesPerSec: 10000, BytesBurst: 1000}, 2000, 2, 200 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, err := virtio.NewRateLimiter(tt.lim)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			for i := 0; i < tt.count; i++ {
+				if !rl.Wait(tt.n, nil) {
+					t.Fatal("wait failed")
+				}
+			}
+
+			if d := time.Since(start); d < tt.min || d > tt.min+time.Second {
+				t.Errorf("%d requests took %v, want %v", tt.count, d, tt.min)
+			}
+		})
+	}
+
+	if _, err := virtio.NewRateLimiter(virtio.RateLimit{OpsPerSec: -1}); err == nil {
+		t.Error("no error for a negative limit")
+	}
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	rl, err := virtio.NewRateLimiter(virtio.RateLimit{OpsPerSec: 1, OpsBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rl.Wait(0, nil)
+
+	// a waiting request is released when the limit is lifted
+	doneC := make(chan bool)
+	go func() { doneC <- rl.Wait(0, nil) }()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := rl.SetLimit(virtio.RateLimit{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-doneC:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("request is still waiting after the limit was lifted")
+	}
+
+	if lim := rl.Limit(); lim != (virtio.RateLimit{}) {
+		t.Errorf("limit is %+v", lim)
+	}
+
+	// canceled waits fail
+	rl.SetLimit(virtio.RateLimit{OpsPerSec: 1, OpsBurst: 1})
+	rl.Wait(0, nil)
+
+	cancel := make(chan struct{})
+	go func() { doneC <- rl.Wait(0, cancel) }()
+	close(cancel)
+
+	if <-doneC {
+		t.Error("canceled wait succeeded")
+	}
+}
+
+func TestBlockRateLimit(t *testing.T) {
+	rl, err := virtio.NewRateLimiter(virtio.RateLimit{OpsPerSec: 50, OpsBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt := newBlkTest(t, virtio.BlockDevice{
+		Storage:     &virtio.MemStorage{Bytes: make([]byte, 1<<20)},
+		RateLimiter: rl,
+	}, 0)
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if s := bt.do(0, uint64(i), make([]byte, 512), true); s != 0 {
+			t.Fatalf("status %d", s)
+		}
+	}
+
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("6 requests at 50/s took %v", d)
+	}
+
+	// lifting the limit at runtime speeds the device up
+	rl.SetLimit(virtio.RateLimit{})
+
+	start = time.Now()
+	for i := 0; i < 20; i++ {
+		bt.do(0, uint64(i), make([]byte, 512), true)
+	}
+
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("20 unlimited requests took %v", d)
+	}
+}
@@ -0,0 +1,589 @@
+package virtio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// UringStorage is read-write block storage backed by a file. It executes reads,
+// writes, and flushes asynchronously with io_uring, and discards and write zeroes
+// with io_uring fallocate operations.
+//
+// If the file was opened with O_DIRECT, buffers that don't meet the file's direct
+// I/O memory alignment are copied through aligned memory. Offsets and lengths must
+// still be aligned: UringStorage reports the file's direct I/O offset alignment as
+// its logical block size, so the guest aligns its requests.
+type UringStorage struct {
+	File *os.File
+
+	fd    int      // io_uring fd
+	rings [][]byte // mmapped regions to unmap on close
+
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []uringSQE
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []uringCQE
+
+	direct   bool
+	memAlign int
+	offAlign int
+
+	slots chan struct{} // limits operations in flight to the ring size
+	doneC chan struct{} // closed when the completion goroutine returns
+
+	mu      sync.Mutex
+	closed  bool
+	nextID  uint64
+	pending map[uint64]*uringOp
+}
+
+// uringOp is an operation in flight. It keeps the memory the kernel may
+// access reachable until the operation completes.
+type uringOp struct {
+	iov    []unix.Iovec
+	bounce []byte
+	done   func(res int32)
+}
+
+// uringParams has the same layout as the C struct io_uring_params.
+type uringParams struct {
+	SQEntries    uint32
+	CQEntries    uint32
+	Flags        uint32
+	SQThreadCPU  uint32
+	SQThreadIdle uint32
+	Features     uint32
+	WQFd         uint32
+	_            [3]uint32
+	SQOff        uringSQOffsets
+	CQOff        uringCQOffsets
+}
+
+// uringSQOffsets has the same layout as the C struct io_sqring_offsets.
+type uringSQOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Flags       uint32
+	Dropped     uint32
+	Array       uint32
+	_           uint32
+	_           uint64
+}
+
+// uringCQOffsets has the same layout as the C struct io_cqring_offsets.
+type uringCQOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Overflow    uint32
+	CQEs        uint32
+	Flags       uint32
+	_           uint32
+	_           uint64
+}
+
+// uringSQE has the same layout as the C struct io_uring_sqe.
+type uringSQE struct {
+	Opcode      uint8
+	Flags       uint8
+	IOPrio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	_           uint64
+}
+
+// uringCQE has the same layout as the C struct io_uring_cqe.
+type uringCQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+const (
+	uringOpNop       = 0
+	uringOpReadv     = 1
+	uringOpWritev    = 2
+	uringOpFsync     = 3
+	uringOpFallocate = 17
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringFeatSingleMmap = 1 << 0
+
+	uringEnterGetEvents = 1 << 0
+
+	// uringStop is the user data of the no-op that stops the completion goroutine
+	uringStop = ^uint64(0)
+)
+
+// NewUringStorage creates an io_uring with room for the given number of
+// operations in flight, and starts a goroutine to complete them. The file is
+// not closed when the storage is closed.
+func NewUringStorage(f *os.File, entries int) (*UringStorage, error) {
+	us := &UringStorage{
+		File:    f,
+		fd:      -1,
+		doneC:   make(chan struct{}),
+		pending: make(map[uint64]*uringOp),
+	}
+
+	if err := us.setupDirect(); err != nil {
+		return nil, err
+	}
+
+	if err := us.setupRing(entries); err != nil {
+		us.unmap()
+		return nil, err
+	}
+
+	us.slots = make(chan struct{}, len(us.sqes))
+
+	go us.complete()
+	return us, nil
+}
+
+// setupDirect reads the file's direct I/O alignment if it was opened with O_DIRECT.
+func (us *UringStorage) setupDirect() error {
+	flags, err := unix.FcntlInt(us.File.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return fmt.Errorf("uring storage: get file flags: %w", err)
+	}
+
+	if flags&unix.O_DIRECT == 0 {
+		return nil
+	}
+
+	us.direct = true
+	us.memAlign, us.offAlign = 4096, 4096
+
+	var stx unix.Statx_t
+	if err := unix.Statx(int(us.File.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_DIOALIGN, &stx); err == nil &&
+		stx.Mask&unix.STATX_DIOALIGN != 0 && stx.Dio_mem_align != 0 {
+		us.memAlign, us.offAlign = int(stx.Dio_mem_align), int(max(stx.Dio_offset_align, 512))
+	}
+
+	return nil
+}
+
+// setupRing creates the io_uring and maps its rings.
+func (us *UringStorage) setupRing(entries int) error {
+	var p uringParams
+
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return fmt.Errorf("uring storage: io_uring_setup: %w", errno)
+	}
+
+	us.fd = int(fd)
+
+	var (
+		sqSz = int(p.SQOff.Array + 4*p.SQEntries)
+		cqSz = int(p.CQOff.CQEs + uint32(unsafe.Sizeof(uringCQE{}))*p.CQEntries)
+	)
+
+	if p.Features&uringFeatSingleMmap != 0 {
+		sqSz = max(sqSz, cqSz)
+	}
+
+	sq, err := us.mmap(uringOffSQRing, sqSz)
+	if err != nil {
+		return err
+	}
+
+	cq := sq
+	if p.Features&uringFeatSingleMmap == 0 {
+		if cq, err = us.mmap(uringOffCQRing, cqSz); err != nil {
+			return err
+		}
+	}
+
+	sqes, err := us.mmap(uringOffSQEs, int(p.SQEntries)*int(unsafe.Sizeof(uringSQE{})))
+	if err != nil {
+		return err
+	}
+
+	us.sqHead = (*uint32)(unsafe.Pointer(&sq[p.SQOff.Head]))
+	us.sqTail = (*uint32)(unsafe.Pointer(&sq[p.SQOff.Tail]))
+	us.sqMask = *(*uint32)(unsafe.Pointer(&sq[p.SQOff.RingMask]))
+	us.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&sq[p.SQOff.Array])), p.SQEntries)
+	us.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&sqes[0])), p.SQEntries)
+
+	us.cqHead = (*uint32)(unsafe.Pointer(&cq[p.CQOff.Head]))
+	us.cqTail = (*uint32)(unsafe.Pointer(&cq[p.CQOff.Tail]))
+	us.cqMask = *(*uint32)(unsafe.Pointer(&cq[p.CQOff.RingMask]))
+	us.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&cq[p.CQOff.CQEs])), p.CQEntries)
+
+	return nil
+}
+
+func (us *UringStorage) mmap(off int64, size int) ([]byte, error) {
+	b, err := unix.Mmap(us.fd, off, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, fmt.Errorf("uring storage: mmap ring: %w", err)
+	}
+
+	us.rings = append(us.rings, b)
+	return b, nil
+}
+
+// unmap unmaps the rings and closes the io_uring.
+func (us *UringStorage) unmap() {
+	for _, b := range us.rings {
+		unix.Munmap(b)
+	}
+
+	if us.fd >= 0 {
+		unix.Close(us.fd)
+	}
+}
+
+// Close waits for the operations in flight to complete, then closes the io_uring.
+// It doesn't close the file.
+func (us *UringStorage) Close() error {
+	us.slots <- struct{}{}
+	if err := us.submit(uringSQE{Opcode: uringOpNop, UserData: uringStop}, nil); err != nil {
+		return err
+	}
+
+	us.mu.Lock()
+	us.closed = true
+	us.mu.Unlock()
+
+	<-us.doneC
+	us.unmap()
+	return nil
+}
+
+// submit submits sqe. If op is not nil, it is completed when the kernel posts the
+// sqe's completion. The caller must hold a slot.
+func (us *UringStorage) submit(sqe uringSQE, op *uringOp) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if us.closed {
+		<-us.slots
+		return os.ErrClosed
+	}
+
+	if op != nil {
+		us.nextID++
+		sqe.UserData = us.nextID
+		us.pending[sqe.UserData] = op
+	}
+
+	// the slots keep the submission queue from filling up
+	tail := *us.sqTail
+	idx := tail & us.sqMask
+	us.sqes[idx] = sqe
+	us.sqArray[idx] = idx
+	atomic.StoreUint32(us.sqTail, tail+1)
+
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(us.fd), 1, 0, 0, 0, 0)
+		switch errno {
+		case 0:
+			return nil
+
+		case unix.EINTR:
+			continue
+
+		default:
+			// the kernel didn't consume the sqe
+			atomic.StoreUint32(us.sqTail, tail)
+			delete(us.pending, sqe.UserData)
+			<-us.slots
+			return fmt.Errorf("uring storage: io_uring_enter: %w", errno)
+		}
+	}
+}
+
+// complete waits for completions and calls their operations' done funcs. It
+// returns after the stop no-op completes and nothing else is pending.
+func (us *UringStorage) complete() {
+	defer close(us.doneC)
+
+	var stopping bool
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(us.fd), 0, 1, uringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != unix.EINTR {
+			slog.Error("uring storage: wait for completions", "err", errno)
+			return
+		}
+
+		head := atomic.LoadUint32(us.cqHead)
+		tail := atomic.LoadUint32(us.cqTail)
+
+		for ; head != tail; head++ {
+			cqe := us.cqes[head&us.cqMask]
+			atomic.StoreUint32(us.cqHead, head+1)
+
+			<-us.slots
+
+			if cqe.UserData == uringStop {
+				stopping = true
+				continue
+			}
+
+			us.mu.Lock()
+			op := us.pending[cqe.UserData]
+			delete(us.pending, cqe.UserData)
+			us.mu.Unlock()
+
+			if op != nil {
+				op.done(cqe.Res)
+			}
+		}
+
+		us.mu.Lock()
+		idle := len(us.pending) == 0
+		us.mu.Unlock()
+
+		if stopping && idle {
+			return
+		}
+	}
+}
+
+// rw reads into or writes bufs at off, resubmitting short transfers.
+func (us *UringStorage) rw(opcode uint8, bufs [][]byte, off int64, done func(n int, err error)) {
+	total := sgLen(bufs)
+	if total == 0 {
+		done(0, nil)
+		return
+	}
+
+	op := &uringOp{}
+
+	// direct I/O needs aligned memory
+	var bounce []byte
+	if us.direct && !us.aligned(bufs) {
+		bounce = alignedBuf(total, us.memAlign)
+		if opcode == uringOpWritev {
+			sgCopy([][]byte{bounce}, bufs...)
+		}
+
+		op.bounce = bounce
+		op.iov = iovecs([][]byte{bounce})
+	} else {
+		op.iov = iovecs(bufs)
+	}
+
+	op.done = func(res int32) {
+		n, err := int(res), error(nil)
+
+		switch {
+		case res < 0:
+			n, err = 0, unix.Errno(-res)
+
+		case res == 0:
+			err = io.ErrUnexpectedEOF
+		}
+
+		if bounce != nil && opcode == uringOpReadv {
+			sgCopy(bufs, bounce[:n])
+		}
+
+		if err != nil || n == total {
+			done(n, err)
+			return
+		}
+
+		// short transfer: submit the rest from another goroutine, since this
+		// one must keep completing operations to free the slots
+		go us.rw(opcode, sgSkip(bufs, n), off+int64(n), func(m int, err error) {
+			done(n+m, err)
+		})
+	}
+
+	us.slots <- struct{}{}
+	err := us.submit(uringSQE{
+		Opcode: opcode,
+		Fd:     int32(us.File.Fd()),
+		Off:    uint64(off),
+		Addr:   uint64(uintptr(unsafe.Pointer(&op.iov[0]))),
+		Len:    uint32(len(op.iov)),
+	}, op)
+
+	if err != nil {
+		done(0, err)
+	}
+}
+
+// aligned returns true if bufs meet the direct I/O memory alignment.
+func (us *UringStorage) aligned(bufs [][]byte) bool {
+	for _, b := range bufs {
+		if len(b) > 0 && (uintptr(unsafe.Pointer(&b[0]))%uintptr(us.memAlign) != 0 || len(b)%us.offAlign != 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// do submits an operation without buffers and calls done with its result.
+func (us *UringStorage) do(sqe uringSQE, done func(err error)) {
+	op := &uringOp{
+		done: func(res int32) {
+			if res < 0 {
+				done(unix.Errno(-res))
+				return
+			}
+
+			done(nil)
+		},
+	}
+
+	sqe.Fd = int32(us.File.Fd())
+
+	us.slots <- struct{}{}
+	if err := us.submit(sqe, op); err != nil {
+		done(err)
+	}
+}
+
+// wait calls start and waits for it to call its done func.
+func wait(start func(done func(n int, err error))) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+
+	c := make(chan result, 1)
+	start(func(n int, err error) { c <- result{n, err} })
+
+	r := <-c
+	return r.n, r.err
+}
+
+// ReadAsync reads into bufs from the file at off.
+func (us *UringStorage) ReadAsync(bufs [][]byte, off int64, done func(n int, err error)) {
+	us.rw(uringOpReadv, bufs, off, done)
+}
+
+// WriteAsync writes bufs to the file at off.
+func (us *UringStorage) WriteAsync(bufs [][]byte, off int64, done func(n int, err error)) {
+	us.rw(uringOpWritev, bufs, off, done)
+}
+
+// SyncAsync commits the file's contents to durable storage.
+func (us *UringStorage) SyncAsync(done func(err error)) {
+	us.do(uringSQE{Opcode: uringOpFsync}, done)
+}
+
+// ReadAt reads from the file at off, waiting for the read to complete.
+func (us *UringStorage) ReadAt(p []byte, off int64) (int, error) {
+	n, err := wait(func(done func(int, error)) { us.ReadAsync([][]byte{p}, off, done) })
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// WriteAt writes to the file at off, waiting for the write to complete.
+func (us *UringStorage) WriteAt(p []byte, off int64) (int, error) {
+	return wait(func(done func(int, error)) { us.WriteAsync([][]byte{p}, off, done) })
+}
+
+// Size stats the file and returns its size in bytes.
+func (us *UringStorage) Size() (int64, error) {
+	info, err := us.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// Sync commits the file's contents to durable storage, waiting for the fsync to complete.
+func (us *UringStorage) Sync() error {
+	_, err := wait(func(done func(int, error)) {
+		us.SyncAsync(func(err error) { done(0, err) })
+	})
+
+	return err
+}
+
+// Discard punches a hole in the file, deallocating n bytes at off.
+func (us *UringStorage) Discard(off, n int64) error {
+	return us.fallocate(unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+}
+
+// WriteZeroesAt zeroes n bytes of the file at off.
+func (us *UringStorage) WriteZeroesAt(off, n int64) error {
+	err := us.fallocate(unix.FALLOC_FL_ZERO_RANGE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+	if !errors.Is(err, unix.EOPNOTSUPP) {
+		return err
+	}
+
+	// punched holes read as zeroes
+	return us.Discard(off, n)
+}
+
+func (us *UringStorage) fallocate(mode uint32, off, n int64) error {
+	_, err := wait(func(done func(int, error)) {
+		us.do(uringSQE{
+			Opcode: uringOpFallocate,
+			Off:    uint64(off),
+			Addr:   uint64(n),
+			Len:    mode,
+		}, func(err error) { done(0, err) })
+	})
+
+	return err
+}
+
+// Topology reports the file's direct I/O offset alignment as the logical block size.
+func (us *UringStorage) Topology() BlockTopology {
+	if !us.direct {
+		return BlockTopology{}
+	}
+
+	return BlockTopology{LogicalBlockSize: uint32(us.offAlign)}
+}
+
+// iovecs returns an iovec for each non-empty buffer in bufs.
+func iovecs(bufs [][]byte) []unix.Iovec {
+	iov := make([]unix.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) > 0 {
+			iov = append(iov, unix.Iovec{Base: &b[0], Len: uint64(len(b))})
+		}
+	}
+
+	return iov
+}
+
+// alignedBuf returns a buffer of size n whose address is a multiple of align.
+func alignedBuf(n, align int) []byte {
+	b := make([]byte, n+align)
+	off := align - int(uintptr(unsafe.Pointer(&b[0]))%uintptr(align))
+	return b[off%align:][:n]
+}
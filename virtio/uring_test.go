@@ -0,0 +1,179 @@
+package virtio_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/c35s/hype/virtio"
+	"golang.org/x/sys/unix"
+)
+
+// newUringStorage creates uring storage for a file of size bytes of 0xaa,
+// skipping the test if io_uring is unavailable.
+func newUringStorage(t *testing.T, size int, flag int) *virtio.UringStorage {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(name, bytes.Repeat([]byte{0xaa}, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|flag, 0)
+	if err != nil {
+		if flag&unix.O_DIRECT != 0 && errors.Is(err, unix.EINVAL) {
+			t.Skip("direct I/O is unsupported:", err)
+		}
+
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { f.Close() })
+
+	us, err := virtio.NewUringStorage(f, 32)
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+		t.Skip("io_uring is unavailable:", err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := us.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return us
+}
+
+func TestUringStorage(t *testing.T) {
+	us := newUringStorage(t, 1<<16, 0)
+
+	if sz, err := us.Size(); err != nil || sz != 1<<16 {
+		t.Fatalf("size %d, %v", sz, err)
+	}
+
+	// concurrent vectored writes, then read everything back
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		i := i
+		wg.Add(1)
+		us.WriteAsync([][]byte{
+			bytes.Repeat([]byte{byte(i)}, 1024),
+			bytes.Repeat([]byte{byte(i) + 1}, 3072),
+		}, int64(i)*4096, func(n int, err error) {
+			defer wg.Done()
+			if err != nil || n != 4096 {
+				t.Errorf("write %d: n=%d err=%v", i, n, err)
+			}
+		})
+	}
+
+	wg.Wait()
+
+	if err := us.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 1<<16)
+	if n, err := us.ReadAt(p, 0); err != nil || n != len(p) {
+		t.Fatalf("read n=%d err=%v", n, err)
+	}
+
+	for i := 0; i < 16; i++ {
+		blk := p[i*4096:]
+		if blk[0] != byte(i) || blk[1023] != byte(i) || blk[1024] != byte(i)+1 || blk[4095] != byte(i)+1 {
+			t.Errorf("block %d has %d %d", i, blk[0], blk[1024])
+		}
+	}
+
+	// reading past the end is a short read
+	if n, err := us.ReadAt(p[:1024], 1<<16-512); n != 512 || err == nil {
+		t.Errorf("read past end: n=%d err=%v", n, err)
+	}
+
+	if err := us.WriteZeroesAt(0, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := us.Discard(4096, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := us.ReadAt(p[:8192], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p[:8192], make([]byte, 8192)) {
+		t.Error("zeroed and discarded blocks aren't zero")
+	}
+}
+
+func TestUringStorageDirect(t *testing.T) {
+	us := newUringStorage(t, 1<<16, unix.O_DIRECT)
+
+	lbs := int(us.Topology().LogicalBlockSize)
+	if lbs < 512 {
+		t.Fatalf("logical block size %d < 512", lbs)
+	}
+
+	// a misaligned buffer is bounced
+	buf := make([]byte, lbs+1)[1:]
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+
+	if n, err := us.WriteAt(buf, int64(lbs)); err != nil || n != lbs {
+		t.Fatalf("write n=%d err=%v", n, err)
+	}
+
+	p := make([]byte, 2*lbs+1)[1:]
+	if _, err := us.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p[:lbs], bytes.Repeat([]byte{0xaa}, lbs)) || !bytes.Equal(p[lbs:], buf) {
+		t.Error("read doesn't match write")
+	}
+}
+
+func TestBlockUring(t *testing.T) {
+	us := newUringStorage(t, 1<<16, 0)
+
+	h, err := virtio.BlockDevice{Storage: us}.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	features := h.GetFeatures()
+	h.Close()
+
+	bt := newBlkTest(t, virtio.BlockDevice{Storage: us}, features)
+
+	data := bytes.Repeat([]byte{0x55}, 2048)
+	if s := bt.do(1, 4, data, false); s != 0 {
+		t.Fatalf("write status %d", s)
+	}
+
+	if s := bt.do(4, 0, nil, false); s != 0 {
+		t.Fatalf("flush status %d", s)
+	}
+
+	data = make([]byte, 4096)
+	if s := bt.do(0, 0, data, true); s != 0 {
+		t.Fatalf("read status %d", s)
+	}
+
+	if !bytes.Equal(data[:2048], bytes.Repeat([]byte{0xaa}, 2048)) || !bytes.Equal(data[2048:], bytes.Repeat([]byte{0x55}, 2048)) {
+		t.Error("read doesn't match write")
+	}
+
+	if s := bt.do(0, 127, make([]byte, 1024), true); s != 1 {
+		t.Errorf("out of range read: status %d != ioerr", s)
+	}
+}
@@ -18,13 +18,16 @@ type DeviceHandler interface {
 	// GetFeatures returns additional feature bits supported by the device.
 	GetFeatures() uint64
 
-	// Ready is called after feature negotiation is complete.
-	Ready(negotiatedFeatures uint64) error
+	// Ready is called after feature negotiation is complete. The handler may
+	// call configChanged from any goroutine, but not from its own methods, after
+	// it changes the device configuration. The bus bumps the config generation
+	// and sends a configuration change notification to the driver.
+	Ready(negotiatedFeatures uint64, configChanged func()) error
 
 	// QueueReady is called when a new virtqueue is available. The bus
 	// sends to the given notify channel when there are new buffers in
 	// the queue.
-	QueueReady(num int, q *virtq.Queue, notify <-chan struct{}) error
+	QueueReady(num int, q virtq.Queue, notify <-chan struct{}) error
 
 	// ReadConfig reads the device configuration register at off into p.
 	ReadConfig(p []byte, off int) error
@@ -33,6 +36,16 @@ type DeviceHandler interface {
 	Close() error
 }
 
+// ConfigWriter is implemented by device handlers with writable configuration
+// fields. The bus rejects configuration writes to handlers that don't implement it.
+type ConfigWriter interface {
+
+	// WriteConfig writes p to the device configuration register at off. If the
+	// write changes other configuration fields, WriteConfig returns changed=true
+	// and the bus sends a configuration change notification.
+	WriteConfig(p []byte, off int) (changed bool, err error)
+}
+
 // DeviceID identifies the type of a virtio device.
 type DeviceID uint32
 
@@ -134,7 +147,11 @@ const (
 )
 
 // RequiredFeatures are the feature bits negotiated for all virtio devices.
-const RequiredFeatures = FVersion1 | FRingPacked | FIndirectDesc | FEventIdx
+const RequiredFeatures = FVersion1
+
+// OptionalFeatures are the feature bits offered by all virtio devices. The driver
+// may decline them. If FRingPacked is declined, the device uses split virtqueues.
+const OptionalFeatures = FRingPacked | FIndirectDesc | FEventIdx
 
 func (id DeviceID) String() string {
 	switch id {
@@ -0,0 +1,300 @@
+package virtq
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// PackedQueue is a packed virtqueue.
+type PackedQueue struct {
+	cfg  Config
+	ring []Desc
+	drvE *EventSuppress
+	devE *EventSuppress
+
+	mu    sync.Mutex
+	aidx  uint16 // next available descriptor
+	awrap bool   // driver ring wrap counter
+	uidx  uint16 // next used descriptor
+	uwrap bool   // device ring wrap counter
+	fidx  uint16 // uidx at the last flush
+	fwrap bool   // uwrap at the last flush
+	nused int    // descriptors used since the last flush
+	off   bool   // available buffer notifications are disabled
+}
+
+// EventSuppress is the driver or device event suppression area for a packed virtqueue.
+type EventSuppress struct {
+	Desc  uint16
+	Flags uint16
+}
+
+const (
+	eventFlagsEnable  = 0x0 // enable events
+	eventFlagsDisable = 0x1 // disable events
+	eventFlagsDesc    = 0x2 // enable events for a specific descriptor
+	_                 = 0x3 // reserved
+)
+
+// NewPacked returns a new packed virtqueue backed by the given ring and event
+// suppression areas.
+func NewPacked(ring []Desc, drvE, devE *EventSuppress, cfg Config) *PackedQueue {
+	return &PackedQueue{
+		cfg:   cfg,
+		ring:  ring,
+		drvE:  drvE,
+		devE:  devE,
+		awrap: true,
+		uwrap: true,
+		fwrap: true,
+	}
+}
+
+// Next returns the next available descriptor chain, or nil if no descriptors
+// are available. It returns an error if the queue's MemAt callback fails while
+// resolving an indirect descriptor, or if an indirect descriptor has a
+// malformed buffer. The chain's descriptors are copied from the ring, so they
+// remain valid while other chains are used.
+func (q *PackedQueue) Next() (avail *Chain, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.ring) == 0 {
+		return
+	}
+
+	i, ok := q.advance()
+
+	if !ok {
+		return
+	}
+
+	defer q.armEvent()
+
+	c := &Chain{
+		q:    q,
+		skip: 1,
+		Desc: []Desc{q.ring[i]},
+	}
+
+	for q.ring[i].Continues() {
+		if q.ring[i].IsIndirect() {
+			return nil, errors.New("indirect descriptor continues")
+		}
+
+		if len(c.Desc) == len(q.ring) {
+			return nil, errors.New("descriptor chain is longer than the ring")
+		}
+
+		i, ok = q.advance()
+
+		if !ok {
+			return nil, errors.New("descriptor continues but no next descriptor is available")
+		}
+
+		c.Desc = append(c.Desc, q.ring[i])
+	}
+
+	c.skip = uint16(len(c.Desc))
+
+	// "The Buffer ID is included in the last descriptor in the list."
+	last := c.Desc[len(c.Desc)-1]
+	c.id = last.ID
+
+	if last.IsIndirect() {
+		if len(c.Desc) > 1 {
+			return nil, errors.New("misplaced indirect descriptor")
+		}
+
+		data, err := getIndirect(q.cfg, last)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Desc = make([]Desc, len(data)/16)
+		for j := range c.Desc {
+			c.Desc[j] = Desc{
+				Addr:  le.Uint64(data[16*j:]),
+				Len:   le.Uint32(data[16*j+8:]),
+				ID:    le.Uint16(data[16*j+12:]),
+				Flags: le.Uint16(data[16*j+14:]),
+			}
+
+			if c.Desc[j].IsIndirect() {
+				return nil, errors.New("nested indirect descriptor")
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// Flush sends a used buffer notification if any chains were used since the
+// last flush and the driver's event suppression area allows it.
+func (q *PackedQueue) Flush() error {
+	q.mu.Lock()
+	notify := q.shouldNotify()
+	q.fidx, q.fwrap, q.nused = q.uidx, q.uwrap, 0
+	q.mu.Unlock()
+
+	if notify {
+		return q.cfg.Notify()
+	}
+
+	return nil
+}
+
+// DisableNotify asks the driver not to send available buffer notifications.
+func (q *PackedQueue) DisableNotify() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.off = true
+	q.setDevE(0, eventFlagsDisable)
+}
+
+// EnableNotify asks the driver to send available buffer notifications again. It
+// returns true if a descriptor became available before notifications were enabled.
+func (q *PackedQueue) EnableNotify() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.off = false
+	q.armEvent()
+
+	if len(q.ring) == 0 {
+		return false
+	}
+
+	// the store in setDevE is ordered before this load
+	v := atomic.LoadUint32((*uint32)(unsafe.Pointer(&q.ring[q.aidx].ID)))
+	a := v&(DescFAvail<<16) != 0
+	u := v&(DescFUsed<<16) != 0
+	return a != u && a == q.awrap
+}
+
+// armEvent writes the device event suppression area to ask for a notification
+// about the next available descriptor, unless notifications are disabled.
+func (q *PackedQueue) armEvent() {
+	switch {
+	case q.off:
+		return
+
+	case q.cfg.EventIdx:
+		desc := q.aidx
+		if q.awrap {
+			desc |= 1 << 15
+		}
+
+		q.setDevE(desc, eventFlagsDesc)
+
+	default:
+		q.setDevE(0, eventFlagsEnable)
+	}
+}
+
+// setDevE publishes the device event suppression area's descriptor and flags together.
+func (q *PackedQueue) setDevE(desc, flags uint16) {
+	if q.devE != nil {
+		atomic.StoreUint32((*uint32)(unsafe.Pointer(q.devE)), uint32(desc)|uint32(flags)<<16)
+	}
+}
+
+func (q *PackedQueue) getBuf(d Desc) ([]byte, error) {
+	return getBuf(q.cfg, d)
+}
+
+func (q *PackedQueue) advance() (index uint16, ok bool) {
+	a := q.ring[q.aidx].Flags&DescFAvail != 0
+	u := q.ring[q.aidx].Flags&DescFUsed != 0
+	if a == u || a != q.awrap {
+		return
+	}
+
+	index = q.aidx
+	ok = true
+
+	q.aidx++
+	if q.aidx == uint16(len(q.ring)) {
+		q.aidx = 0
+		q.awrap = !q.awrap
+	}
+
+	return
+}
+
+// use writes a used descriptor for c at the next used position, which may be
+// anywhere in the ring if chains are used out of order.
+func (q *PackedQueue) use(c *Chain, bytesWritten int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if c.used {
+		return errUsed
+	}
+
+	c.used = true
+
+	var flags uint16
+
+	if q.uwrap {
+		flags |= DescFAvail | DescFUsed
+	}
+
+	if bytesWritten > 0 {
+		flags |= DescFWrite
+	}
+
+	d := &q.ring[q.uidx]
+	d.Len = uint32(bytesWritten)
+
+	// publish the id and flags together, after the length
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&d.ID)), uint32(c.id)|uint32(flags)<<16)
+
+	q.uidx += c.skip
+	q.nused += int(c.skip)
+	if q.uidx >= uint16(len(q.ring)) {
+		q.uidx -= uint16(len(q.ring))
+		q.uwrap = !q.uwrap
+	}
+
+	return nil
+}
+
+// shouldNotify returns true if the driver wants a notification for the
+// descriptors used since the last flush.
+func (q *PackedQueue) shouldNotify() bool {
+	if q.nused == 0 || q.drvE == nil {
+		return false
+	}
+
+	switch e := *q.drvE; e.Flags {
+	case eventFlagsEnable:
+		return true
+
+	case eventFlagsDesc:
+		if q.nused >= len(q.ring) {
+			return true
+		}
+
+		// distance from the last flush to the event descriptor
+		dist := int(e.Desc&^(1<<15)) - int(q.fidx)
+		if (e.Desc>>15 == 1) != q.fwrap {
+			dist += len(q.ring)
+		}
+
+		return dist >= 0 && dist < q.nused
+
+	default:
+		return false
+	}
+}
+
+// ShouldNotify returns true if a notification should be sent for the given
+// descriptor index and wrap counter, or false if the event is suppressed.
+func (e EventSuppress) ShouldNotify(index uint16, wrap bool) bool {
+	return e.Flags == eventFlagsEnable || (e.Flags == eventFlagsDesc &&
+		e.Desc&^(1<<15) == index && (e.Desc>>15 == 1) == wrap)
+}
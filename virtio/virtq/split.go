@@ -0,0 +1,289 @@
+package virtq
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// SplitQueue is a split virtqueue.
+type SplitQueue struct {
+	cfg  Config
+	desc []SplitDesc
+
+	// avail aliases the driver area: flags, idx, ring[len(desc)], used_event
+	avail   []uint16
+	availFI *uint32
+
+	// used aliases the device area: flags and idx, ring[len(desc)], avail_event
+	usedFI     *uint32
+	usedRing   []usedElem
+	availEvent *uint16
+
+	mu     sync.Mutex
+	aidx   uint16 // next available ring index
+	uidx   uint16 // next used ring index
+	fidx   uint16 // uidx at the last flush
+	uflags uint16 // used ring flags
+	off    bool   // available buffer notifications are disabled
+}
+
+// SplitDesc is a split virtqueue descriptor.
+type SplitDesc struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+// usedElem is an element of a split virtqueue's used ring.
+type usedElem struct {
+	ID  uint32
+	Len uint32
+}
+
+const (
+	availFNoInterrupt = 1 // the driver doesn't want used buffer notifications
+	usedFNoNotify     = 1 // the device doesn't want available buffer notifications
+)
+
+// SplitDriverAreaSize returns the size in bytes of the driver area (the available
+// ring) of a split virtqueue with n descriptors.
+func SplitDriverAreaSize(n int) int {
+	return 2*3 + 2*n
+}
+
+// SplitDeviceAreaSize returns the size in bytes of the device area (the used ring)
+// of a split virtqueue with n descriptors.
+func SplitDeviceAreaSize(n int) int {
+	return 2*3 + 8*n
+}
+
+// NewSplit returns a new split virtqueue backed by the given descriptor table, driver
+// area, and device area. It returns an error if the number of descriptors is not a
+// power of 2 or if either area is too small for the table.
+func NewSplit(desc []SplitDesc, drvA, devA []byte, cfg Config) (*SplitQueue, error) {
+	n := len(desc)
+	q := &SplitQueue{cfg: cfg, desc: desc}
+
+	if n == 0 {
+		return q, nil
+	}
+
+	if n&(n-1) != 0 || n > 1<<15 {
+		return nil, errors.New("split queue size is not a power of 2 <= 32768")
+	}
+
+	if len(drvA) < SplitDriverAreaSize(n) || len(devA) < SplitDeviceAreaSize(n) {
+		return nil, errors.New("split queue area is too small")
+	}
+
+	q.avail = unsafe.Slice((*uint16)(unsafe.Pointer(&drvA[0])), n+3)
+	q.availFI = (*uint32)(unsafe.Pointer(&drvA[0]))
+	q.usedFI = (*uint32)(unsafe.Pointer(&devA[0]))
+	q.usedRing = unsafe.Slice((*usedElem)(unsafe.Pointer(&devA[4])), n)
+	q.availEvent = (*uint16)(unsafe.Pointer(&devA[4+8*n]))
+
+	return q, nil
+}
+
+// Next returns the next available descriptor chain, or nil if no descriptors
+// are available. It returns an error if the queue's MemAt callback fails while
+// resolving an indirect descriptor, or if the chain is malformed.
+func (q *SplitQueue) Next() (*Chain, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.desc)
+	if n == 0 {
+		return nil, nil
+	}
+
+	idx := q.availIdx()
+	if q.aidx == idx {
+		return nil, nil
+	}
+
+	if idx-q.aidx > uint16(n) {
+		return nil, errors.New("available ring idx is out of range")
+	}
+
+	head := q.avail[2+int(q.aidx)%n]
+	q.aidx++
+
+	if q.cfg.EventIdx && !q.off {
+		*q.availEvent = q.aidx
+	}
+
+	desc, err := q.walk(q.desc, head, false)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Chain{
+		q:    q,
+		id:   head,
+		Desc: desc,
+	}
+
+	return c, nil
+}
+
+// walk follows the chain starting at table[i], converting each descriptor.
+func (q *SplitQueue) walk(table []SplitDesc, i uint16, indirect bool) ([]Desc, error) {
+	var desc []Desc
+	for {
+		if int(i) >= len(table) {
+			return nil, errors.New("descriptor index out of range")
+		}
+
+		if len(desc) == len(table) {
+			return nil, errors.New("descriptor chain loops")
+		}
+
+		d := table[i]
+
+		if d.Flags&DescFIndirect != 0 {
+			if indirect || len(desc) > 0 || d.Flags&DescFNext != 0 {
+				return nil, errors.New("misplaced indirect descriptor")
+			}
+
+			data, err := getIndirect(q.cfg, Desc{Addr: d.Addr, Len: d.Len})
+			if err != nil {
+				return nil, err
+			}
+
+			it := make([]SplitDesc, len(data)/16)
+			for j := range it {
+				it[j] = SplitDesc{
+					Addr:  le.Uint64(data[16*j:]),
+					Len:   le.Uint32(data[16*j+8:]),
+					Flags: le.Uint16(data[16*j+12:]),
+					Next:  le.Uint16(data[16*j+14:]),
+				}
+			}
+
+			return q.walk(it, 0, true)
+		}
+
+		desc = append(desc, Desc{
+			Addr:  d.Addr,
+			Len:   d.Len,
+			Flags: d.Flags,
+		})
+
+		if d.Flags&DescFNext == 0 {
+			return desc, nil
+		}
+
+		i = d.Next
+	}
+}
+
+func (q *SplitQueue) getBuf(d Desc) ([]byte, error) {
+	return getBuf(q.cfg, d)
+}
+
+// Flush sends a used buffer notification if any chains were used since the last
+// flush and the driver wants to be notified about them.
+func (q *SplitQueue) Flush() error {
+	q.mu.Lock()
+	notify := q.shouldNotify(q.fidx, q.uidx)
+	q.fidx = q.uidx
+	q.mu.Unlock()
+
+	if notify {
+		return q.cfg.Notify()
+	}
+
+	return nil
+}
+
+// DisableNotify asks the driver not to send available buffer notifications.
+// With VIRTIO_F_EVENT_IDX, the avail_event field simply stops advancing.
+func (q *SplitQueue) DisableNotify() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.off = true
+
+	if len(q.desc) > 0 && !q.cfg.EventIdx {
+		q.uflags |= usedFNoNotify
+		q.publish()
+	}
+}
+
+// EnableNotify asks the driver to send available buffer notifications again. It
+// returns true if a chain became available before notifications were enabled.
+func (q *SplitQueue) EnableNotify() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.off = false
+
+	if len(q.desc) == 0 {
+		return false
+	}
+
+	if q.cfg.EventIdx {
+		*q.availEvent = q.aidx
+	} else {
+		q.uflags &^= usedFNoNotify
+	}
+
+	// the atomic store orders the writes above before the avail idx load
+	q.publish()
+	return q.aidx != q.availIdx()
+}
+
+// availIdx atomically reads the available ring's idx. The load orders the
+// driver's writes to the ring and descriptors before the reads that follow it.
+func (q *SplitQueue) availIdx() uint16 {
+	return uint16(atomic.LoadUint32(q.availFI) >> 16)
+}
+
+// publish atomically writes the used ring's flags and idx.
+func (q *SplitQueue) publish() {
+	atomic.StoreUint32(q.usedFI, uint32(q.uflags)|uint32(q.uidx)<<16)
+}
+
+// use appends c to the used ring. The ring's elements identify their chains, so
+// chains may be used in any order.
+func (q *SplitQueue) use(c *Chain, bytesWritten int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if c.used {
+		return errUsed
+	}
+
+	c.used = true
+
+	q.usedRing[int(q.uidx)%len(q.usedRing)] = usedElem{
+		ID:  uint32(c.id),
+		Len: uint32(bytesWritten),
+	}
+
+	q.uidx++
+
+	// publish the new used idx after the element
+	q.publish()
+
+	return nil
+}
+
+// shouldNotify returns true if the driver wants a notification after the used
+// idx moves from old to new.
+func (q *SplitQueue) shouldNotify(old, new uint16) bool {
+	if old == new {
+		return false
+	}
+
+	if q.cfg.EventIdx {
+		e := q.avail[2+len(q.desc)]
+		return new-e-1 < new-old
+	}
+
+	return uint16(atomic.LoadUint32(q.availFI))&availFNoInterrupt == 0
+}
@@ -1,38 +1,67 @@
-// Package virtq partially implements packed virtqueues as described by the Virtual I/O
-// Device (VIRTIO) Version 1.2 spec. Split virtqueues are not supported.
+// Package virtq partially implements packed and split virtqueues as described by the
+// Virtual I/O Device (VIRTIO) Version 1.2 spec.
 package virtq
 
 import (
+	"encoding/binary"
 	"errors"
-	"unsafe"
 )
 
+// errUsed is returned when a chain is used twice.
+var errUsed = errors.New("chain is already used")
+
+var le = binary.LittleEndian
+
+// maxIndirect is the maximum number of descriptors in an indirect table.
+const maxIndirect = 1 << 15
+
 type Config struct {
 	MemAt  func(addr uint64, len int) ([]byte, error)
 	Notify func() error
+
+	// EventIdx is true if VIRTIO_F_EVENT_IDX was negotiated.
+	EventIdx bool
 }
 
-// Queue is a packed virtqueue.
-type Queue struct {
-	cfg  Config
-	ring []Desc
-	drvE *EventSuppress
-	devE *EventSuppress
+// Queue is a packed or split virtqueue. Its methods, and the methods of its chains,
+// are safe to call from multiple goroutines. Chains may be used in any order.
+type Queue interface {
+
+	// Next returns the next available descriptor chain, or nil if no descriptors
+	// are available. It returns an error if the queue's MemAt callback fails while
+	// resolving an indirect descriptor, or if the driver made a malformed chain.
+	Next() (*Chain, error)
+
+	// Flush sends a used buffer notification if any chains were used since the
+	// last flush and the driver wants to be notified about them. It returns an
+	// error if the queue's Notify callback fails.
+	Flush() error
+
+	// DisableNotify asks the driver not to send available buffer notifications.
+	// Call it before processing a batch of chains. The driver may ignore it.
+	DisableNotify()
 
-	aidx uint16
-	uidx uint16
-	wrap bool
+	// EnableNotify asks the driver to send available buffer notifications again.
+	// It returns true if chains became available before notifications were
+	// enabled. The driver may not notify about those chains, so the caller must
+	// disable notifications and process them.
+	EnableNotify() bool
+
+	getBuf(d Desc) ([]byte, error)
+	use(c *Chain, bytesWritten int) error
 }
 
-// Chain is a descriptor chain in a packed virtqueue.
+// Chain is a descriptor chain in a virtqueue.
 type Chain struct {
-	q    *Queue
+	q    Queue
 	id   uint16
 	skip uint16
+	used bool
 	Desc []Desc
 }
 
-// Desc is a packed virtqueue descriptor.
+// Desc is a virtqueue descriptor. It has the same layout as a packed virtqueue
+// descriptor. Descriptors from split virtqueues are converted to this layout.
 type Desc struct {
 	Addr  uint64
 	Len   uint32
@@ -40,12 +69,6 @@ type Desc struct {
 	Flags uint16
 }
 
-// EventSuppress is the driver or device event suppression area for a packed virtqueue.
-type EventSuppress struct {
-	Desc  uint16
-	Flags uint16
-}
-
 const (
 	DescFNext     = 1 // buffer continues in the next descriptor
 	DescFWrite    = 2 // buffer is device wo (otherwise ro)
@@ -54,150 +77,6 @@ const (
 	DescFUsed     = 1 << 15
 )
 
-const (
-	eventFlagsEnable  = 0x0 // enable events
-	eventFlagsDisable = 0x1 // disable events
-	eventFlagsDesc    = 0x2 // enable events for a specific descriptor
-	_                 = 0x3 // reserved
-)
-
-// New returns a new virtqueue backed by the given ring and event suppression areas.
-func New(ring []Desc, drvE, devE *EventSuppress, cfg Config) *Queue {
-	return &Queue{cfg: cfg, ring: ring, drvE: drvE, devE: devE, wrap: true}
-}
-
-// Next returns the next available descriptor chain, or nil if no descriptors
-// are available. It returns an error if the queue's MemAt callback fails while
-// resolving an indirect descriptor, or if an indirect descriptor has a
-// malformed buffer.
-func (q *Queue) Next() (avail *Chain, err error) {
-	if len(q.ring) == 0 {
-		return
-	}
-
-	i, ok := q.advance()
-
-	if !ok {
-		return
-	}
-
-	head := i
-
-	c := &Chain{
-		q:    q,
-		id:   q.ring[head].ID,
-		skip: 1,
-		Desc: q.ring[head : head+1],
-	}
-
-	switch {
-	case q.ring[i].Continues():
-		for {
-			i, ok = q.advance()
-
-			if !ok {
-				return nil, errors.New("descriptor continues but no next descriptor is available")
-			}
-
-			if !q.ring[i].Continues() {
-				break
-			}
-		}
-
-		c.skip = i - head + 1
-		c.Desc = q.ring[head : i+1]
-
-	case q.ring[i].IsIndirect():
-		data, err := q.getBuf(q.ring[i])
-		if err != nil {
-			return nil, err
-		}
-
-		if len(data)%16 != 0 {
-			return nil, errors.New("malformed indirect buffer")
-		}
-
-		c.Desc = unsafe.Slice((*Desc)(unsafe.Pointer(&data[0])), len(data)/16)
-	}
-
-	return c, nil
-}
-
-func (q *Queue) getBuf(d Desc) (buf []byte, err error) {
-	if d.Len == 0 {
-		return
-	}
-
-	buf, err = q.cfg.MemAt(d.Addr, int(d.Len))
-	if err != nil {
-		return
-	}
-
-	if len(buf) != int(d.Len) {
-		return nil, errors.New("short buffer")
-	}
-
-	return
-}
-
-func (q *Queue) advance() (index uint16, ok bool) {
-	a := q.ring[q.aidx].Flags&DescFAvail != 0
-	u := q.ring[q.aidx].Flags&DescFUsed != 0
-	if a == u || a != q.wrap {
-		return
-	}
-
-	index = q.aidx
-	ok = true
-
-	q.aidx++
-	if q.aidx == uint16(len(q.ring)) {
-		q.aidx = 0
-	}
-
-	return
-}
-
-func (q *Queue) release(c *Chain, bytesWritten int) error {
-	d := &q.ring[q.uidx]
-	a := d.Flags&DescFAvail != 0
-	u := d.Flags&DescFUsed != 0
-	if a == u || a != q.wrap {
-		panic("ring full")
-	}
-
-	var flags uint16
-
-	if q.wrap {
-		flags |= 1<<7 | 1<<15
-	}
-
-	if bytesWritten > 0 {
-		flags |= DescFWrite
-	}
-
-	*d = Desc{
-		ID:    c.id,
-		Len:   uint32(bytesWritten),
-		Flags: flags,
-	}
-
-	uidx := q.uidx
-	wrap := q.wrap
-
-	q.uidx += c.skip
-	if q.uidx >= uint16(len(q.ring)) {
-		q.uidx -= uint16(len(q.ring))
-		q.wrap = !q.wrap
-	}
-
-	if q.drvE.ShouldNotify(uidx, wrap) {
-		return q.cfg.Notify()
-	}
-
-	return nil
-}
-
 // Buf returns a slice aliasing the buffer described by the descriptor at the
 // given index. It panics if the index is out of range. If the queue's MemAt
 // callback fails, Buf returns the error.
@@ -206,9 +85,21 @@ func (c *Chain) Buf(i int) ([]byte, error) {
 }
 
 // Release marks the chain as used, recording the number of bytes written to the
-// chain. It returns an error if the queue's Notify callback fails.
+// chain, then flushes the queue. It returns an error if the chain was already used
+// or if the queue's Notify callback fails.
 func (c *Chain) Release(bytesWritten int) error {
-	return c.q.release(c, bytesWritten)
+	if err := c.q.use(c, bytesWritten); err != nil {
+		return err
+	}
+
+	return c.q.Flush()
+}
+
+// Use marks the chain as used, recording the number of bytes written to the chain,
+// without notifying the driver. Call the queue's Flush method after using a batch of
+// chains. Use returns an error if the chain was already used.
+func (c *Chain) Use(bytesWritten int) error {
+	return c.q.use(c, bytesWritten)
 }
 
 // Continues returns true if the descriptor's buffer continues in the next descriptor.
@@ -231,9 +122,35 @@ func (d Desc) IsIndirect() bool {
 	return d.Flags&DescFIndirect != 0
 }
 
-// ShouldNotify returns true if a notification should be sent for the given
-// descriptor index and wrap counter, or false if the event is suppressed.
-func (e EventSuppress) ShouldNotify(index uint16, wrap bool) bool {
-	return e.Flags == eventFlagsEnable || (e.Flags == eventFlagsDesc &&
-		e.Desc&^(1<<15) == index && (e.Desc>>15 == 1) == wrap)
+// getBuf returns the guest memory described by d.
+func getBuf(cfg Config, d Desc) (buf []byte, err error) {
+	if d.Len == 0 {
+		return
+	}
+
+	if d.Addr+uint64(d.Len) < d.Addr {
+		return nil, errors.New("buffer address overflows")
+	}
+
+	buf, err = cfg.MemAt(d.Addr, int(d.Len))
+	if err != nil {
+		return
+	}
+
+	if len(buf) != int(d.Len) {
+		return nil, errors.New("short buffer")
+	}
+
+	return
+}
+
+// getIndirect returns the guest memory holding the indirect descriptor table
+// described by d. The table is decoded by the caller rather than aliased,
+// so its alignment doesn't matter and the driver can't change it later.
+func getIndirect(cfg Config, d Desc) ([]byte, error) {
+	if d.Len == 0 || d.Len%16 != 0 || d.Len/16 > maxIndirect {
+		return nil, errors.New("malformed indirect buffer")
+	}
+
+	return getBuf(cfg, d)
 }
@@ -3,6 +3,8 @@ package virtq_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"sync"
 	"testing"
 
 	"github.com/c35s/hype/virtio/virtq"
@@ -20,7 +22,7 @@ var nopConfig = virtq.Config{
 
 func TestQ(t *testing.T) {
 	t.Run("nil ring", func(t *testing.T) {
-		q := virtq.New(nil, nil, nil, virtq.Config{})
+		q := virtq.NewPacked(nil, nil, nil, virtq.Config{})
 		if c, err := q.Next(); c != nil || err != nil {
 			t.Errorf("c=%v err=%v", c, err)
 		}
@@ -28,7 +30,7 @@ func TestQ(t *testing.T) {
 
 	t.Run("nothing available", func(t *testing.T) {
 		ring := make([]virtq.Desc, 1)
-		q := virtq.New(ring, nil, nil, virtq.Config{})
+		q := virtq.NewPacked(ring, nil, nil, virtq.Config{})
 		if c, err := q.Next(); c != nil || err != nil {
 			t.Errorf("c=%v err=%v", c, err)
 		}
@@ -36,7 +38,7 @@ func TestQ(t *testing.T) {
 
 	t.Run("one available", func(t *testing.T) {
 		ring := []virtq.Desc{{Flags: virtq.DescFAvail | virtq.DescFWrite}}
-		q := virtq.New(ring, new(virtq.EventSuppress), nil, nopConfig)
+		q := virtq.NewPacked(ring, new(virtq.EventSuppress), nil, nopConfig)
 
 		c, err := q.Next()
 		if err != nil {
@@ -75,7 +77,7 @@ func TestQ(t *testing.T) {
 			{Flags: virtq.DescFAvail},
 		}
 
-		q := virtq.New(ring, new(virtq.EventSuppress), nil, nopConfig)
+		q := virtq.NewPacked(ring, new(virtq.EventSuppress), nil, nopConfig)
 
 		c, err := q.Next()
 		if err != nil {
@@ -109,7 +111,7 @@ func TestQ(t *testing.T) {
 			{Addr: 0x1, Len: uint32(buf.Len()), Flags: virtq.DescFAvail | virtq.DescFIndirect},
 		}
 
-		q := virtq.New(ring, nil, nil, virtq.Config{
+		q := virtq.NewPacked(ring, nil, nil, virtq.Config{
 			MemAt: func(addr uint64, len int) ([]byte, error) {
 				if addr != 0x1 {
 					t.Errorf("descriptor addr %#x != %#x", addr, 0x1)
@@ -129,11 +131,35 @@ func TestQ(t *testing.T) {
 		}
 	})
 
+	t.Run("chain longer than ring", func(t *testing.T) {
+		ring := []virtq.Desc{
+			{Flags: virtq.DescFAvail | virtq.DescFNext},
+			{Flags: virtq.DescFAvail | virtq.DescFNext},
+		}
+
+		q := virtq.NewPacked(ring, new(virtq.EventSuppress), nil, nopConfig)
+		if _, err := q.Next(); err == nil {
+			t.Error("no error for a chain that doesn't end")
+		}
+	})
+
+	t.Run("indirect continues", func(t *testing.T) {
+		ring := []virtq.Desc{
+			{Len: 16, Flags: virtq.DescFAvail | virtq.DescFIndirect | virtq.DescFNext},
+			{Flags: virtq.DescFAvail},
+		}
+
+		q := virtq.NewPacked(ring, new(virtq.EventSuppress), nil, nopConfig)
+		if _, err := q.Next(); err == nil {
+			t.Error("no error for an indirect descriptor with the next flag")
+		}
+	})
+
 	t.Run("data", func(t *testing.T) {
 		data := []byte("hello")
 		ring := []virtq.Desc{{Addr: 0x1, Len: uint32(len(data)), Flags: virtq.DescFAvail}}
 
-		q := virtq.New(ring, nil, nil, virtq.Config{
+		q := virtq.NewPacked(ring, nil, nil, virtq.Config{
 			MemAt: func(addr uint64, len int) ([]byte, error) {
 				if addr != 0x1 {
 					t.Errorf("descriptor addr %#x != %#x", addr, 0x1)
@@ -159,7 +185,7 @@ func TestQ(t *testing.T) {
 	})
 
 	t.Run("data for a bad descriptor", func(t *testing.T) {
-		q := virtq.New([]virtq.Desc{{Flags: virtq.DescFAvail}}, nil, nil, virtq.Config{})
+		q := virtq.NewPacked([]virtq.Desc{{Flags: virtq.DescFAvail}}, nil, nil, virtq.Config{})
 		c, err := q.Next()
 		if err != nil {
 			t.Fatal(err)
@@ -175,3 +201,762 @@ func TestQ(t *testing.T) {
 		t.Fatal("unreachable")
 	})
 }
+
+func TestSplitQ(t *testing.T) {
+	le := binary.LittleEndian
+
+	// newSplit returns a split queue and its driver and device areas
+	newSplit := func(t *testing.T, desc []virtq.SplitDesc, cfg virtq.Config) (*virtq.SplitQueue, []byte, []byte) {
+		drvA := make([]byte, virtq.SplitDriverAreaSize(len(desc)))
+		devA := make([]byte, virtq.SplitDeviceAreaSize(len(desc)))
+
+		q, err := virtq.NewSplit(desc, drvA, devA, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return q, drvA, devA
+	}
+
+	// makeAvail appends heads to the available ring
+	makeAvail := func(drvA []byte, n int, heads ...uint16) {
+		idx := le.Uint16(drvA[2:])
+		for _, h := range heads {
+			le.PutUint16(drvA[4+2*(int(idx)%n):], h)
+			idx++
+		}
+
+		le.PutUint16(drvA[2:], idx)
+	}
+
+	t.Run("nil table", func(t *testing.T) {
+		q, _, _ := newSplit(t, nil, virtq.Config{})
+		if c, err := q.Next(); c != nil || err != nil {
+			t.Errorf("c=%v err=%v", c, err)
+		}
+	})
+
+	t.Run("bad size", func(t *testing.T) {
+		if _, err := virtq.NewSplit(make([]virtq.SplitDesc, 3), make([]byte, 64), make([]byte, 64), nopConfig); err == nil {
+			t.Error("no error for a non-power-of-2 size")
+		}
+
+		if _, err := virtq.NewSplit(make([]virtq.SplitDesc, 4), make([]byte, 4), make([]byte, 4), nopConfig); err == nil {
+			t.Error("no error for small areas")
+		}
+	})
+
+	t.Run("nothing available", func(t *testing.T) {
+		q, _, _ := newSplit(t, make([]virtq.SplitDesc, 4), nopConfig)
+		if c, err := q.Next(); c != nil || err != nil {
+			t.Errorf("c=%v err=%v", c, err)
+		}
+	})
+
+	t.Run("one available", func(t *testing.T) {
+		desc := make([]virtq.SplitDesc, 4)
+		desc[2] = virtq.SplitDesc{Addr: 0x1, Len: 1, Flags: virtq.DescFWrite}
+
+		notified := 0
+		q, drvA, devA := newSplit(t, desc, virtq.Config{
+			MemAt:  nopMemAt,
+			Notify: func() error { notified++; return nil },
+		})
+
+		makeAvail(drvA, len(desc), 2)
+
+		c, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c.Desc) != 1 || c.Desc[0].Addr != 0x1 {
+			t.Fatalf("unexpected chain: %+v", c.Desc)
+		}
+
+		if !c.Desc[0].IsWO() {
+			t.Error("chain[0] is not write-only")
+		}
+
+		if err := c.Release(1); err != nil {
+			t.Fatal(err)
+		}
+
+		if idx := le.Uint16(devA[2:]); idx != 1 {
+			t.Errorf("used idx %d != 1", idx)
+		}
+
+		if id, n := le.Uint32(devA[4:]), le.Uint32(devA[8:]); id != 2 || n != 1 {
+			t.Errorf("used elem {%d %d} != {2 1}", id, n)
+		}
+
+		if notified != 1 {
+			t.Errorf("notified %d times", notified)
+		}
+
+		if c, err := q.Next(); c != nil || err != nil {
+			t.Errorf("c=%v err=%v", c, err)
+		}
+	})
+
+	t.Run("chained", func(t *testing.T) {
+		desc := []virtq.SplitDesc{
+			{Addr: 0x1, Flags: virtq.DescFNext, Next: 3},
+			{Addr: 0x3},
+			{},
+			{Addr: 0x2, Flags: virtq.DescFNext, Next: 1},
+		}
+
+		q, drvA, _ := newSplit(t, desc, nopConfig)
+		makeAvail(drvA, len(desc), 0)
+
+		c, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c.Desc) != 3 {
+			t.Fatalf("len(chain) %d != 3", len(c.Desc))
+		}
+
+		for i, d := range c.Desc {
+			if d.Addr != uint64(i+1) {
+				t.Errorf("chain[%d].Addr %#x != %#x", i, d.Addr, i+1)
+			}
+		}
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		desc := []virtq.SplitDesc{
+			{Flags: virtq.DescFNext, Next: 1},
+			{Flags: virtq.DescFNext, Next: 0},
+		}
+
+		q, drvA, _ := newSplit(t, desc, nopConfig)
+		makeAvail(drvA, len(desc), 0)
+
+		if _, err := q.Next(); err == nil {
+			t.Error("no error for a looping chain")
+		}
+	})
+
+	t.Run("next out of range", func(t *testing.T) {
+		desc := []virtq.SplitDesc{
+			{Flags: virtq.DescFNext, Next: 2},
+			{},
+		}
+
+		q, drvA, _ := newSplit(t, desc, nopConfig)
+		makeAvail(drvA, len(desc), 0)
+
+		if _, err := q.Next(); err == nil {
+			t.Error("no error for an out-of-range next index")
+		}
+	})
+
+	t.Run("avail idx out of range", func(t *testing.T) {
+		q, drvA, _ := newSplit(t, make([]virtq.SplitDesc, 2), nopConfig)
+		le.PutUint16(drvA[2:], 3)
+
+		if _, err := q.Next(); err == nil {
+			t.Error("no error for an out-of-range avail idx")
+		}
+	})
+
+	t.Run("malformed indirect", func(t *testing.T) {
+		desc := []virtq.SplitDesc{{Addr: 0x10, Len: 15, Flags: virtq.DescFIndirect}}
+		q, drvA, _ := newSplit(t, desc, virtq.Config{MemAt: fuzzMem(make([]byte, 64))})
+		makeAvail(drvA, len(desc), 0)
+
+		if _, err := q.Next(); err == nil {
+			t.Error("no error for a malformed indirect table")
+		}
+	})
+
+	t.Run("indirect", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		table := []virtq.SplitDesc{
+			{Addr: 0x10, Flags: virtq.DescFNext, Next: 1},
+			{Addr: 0x20, Flags: virtq.DescFWrite},
+		}
+
+		if err := binary.Write(buf, le, table); err != nil {
+			t.Fatal(err)
+		}
+
+		desc := []virtq.SplitDesc{
+			{Addr: 0x1, Len: uint32(buf.Len()), Flags: virtq.DescFIndirect},
+		}
+
+		q, drvA, _ := newSplit(t, desc, virtq.Config{
+			MemAt: func(addr uint64, len int) ([]byte, error) {
+				if addr != 0x1 {
+					t.Errorf("descriptor addr %#x != %#x", addr, 0x1)
+				}
+
+				return buf.Bytes(), nil
+			},
+		})
+
+		makeAvail(drvA, len(desc), 0)
+
+		c, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c.Desc) != 2 {
+			t.Fatalf("len(chain) %d != 2", len(c.Desc))
+		}
+
+		if c.Desc[1].Addr != 0x20 || !c.Desc[1].IsWO() {
+			t.Errorf("unexpected chain[1]: %+v", c.Desc[1])
+		}
+	})
+
+	t.Run("event idx", func(t *testing.T) {
+		desc := make([]virtq.SplitDesc, 4)
+
+		notified := 0
+		q, drvA, _ := newSplit(t, desc, virtq.Config{
+			MemAt:    nopMemAt,
+			Notify:   func() error { notified++; return nil },
+			EventIdx: true,
+		})
+
+		// used_event: notify when the used idx passes 1
+		le.PutUint16(drvA[4+2*len(desc):], 1)
+		makeAvail(drvA, len(desc), 0, 1)
+
+		for i, want := range []int{0, 1} {
+			c, err := q.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.Release(0); err != nil {
+				t.Fatal(err)
+			}
+
+			if notified != want {
+				t.Errorf("release %d: notified %d != %d", i, notified, want)
+			}
+		}
+	})
+
+	t.Run("no interrupt", func(t *testing.T) {
+		desc := make([]virtq.SplitDesc, 4)
+
+		notified := 0
+		q, drvA, _ := newSplit(t, desc, virtq.Config{
+			MemAt:  nopMemAt,
+			Notify: func() error { notified++; return nil },
+		})
+
+		le.PutUint16(drvA, 1) // VIRTQ_AVAIL_F_NO_INTERRUPT
+		makeAvail(drvA, len(desc), 0)
+
+		c, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Release(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if notified != 0 {
+			t.Errorf("notified %d times", notified)
+		}
+	})
+}
+
+func TestPackedOutOfOrder(t *testing.T) {
+	ring := []virtq.Desc{
+		{Addr: 0xa, ID: 7, Flags: virtq.DescFAvail},
+		{Addr: 0xb, ID: 8, Flags: virtq.DescFAvail | virtq.DescFNext},
+		{Addr: 0xc, ID: 9, Flags: virtq.DescFAvail},
+		{},
+	}
+
+	q := virtq.NewPacked(ring, new(virtq.EventSuppress), nil, nopConfig)
+
+	a, err := q.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := q.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Release(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// b's used descriptor overwrote a's slot
+	if ring[0].ID != 9 || ring[0].Flags&(virtq.DescFAvail|virtq.DescFUsed) != virtq.DescFAvail|virtq.DescFUsed {
+		t.Errorf("unexpected used descriptor for b: %+v", ring[0])
+	}
+
+	if a.Desc[0].Addr != 0xa || a.Desc[0].ID != 7 {
+		t.Errorf("a's descriptor changed: %+v", a.Desc[0])
+	}
+
+	if err := a.Release(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a's used descriptor follows b's 2-descriptor chain
+	if ring[2].ID != 7 {
+		t.Errorf("unexpected used descriptor for a: %+v", ring[2])
+	}
+
+	if err := a.Release(0); err == nil {
+		t.Error("no error releasing a twice")
+	}
+}
+
+func TestPackedWrap(t *testing.T) {
+	ring := make([]virtq.Desc, 3)
+	q := virtq.NewPacked(ring, new(virtq.EventSuppress), nil, nopConfig)
+
+	var (
+		aidx int
+		wrap = true
+	)
+
+	// makeAvail makes the next ring slot available like a driver would
+	makeAvail := func(id uint16) {
+		flags := uint16(virtq.DescFAvail)
+		if !wrap {
+			flags = virtq.DescFUsed
+		}
+
+		ring[aidx] = virtq.Desc{ID: id, Flags: flags}
+
+		aidx++
+		if aidx == len(ring) {
+			aidx = 0
+			wrap = !wrap
+		}
+	}
+
+	for round := 0; round < 5; round++ {
+		makeAvail(uint16(2 * round))
+		makeAvail(uint16(2*round + 1))
+
+		a, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a == nil || b == nil {
+			t.Fatalf("round %d: missing chain: a=%v b=%v", round, a, b)
+		}
+
+		if c, err := q.Next(); c != nil || err != nil {
+			t.Fatalf("round %d: c=%v err=%v", round, c, err)
+		}
+
+		// out of order
+		if err := b.Release(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := a.Release(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBatchedNotify(t *testing.T) {
+	ring := make([]virtq.Desc, 4)
+	for i := range ring {
+		ring[i] = virtq.Desc{ID: uint16(i), Flags: virtq.DescFAvail}
+	}
+
+	// notify when the used descriptor at index 2 (wrap 1) is written
+	drvE := &virtq.EventSuppress{Flags: 0x2, Desc: 2 | 1<<15}
+
+	notified := 0
+	q := virtq.NewPacked(ring, drvE, nil, virtq.Config{
+		MemAt:  nopMemAt,
+		Notify: func() error { notified++; return nil },
+	})
+
+	for i := 0; i < 2; i++ {
+		c, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Use(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if notified != 0 {
+		t.Fatalf("notified %d times before the event index", notified)
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Use(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := q.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if notified != 1 {
+		t.Fatalf("notified %d times != 1", notified)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	const n = 64
+
+	packed := make([]virtq.Desc, n)
+	for i := range packed {
+		packed[i] = virtq.Desc{ID: uint16(i), Flags: virtq.DescFAvail}
+	}
+
+	split := make([]virtq.SplitDesc, n)
+	drvA := make([]byte, virtq.SplitDriverAreaSize(n))
+	devA := make([]byte, virtq.SplitDeviceAreaSize(n))
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint16(drvA[4+2*i:], uint16(i))
+	}
+
+	binary.LittleEndian.PutUint16(drvA[2:], n)
+
+	sq, err := virtq.NewSplit(split, drvA, devA, nopConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queues := map[string]virtq.Queue{
+		"packed": virtq.NewPacked(packed, new(virtq.EventSuppress), nil, nopConfig),
+		"split":  sq,
+	}
+
+	for name, q := range queues {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						c, err := q.Next()
+						if err != nil {
+							t.Error(err)
+							return
+						}
+
+						if c == nil {
+							return
+						}
+
+						if err := c.Use(1); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+
+			wg.Wait()
+
+			if err := q.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	seen := make(map[uint16]bool)
+	for _, d := range packed {
+		if d.Flags&virtq.DescFUsed == 0 {
+			t.Errorf("packed descriptor not used: %+v", d)
+		}
+
+		seen[d.ID] = true
+	}
+
+	if len(seen) != n {
+		t.Errorf("packed: %d unique used ids != %d", len(seen), n)
+	}
+
+	if idx := binary.LittleEndian.Uint16(devA[2:]); idx != n {
+		t.Errorf("split: used idx %d != %d", idx, n)
+	}
+
+	seen = make(map[uint16]bool)
+	for i := 0; i < n; i++ {
+		seen[uint16(binary.LittleEndian.Uint32(devA[4+8*i:]))] = true
+	}
+
+	if len(seen) != n {
+		t.Errorf("split: %d unique used ids != %d", len(seen), n)
+	}
+}
+
+func TestNotifySuppression(t *testing.T) {
+	t.Run("packed", func(t *testing.T) {
+		ring := make([]virtq.Desc, 4)
+		devE := new(virtq.EventSuppress)
+		q := virtq.NewPacked(ring, new(virtq.EventSuppress), devE, nopConfig)
+
+		q.DisableNotify()
+		if devE.Flags != 0x1 {
+			t.Errorf("disabled: devE.Flags=%#x", devE.Flags)
+		}
+
+		if q.EnableNotify() {
+			t.Error("enabled: pending with nothing available")
+		}
+
+		if devE.Flags != 0x0 {
+			t.Errorf("enabled: devE.Flags=%#x", devE.Flags)
+		}
+
+		q.DisableNotify()
+		ring[0] = virtq.Desc{ID: 1, Flags: virtq.DescFAvail}
+
+		if !q.EnableNotify() {
+			t.Error("enabled: not pending with a descriptor available")
+		}
+	})
+
+	t.Run("packed event idx", func(t *testing.T) {
+		ring := []virtq.Desc{{ID: 1, Flags: virtq.DescFAvail}, {}}
+		devE := new(virtq.EventSuppress)
+		q := virtq.NewPacked(ring, new(virtq.EventSuppress), devE, virtq.Config{
+			MemAt:    nopMemAt,
+			Notify:   nopNotify,
+			EventIdx: true,
+		})
+
+		if c, err := q.Next(); c == nil || err != nil {
+			t.Fatalf("c=%v err=%v", c, err)
+		}
+
+		if devE.Flags != 0x2 || devE.Desc != 1|1<<15 {
+			t.Errorf("devE=%+v", *devE)
+		}
+
+		q.DisableNotify()
+		if devE.Flags != 0x1 {
+			t.Errorf("disabled: devE.Flags=%#x", devE.Flags)
+		}
+	})
+
+	t.Run("split", func(t *testing.T) {
+		const n = 4
+
+		var (
+			desc = make([]virtq.SplitDesc, n)
+			drvA = make([]byte, virtq.SplitDriverAreaSize(n))
+			devA = make([]byte, virtq.SplitDeviceAreaSize(n))
+		)
+
+		q, err := virtq.NewSplit(desc, drvA, devA, nopConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q.DisableNotify()
+		if flags := binary.LittleEndian.Uint16(devA); flags != 1 {
+			t.Errorf("disabled: used flags=%#x", flags)
+		}
+
+		if q.EnableNotify() {
+			t.Error("enabled: pending with nothing available")
+		}
+
+		if flags := binary.LittleEndian.Uint16(devA); flags != 0 {
+			t.Errorf("enabled: used flags=%#x", flags)
+		}
+
+		q.DisableNotify()
+		binary.LittleEndian.PutUint16(drvA[2:], 1)
+
+		if !q.EnableNotify() {
+			t.Error("enabled: not pending with a chain available")
+		}
+	})
+
+	t.Run("split event idx", func(t *testing.T) {
+		const n = 4
+
+		var (
+			desc = make([]virtq.SplitDesc, n)
+			drvA = make([]byte, virtq.SplitDriverAreaSize(n))
+			devA = make([]byte, virtq.SplitDeviceAreaSize(n))
+		)
+
+		q, err := virtq.NewSplit(desc, drvA, devA, virtq.Config{
+			MemAt:    nopMemAt,
+			Notify:   nopNotify,
+			EventIdx: true,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		binary.LittleEndian.PutUint16(drvA[2:], 2)
+
+		q.DisableNotify()
+		if flags := binary.LittleEndian.Uint16(devA); flags != 0 {
+			t.Errorf("disabled: used flags=%#x with event idx", flags)
+		}
+
+		if c, err := q.Next(); c == nil || err != nil {
+			t.Fatalf("c=%v err=%v", c, err)
+		}
+
+		if e := binary.LittleEndian.Uint16(devA[4+8*n:]); e != 0 {
+			t.Errorf("disabled: avail_event=%d", e)
+		}
+
+		if !q.EnableNotify() {
+			t.Error("enabled: not pending with a chain available")
+		}
+
+		if e := binary.LittleEndian.Uint16(devA[4+8*n:]); e != 1 {
+			t.Errorf("enabled: avail_event=%d", e)
+		}
+	})
+}
+
+// fuzzMem returns a MemAt callback over mem that fails for out-of-range addresses.
+func fuzzMem(mem []byte) func(addr uint64, len int) ([]byte, error) {
+	return func(addr uint64, n int) ([]byte, error) {
+		if n < 0 || addr > uint64(len(mem)) || uint64(n) > uint64(len(mem))-addr {
+			return nil, errors.New("out of range")
+		}
+
+		return mem[addr : addr+uint64(n)], nil
+	}
+}
+
+// drain consumes and uses every chain in q, touching every buffer.
+func drain(q virtq.Queue, max int) {
+	q.DisableNotify()
+	for i := 0; i < max; i++ {
+		c, err := q.Next()
+		if err != nil || c == nil {
+			break
+		}
+
+		var n int
+		for j := range c.Desc {
+			if buf, err := c.Buf(j); err == nil && c.Desc[j].IsWO() {
+				n += copy(buf, "fuzz")
+			}
+		}
+
+		c.Use(n)
+		c.Use(n)
+	}
+
+	q.Flush()
+	q.EnableNotify()
+}
+
+func FuzzPackedQ(f *testing.F) {
+	f.Add(uint8(4), []byte{}, false)
+	f.Add(uint8(2), []byte{
+		0x20, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0x81, 0,
+		0x30, 0, 0, 0, 0, 0, 0, 0, 32, 0, 0, 0, 2, 0, 0x84, 0,
+		1, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0,
+		0x40, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0x06, 0,
+	}, true)
+
+	f.Fuzz(func(t *testing.T, n uint8, mem []byte, eventIdx bool) {
+		ring := make([]virtq.Desc, n)
+		for i := range ring {
+			if len(mem) < 16*(i+1) {
+				break
+			}
+
+			ring[i] = virtq.Desc{
+				Addr:  binary.LittleEndian.Uint64(mem[16*i:]),
+				Len:   binary.LittleEndian.Uint32(mem[16*i+8:]),
+				ID:    binary.LittleEndian.Uint16(mem[16*i+12:]),
+				Flags: binary.LittleEndian.Uint16(mem[16*i+14:]),
+			}
+		}
+
+		q := virtq.NewPacked(ring, new(virtq.EventSuppress), new(virtq.EventSuppress), virtq.Config{
+			MemAt:    fuzzMem(mem),
+			Notify:   nopNotify,
+			EventIdx: eventIdx,
+		})
+
+		drain(q, 2*len(ring)+1)
+	})
+}
+
+func FuzzSplitQ(f *testing.F) {
+	f.Add(uint8(4), []byte{}, []byte{}, false)
+	f.Add(uint8(2), []byte{
+		0x20, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 1, 0, 1, 0,
+		0x30, 0, 0, 0, 0, 0, 0, 0, 16, 0, 0, 0, 6, 0, 0, 0,
+	}, []byte{0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, true)
+
+	f.Fuzz(func(t *testing.T, n uint8, mem, drv []byte, eventIdx bool) {
+		desc := make([]virtq.SplitDesc, n)
+		for i := range desc {
+			if len(mem) < 16*(i+1) {
+				break
+			}
+
+			desc[i] = virtq.SplitDesc{
+				Addr:  binary.LittleEndian.Uint64(mem[16*i:]),
+				Len:   binary.LittleEndian.Uint32(mem[16*i+8:]),
+				Flags: binary.LittleEndian.Uint16(mem[16*i+12:]),
+				Next:  binary.LittleEndian.Uint16(mem[16*i+14:]),
+			}
+		}
+
+		var (
+			drvA = make([]byte, virtq.SplitDriverAreaSize(int(n)))
+			devA = make([]byte, virtq.SplitDeviceAreaSize(int(n)))
+		)
+
+		copy(drvA, drv)
+
+		q, err := virtq.NewSplit(desc, drvA, devA, virtq.Config{
+			MemAt:    fuzzMem(mem),
+			Notify:   nopNotify,
+			EventIdx: eventIdx,
+		})
+
+		if err != nil {
+			return
+		}
+
+		drain(q, 2*len(desc)+1)
+	})
+}
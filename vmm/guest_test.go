@@ -9,10 +9,11 @@ import (
 
 	"github.com/c35s/hype/virtio"
 	"github.com/c35s/hype/vmm"
+	"github.com/c35s/hype/vmm/vmmtest"
 )
 
 func TestConsole(t *testing.T) {
-	GuestTest{
+	vmmtest.GuestTest{
 		Host: func(t *testing.T, runGuest func(vmm.Config)) {
 			out := new(bytes.Buffer)
 			runGuest(vmm.Config{
@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"runtime"
@@ -83,6 +84,7 @@ type Arch interface {
 
 type VM struct {
 	fd   *kvm.VM
+	sfd  *os.File // binary stats; nil if unsupported
 	mem  []byte
 	cpu  []*vcpu
 	mmio *mmio.Bus
@@ -114,11 +116,13 @@ var (
 	ErrSetupVCPU           = errors.New("vmm: VCPU setup failed")
 	ErrLoadVCPU            = errors.New("vmm: VCPU load failed")
 	ErrVMClosed            = errors.New("vmm: VM closed")
+	ErrStatsUnavailable    = errors.New("vmm: stats unavailable")
 )
 
 // vcpu collects a VCPU fd and its mmaped state.
 type vcpu struct {
 	fd    *kvm.VCPU
+	sfd   *os.File // binary stats; nil if unsupported
 	mm    []byte
 	opC   chan vcpuOp
 	doneC chan struct{}
@@ -199,6 +203,17 @@ func New(cfg Config) (*VM, error) {
 		return nil, fmt.Errorf("%w: %w", ErrGetVCPUMmapSize, err)
 	}
 
+	// binary stats and ioeventfds are optional
+	hasStats, _ := kvm.CheckExtension(sys, kvm.CapBinaryStatsFD)
+	hasIOEventFD, _ := kvm.CheckExtension(sys, kvm.CapIOEventFD)
+
+	var sfd *os.File
+	if hasStats == 1 {
+		if sfd, err = kvm.GetStatsFD(vm); err != nil {
+			return nil, fmt.Errorf("%w: get stats fd: %w", ErrSetup, err)
+		}
+	}
+
 	// create VCPUs
 	cpu := make([]*vcpu, 1)
 	for slot := range cpu {
@@ -214,6 +229,10 @@ func New(cfg Config) (*VM, error) {
 				op.C <- op.F()
 			}
 
+			if c.sfd != nil {
+				c.sfd.Close()
+			}
+
 			if c.fd != nil {
 				c.fd.Close()
 			}
@@ -242,6 +261,12 @@ func New(cfg Config) (*VM, error) {
 				return fmt.Errorf("%w: slot %d: %w", ErrSetupVCPU, slot, err)
 			}
 
+			if hasStats == 1 {
+				if c.sfd, err = kvm.GetStatsFD(fd); err != nil {
+					return fmt.Errorf("%w: slot %d: get stats fd: %w", ErrSetupVCPU, slot, err)
+				}
+			}
+
 			return nil
 		})
 
@@ -254,15 +279,20 @@ func New(cfg Config) (*VM, error) {
 
 	m := &VM{
 		fd:    vm,
+		sfd:   sfd,
 		cpu:   cpu,
 		mem:   mem,
 		irqf:  make(map[int]int),
 		doneC: make(chan struct{}),
 	}
 
-	m.mmio, err = mmio.NewBus(cfg.Devices, mmio.Config{
-		MemAt: func(addr uint64, len int) ([]byte, error) {
-			return m.mem[addr : addr+uint64(len)], nil
+	mcfg := mmio.Config{
+		MemAt: func(addr uint64, size int) ([]byte, error) {
+			if size < 0 || addr > uint64(len(m.mem)) || uint64(size) > uint64(len(m.mem))-addr {
+				return nil, fmt.Errorf("guest memory [%#x+%d] is out of range", addr, size)
+			}
+
+			return m.mem[addr : addr+uint64(size)], nil
 		},
 
 		Notify: func(irq int) error {
@@ -274,7 +304,27 @@ func New(cfg Config) (*VM, error) {
 
 			return nil
 		},
-	})
+	}
+
+	if hasIOEventFD == 1 {
+		mcfg.IOEventFD = func(addr uint64, data uint32, fd int, assign bool) error {
+			iocfg := kvm.IOEventFDConfig{
+				Addr:      addr,
+				Len:       4,
+				Datamatch: uint64(data),
+				Fd:        int32(fd),
+				Flags:     kvm.IOEventFDFlagDatamatch,
+			}
+
+			if !assign {
+				iocfg.Flags |= kvm.IOEventFDFlagDeassign
+			}
+
+			return kvm.IOEventFD(m.fd, &iocfg)
+		}
+	}
+
+	m.mmio, err = mmio.NewBus(cfg.Devices, mcfg)
 
 	if err != nil {
 		return nil, fmt.Errorf("vm: create mmio bus: %w", err)
@@ -389,8 +439,9 @@ func (m *VM) Run(ctx context.Context) error {
 
 			case kvm.ExitMMIO:
 				xd := state.MMIOExitData()
+				// the bus fails the device, so the guest can't crash the VMM with bad MMIO
 				if _, err := m.mmio.HandleMMIO(xd.PhysAddr, xd.Data[:xd.Len], xd.IsWrite); err != nil {
-					panic(err)
+					slog.Warn("mmio", "addr", xd.PhysAddr, "write", xd.IsWrite, "err", err)
 				}
 
 			case kvm.ExitShutdown:
@@ -429,6 +480,12 @@ func (m *VM) Close() error {
 		return fmt.Errorf("close mmio: %w", err)
 	}
 
+	if m.sfd != nil {
+		if err := m.sfd.Close(); err != nil {
+			return fmt.Errorf("close stats fd: %w", err)
+		}
+	}
+
 	if err := m.fd.Close(); err != nil {
 		return fmt.Errorf("close vm fd: %w", err)
 	}
@@ -440,6 +497,86 @@ func (m *VM) Close() error {
 	return nil
 }
 
+// Stats returns the VM's KVM statistics, like exits, halt polls, and page faults,
+// keyed by name. VM-wide statistics are named like "vm.remote_tlb_flush" and per-VCPU
+// statistics are named like "vcpu0.exits". Each bucket of a histogram statistic has its
+// own key, like "vcpu0.halt_poll_success_hist[3]". Stats returns ErrStatsUnavailable
+// if KVM doesn't support binary stats.
+func (m *VM) Stats() (map[string]uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.doneC:
+		return nil, ErrVMClosed
+
+	default:
+		break
+	}
+
+	if m.sfd == nil {
+		return nil, ErrStatsUnavailable
+	}
+
+	stats := make(map[string]uint64)
+	if err := readStats(stats, "vm", m.sfd); err != nil {
+		return nil, err
+	}
+
+	for slot, c := range m.cpu {
+		if err := readStats(stats, fmt.Sprintf("vcpu%d", slot), c.sfd); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// BlockStats returns the I/O statistics of the VM's block devices, keyed by
+// their indexes in Config.Devices.
+func (m *VM) BlockStats() (map[int]virtio.BlockStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.doneC:
+		return nil, ErrVMClosed
+
+	default:
+		break
+	}
+
+	stats := make(map[int]virtio.BlockStats)
+	for i := range m.mmio.Devices() {
+		if r, ok := m.mmio.Handler(i).(virtio.BlockStatsReporter); ok {
+			stats[i] = r.BlockStats()
+		}
+	}
+
+	return stats, nil
+}
+
+// readStats reads binary stats from f into m, prefixing each name with prefix.
+func readStats(m map[string]uint64, prefix string, f *os.File) error {
+	ss, err := kvm.ReadStats(f)
+	if err != nil {
+		return fmt.Errorf("read %s stats: %w", prefix, err)
+	}
+
+	for _, s := range ss {
+		if !s.IsHistogram() && len(s.Value) == 1 {
+			m[prefix+"."+s.Name] = s.Value[0]
+			continue
+		}
+
+		for i, v := range s.Value {
+			m[fmt.Sprintf("%s.%s[%d]", prefix, s.Name, i)] = v
+		}
+	}
+
+	return nil
+}
+
 func (c *vcpu) State() *kvm.VCPUState {
 	return (*kvm.VCPUState)(unsafe.Pointer(&c.mm[0]))
 }
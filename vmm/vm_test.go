@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/c35s/hype/kvm"
+	"github.com/c35s/hype/virtio"
 	"github.com/c35s/hype/vmm"
 )
 
@@ -147,6 +148,71 @@ func TestLoadVCPUError(t *testing.T) {
 	}
 }
 
+func TestStats(t *testing.T) {
+	m, err := vmm.New(vmm.Config{
+		Loader: nopLoader{},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := m.Stats()
+	if errors.Is(err, vmm.ErrStatsUnavailable) {
+		t.Skip(err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"vm.remote_tlb_flush", "vcpu0.exits", "vcpu0.halt_exits"} {
+		if _, ok := stats[name]; !ok {
+			t.Errorf("missing stat %s", name)
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Stats(); !errors.Is(err, vmm.ErrVMClosed) {
+		t.Errorf("error isn't ErrVMClosed: %v", err)
+	}
+}
+
+func TestBlockStats(t *testing.T) {
+	m, err := vmm.New(vmm.Config{
+		Devices: []virtio.DeviceConfig{
+			&virtio.ConsoleDevice{},
+			&virtio.BlockDevice{Storage: &virtio.MemStorage{Bytes: make([]byte, 1<<20)}},
+		},
+
+		Loader: nopLoader{},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := m.BlockStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := stats[1]; !ok || len(stats) != 1 {
+		t.Errorf("stats for devices %v, want [1]", stats)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.BlockStats(); !errors.Is(err, vmm.ErrVMClosed) {
+		t.Errorf("error isn't ErrVMClosed: %v", err)
+	}
+}
+
 type nopLoader struct {
 	LoadMemoryError error
 	LoadVCPUError   error
@@ -0,0 +1,142 @@
+//go:build linux
+
+package vmmtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	resultsMu sync.Mutex
+	results   []result
+)
+
+func recordResult(r result) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	results = append(results, r)
+}
+
+// runGuestMain runs the tests in the guest, reports the results, and reboots.
+func runGuestMain(m *testing.M) {
+	code := m.Run()
+
+	resultsMu.Lock()
+	r := report{Code: code, Tests: results}
+	resultsMu.Unlock()
+
+	// the host fails the test if the report doesn't arrive, so an error
+	// here is only logged to the console
+	if err := sendReport(r); err != nil {
+		fmt.Fprintf(os.Stderr, "vmmtest: send report: %v\n", err)
+	}
+
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART); err != nil {
+		panic(err)
+	}
+
+	select {}
+}
+
+// sendReport writes the report to the report port and waits for the host to
+// acknowledge it, so the VM doesn't reboot before the host reads it.
+func sendReport(r report) error {
+	path, err := openPort(portName)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	ackC := make(chan error, 1)
+	go func() {
+		_, err := f.Read(make([]byte, 1))
+		ackC <- err
+	}()
+
+	select {
+	case err := <-ackC:
+		return err
+
+	case <-time.After(5 * time.Second):
+		return errors.New("no acknowledgement from the host")
+	}
+}
+
+// openPort waits for the console port with the given name to appear in sysfs
+// and returns the path of a device node for it. Nothing is mounted when the
+// test binary starts as /init, so openPort mounts sysfs and makes the node.
+func openPort(name string) (string, error) {
+	if _, err := os.Stat("/sys/class"); err != nil {
+		if err := os.MkdirAll("/sys", 0755); err != nil {
+			return "", err
+		}
+
+		if err := unix.Mount("sysfs", "/sys", "sysfs", 0, ""); err != nil {
+			return "", fmt.Errorf("mount sysfs: %w", err)
+		}
+	}
+
+	// the port is named by a control message after the driver probes it
+	var dev string
+	for deadline := time.Now().Add(5 * time.Second); dev == ""; {
+		names, _ := filepath.Glob("/sys/class/virtio-ports/*/name")
+		for _, n := range names {
+			if b, err := os.ReadFile(n); err == nil && strings.TrimSpace(string(b)) == name {
+				dev = filepath.Dir(n)
+			}
+		}
+
+		if dev == "" && time.Now().After(deadline) {
+			return "", fmt.Errorf("no console port named %s", name)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dev, "dev"))
+	if err != nil {
+		return "", err
+	}
+
+	var major, minor uint32
+	if _, err := fmt.Sscanf(string(b), "%d:%d", &major, &minor); err != nil {
+		return "", fmt.Errorf("parse %s/dev: %w", dev, err)
+	}
+
+	if err := os.MkdirAll("/dev", 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join("/dev", filepath.Base(dev))
+	err = unix.Mknod(path, unix.S_IFCHR|0600, int(unix.Mkdev(major, minor)))
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return "", fmt.Errorf("make %s: %w", path, err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,378 @@
+//go:build linux
+
+// Package vmmtest runs Go tests inside hype guests. Main rebuilds the test
+// binary for the guest and packs it into an initrd as /init. Each GuestTest
+// boots its own VM, which runs just that test and reports the result to the
+// host over a virtio console port.
+//
+// Call Main from TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		vmmtest.Main(m, vmmtest.Config{Kernel: "path/to/bzImage"})
+//	}
+//
+// The guest binary is built from the package under test with the "guest"
+// build tag, so guest-only code can live in files with a guest constraint.
+package vmmtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c35s/hype/os/linux"
+	"github.com/c35s/hype/virtio"
+	"github.com/c35s/hype/virtio/expect"
+	"github.com/c35s/hype/vmm"
+	"github.com/cavaliergopher/cpio"
+)
+
+// Config configures the guest tests of a package.
+type Config struct {
+
+	// Kernel is the path to the guest kernel. It's only read on the host.
+	Kernel string
+
+	// Timeout limits how long each guest runs.
+	// If Timeout is 0, guests time out after a minute.
+	Timeout time.Duration
+}
+
+// GuestTest is a test with a host half and a guest half. The host half
+// configures a VM and calls runGuest to boot it. The guest half runs in the
+// VM. The test fails if the guest half fails or doesn't report its result.
+type GuestTest struct {
+	Host  func(t *testing.T, runGuest func(vmm.Config))
+	Guest func(t *testing.T)
+
+	// Timeout, if set, overrides Config.Timeout.
+	Timeout time.Duration
+}
+
+// guest is set to the string "guest" using -ldflags "-X ..." when the test
+// binary destined to become /init is built.
+var guest string
+
+// IsGuest reports whether the tests are running in a guest.
+func IsGuest() bool {
+	return guest == "guest"
+}
+
+// portName is the name of the console port that carries the guest's report.
+const portName = "hype.vmmtest"
+
+// report is the guest's report. It's sent as a line of JSON.
+type report struct {
+	Code  int      `json:"code"`
+	Tests []result `json:"tests"`
+}
+
+// result is the result of the guest half of a test.
+type result struct {
+	Name    string        `json:"name"`
+	Passed  bool          `json:"passed"`
+	Skipped bool          `json:"skipped"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+var (
+	config Config
+	kernel []byte
+	initrd []byte
+)
+
+// Main runs the tests. On the host, it builds the guest's initrd before
+// running them. In the guest, it runs the tests, reports the results, and
+// reboots, since PID 1 can't exit. Main doesn't return.
+func Main(m *testing.M, cfg Config) {
+	if IsGuest() {
+		runGuestMain(m)
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Minute
+	}
+
+	config = cfg
+
+	kb, err := os.ReadFile(cfg.Kernel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vmmtest: read kernel: %v\n", err)
+		os.Exit(1)
+	}
+
+	kernel = kb
+
+	ib, err := buildInitrd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vmmtest: build initrd: %v\n", err)
+		os.Exit(1)
+	}
+
+	initrd = ib
+
+	os.Exit(m.Run())
+}
+
+// buildInitrd builds a static test binary for the package in the current
+// directory and packs it into a gzipped cpio archive as /init.
+func buildInitrd() ([]byte, error) {
+	exe := new(bytes.Buffer)
+	build := exec.Command("go", "test", "-c", "-o", "/dev/stdout",
+		"-tags", "guest,netgo",
+		"-ldflags", "-X github.com/c35s/hype/vmm/vmmtest.guest=guest", ".")
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+	build.Stdout = exe
+	build.Stderr = os.Stderr
+
+	if err := build.Run(); err != nil {
+		return nil, fmt.Errorf("build test binary: %w", err)
+	}
+
+	ib := new(bytes.Buffer)
+	zw := gzip.NewWriter(ib)
+	cw := cpio.NewWriter(zw)
+
+	err := cw.WriteHeader(&cpio.Header{
+		Name: "init",
+		Mode: 0755,
+		Size: int64(exe.Len()),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cw.Write(exe.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return ib.Bytes(), nil
+}
+
+// Run runs the half of the test that belongs where it's running.
+func (gt GuestTest) Run(t *testing.T) {
+	t.Helper()
+
+	if IsGuest() {
+		t.Run("guest", func(t *testing.T) {
+			start := time.Now()
+			defer func() {
+				recordResult(result{
+					Name:    t.Name(),
+					Passed:  !t.Failed(),
+					Skipped: t.Skipped(),
+					Elapsed: time.Since(start),
+				})
+			}()
+
+			gt.Guest(t)
+		})
+
+		return
+	}
+
+	timeout := gt.Timeout
+	if timeout == 0 {
+		timeout = config.Timeout
+	}
+
+	t.Run("host", func(tt *testing.T) {
+		gt.Host(tt, func(cfg vmm.Config) {
+			runGuest(tt, t.Name()+"/guest", cfg, timeout)
+		})
+	})
+}
+
+// runGuest boots a VM that runs the named test and checks its report.
+func runGuest(t *testing.T, testName string, cfg vmm.Config, timeout time.Duration) {
+	t.Helper()
+
+	if kernel == nil {
+		t.Fatal("vmmtest.Main wasn't called")
+	}
+
+	if cfg.Loader != nil {
+		t.Fatal("loader must be nil")
+	}
+
+	var console *virtio.ConsoleDevice
+	cfg.Devices, console = copyConsole(cfg.Devices)
+
+	var outs []io.Writer
+	if console.Out != nil {
+		outs = append(outs, console.Out)
+	}
+
+	if testing.Verbose() {
+		outs = append(outs, os.Stdout)
+	}
+
+	out := expect.New(expect.Config{Out: io.MultiWriter(outs...)})
+	console.Out = out
+
+	port := newReportPort()
+	defer port.Close()
+
+	console.Ports = append(console.Ports[:len(console.Ports):len(console.Ports)], virtio.ConsolePort{
+		Name: portName,
+		RW:   port,
+	})
+
+	cfg.Loader = &linux.Loader{
+		Kernel:  kernel,
+		Initrd:  initrd,
+		Cmdline: fmt.Sprintf("reboot=t panic=-1 console=hvc0 -- -test.v -test.run=^%s$", testName),
+	}
+
+	m, err := vmm.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := m.Run(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("guest timed out after %v", timeout)
+		} else {
+			t.Error(err)
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if t.Failed() && !testing.Verbose() {
+			log := out.Log()
+			t.Logf("console output:\n%s", log[max(len(log)-8192, 0):])
+		}
+	}()
+
+	r, err := port.report()
+	if err != nil {
+		t.Fatalf("guest didn't report a result: %v", err)
+	}
+
+	var ran bool
+	for _, res := range r.Tests {
+		if res.Name != testName {
+			continue
+		}
+
+		ran = true
+
+		switch {
+		case !res.Passed:
+			t.Errorf("guest failed after %v", res.Elapsed)
+
+		case res.Skipped:
+			t.Skip("guest skipped")
+		}
+	}
+
+	if !ran {
+		t.Fatalf("guest didn't run %s", testName)
+	}
+
+	if r.Code != 0 && !t.Failed() {
+		t.Errorf("guest tests exited with code %d", r.Code)
+	}
+}
+
+// copyConsole returns a copy of devs with the last console device replaced by
+// a copy of it, or with a new console device appended if there isn't one. It
+// also returns the copied console, which runGuest modifies, so the caller's
+// config can boot more guests.
+func copyConsole(devs []virtio.DeviceConfig) ([]virtio.DeviceConfig, *virtio.ConsoleDevice) {
+	devs = append([]virtio.DeviceConfig(nil), devs...)
+	console := new(virtio.ConsoleDevice)
+
+	for i := len(devs) - 1; i >= 0; i-- {
+		if c, ok := devs[i].(*virtio.ConsoleDevice); ok {
+			*console = *c
+			devs[i] = console
+			return devs, console
+		}
+	}
+
+	return append(devs, console), console
+}
+
+// reportPort is the host side of the report port. It collects what the guest
+// writes, and acknowledges the report once it has the whole line.
+type reportPort struct {
+	ackR *io.PipeReader
+	ackW *io.PipeWriter
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	ack bool
+}
+
+func newReportPort() *reportPort {
+	pr, pw := io.Pipe()
+	return &reportPort{ackR: pr, ackW: pw}
+}
+
+func (p *reportPort) Read(b []byte) (int, error) {
+	return p.ackR.Read(b)
+}
+
+func (p *reportPort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf.Write(b)
+	if !p.ack && bytes.IndexByte(p.buf.Bytes(), '\n') >= 0 {
+		p.ack = true
+
+		// the console device reads the pipe on its own goroutine
+		go p.ackW.Write([]byte("\n"))
+	}
+
+	return len(b), nil
+}
+
+// Close ends the port's input.
+func (p *reportPort) Close() error {
+	return p.ackW.Close()
+}
+
+// report decodes the guest's report.
+func (p *reportPort) report() (report, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var r report
+	line, _, ok := bytes.Cut(p.buf.Bytes(), []byte("\n"))
+	if !ok {
+		return r, errors.New("no report")
+	}
+
+	if err := json.Unmarshal(line, &r); err != nil {
+		return r, fmt.Errorf("bad report: %w", err)
+	}
+
+	return r, nil
+}
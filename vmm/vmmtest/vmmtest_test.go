@@ -0,0 +1,107 @@
+//go:build linux
+
+package vmmtest
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/c35s/hype/virtio"
+)
+
+func TestCopyConsole(t *testing.T) {
+	blk := new(virtio.BlockDevice)
+	con := &virtio.ConsoleDevice{Ports: []virtio.ConsolePort{{Name: "a"}}}
+	devs := []virtio.DeviceConfig{con, blk}
+
+	got, c := copyConsole(devs)
+	if c == con || len(got) != 2 || got[0] != c || got[1] != blk {
+		t.Fatalf("devices %v, console %p", got, c)
+	}
+
+	c.Ports = append(c.Ports, virtio.ConsolePort{Name: portName})
+	if devs[0] != con || len(con.Ports) != 1 {
+		t.Error("the caller's devices changed")
+	}
+
+	got, c = copyConsole([]virtio.DeviceConfig{blk})
+	if len(got) != 2 || got[0] != blk || got[1] != c {
+		t.Errorf("devices %v, console %p", got, c)
+	}
+}
+
+func TestReportPort(t *testing.T) {
+	p := newReportPort()
+
+	ackC := make(chan string, 2)
+	go func() {
+		b := make([]byte, 8)
+		for {
+			n, err := p.Read(b)
+			if err != nil {
+				ackC <- err.Error()
+				return
+			}
+
+			ackC <- string(b[:n])
+		}
+	}()
+
+	p.Write([]byte(`{"code":1,"tests":[{"name":"TestX/guest",`))
+	if _, err := p.report(); err == nil {
+		t.Error("no error for a partial report")
+	}
+
+	select {
+	case ack := <-ackC:
+		t.Fatalf("ack %q before the report ended", ack)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	p.Write([]byte(`"passed":true,"elapsed":5}]}` + "\n"))
+	p.Write([]byte("trailing output\n"))
+
+	select {
+	case ack := <-ackC:
+		if ack != "\n" {
+			t.Errorf("ack %q", ack)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ack")
+	}
+
+	r, err := p.report()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := result{Name: "TestX/guest", Passed: true, Elapsed: 5}
+	if r.Code != 1 || len(r.Tests) != 1 || r.Tests[0] != want {
+		t.Errorf("report %+v", r)
+	}
+
+	// the report is acked once, and Close ends reads
+	p.Close()
+
+	select {
+	case ack := <-ackC:
+		if ack != io.EOF.Error() {
+			t.Errorf("read %q after close", ack)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads didn't end")
+	}
+}
+
+func TestReportPortBadReport(t *testing.T) {
+	p := newReportPort()
+	defer p.Close()
+
+	p.Write([]byte("not json\n"))
+	if _, err := p.report(); err == nil {
+		t.Error("no error for a bad report")
+	}
+}